@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/client"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+)
+
+func main() {
+	method := flag.String("X", "GET", "request method")
+	data := flag.String("d", "", "request body")
+	timeout := flag.Duration("timeout", 30*time.Second, "time allowed for the whole request")
+	h := headers.NewHeaders()
+	flag.Func("H", "request header as 'Name: value', repeatable", func(s string) error {
+		name, value, ok := strings.Cut(s, ":")
+		if !ok {
+			return fmt.Errorf("missing colon in %q", s)
+		}
+		h.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+		return nil
+	})
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] url\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	req, err := client.NewRequest(*method, flag.Arg(0), []byte(*data))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	req.Headers = h
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	resp, err := client.DefaultClient.Do(ctx, req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	fmt.Printf("%s %d %s\n", resp.Proto, resp.StatusCode, resp.Reason)
+	printFields(resp.Headers)
+	fmt.Println()
+	_, err = io.Copy(os.Stdout, resp.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(resp.Trailers) > 0 {
+		fmt.Println()
+		printFields(resp.Trailers)
+	}
+}
+
+func printFields(h headers.Headers) {
+	for k, v := range h {
+		for _, line := range strings.Split(v, "\n") {
+			fmt.Printf("%s: %s\n", k, line)
+		}
+	}
+}
@@ -1,36 +1,95 @@
 package main
 
 import (
-	"crypto/sha256"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
-	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/cache"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/http2"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/proxy"
 	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
 	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/router"
 	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/server"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/static"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/websocket"
 )
 
-const port = 42069
-
 func main() {
-	server, err := server.Serve(port, handler)
+	configPath := flag.String("config", os.Getenv("HTTPSERVER_CONFIG"), "YAML or JSON config file")
+	upstream := flag.String("upstream", "https://httpbin.org", "upstreams proxied under /httpbin, comma separated")
+	healthPath := flag.String("health-path", "", "path checked on each of several upstreams")
+	cacheSize := flag.Int64("cache-size", 64<<20, "bytes of proxied responses cached in memory, 0 for none")
+	cacheDir := flag.String("cache-dir", "", "directory caching proxied responses on disk")
+	cacheDirSize := flag.Int64("cache-dir-size", 1<<30, "bytes cached on disk")
+	flag.Parse()
+
+	cfg := server.DefaultConfig()
+	if *configPath != "" {
+		var err error
+		cfg, err = server.LoadConfig(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	err := cfg.ApplyEnv("HTTPSERVER")
+	if err != nil {
+		log.Fatal(err)
+	}
+	pool, err := proxy.NewPool(strings.Split(*upstream, ",")...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pool.HealthPath = *healthPath
+	pool.StartHealthChecks(context.Background())
+	httpbin := proxy.NewBalanced(pool)
+	httpbin.StripPrefix = "/httpbin"
+	httpbin.ErrorRenderer = server.RenderHTML
+	stores := []cache.Store{}
+	if *cacheSize > 0 {
+		stores = append(stores, cache.NewMemoryStore(*cacheSize))
+	}
+	if *cacheDir != "" {
+		disk, err := cache.NewDiskStore(*cacheDir, *cacheDirSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		stores = append(stores, disk)
+	}
+	if len(stores) > 0 {
+		httpbin.Transport = cache.New(nil, cache.Tiered(stores...))
+	}
+	cfg.Handler = newRouter(httpbin).ServeRequest
+
+	s, err := server.ServeConfig(cfg, http2.WithH2C())
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
-	log.Println("Server started on port", port)
+	log.Println("Server started on", s.Addr())
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
+	log.Println("Server shutting down, waiting for active connections")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if cfg.Timeouts.Shutdown > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfg.Timeouts.Shutdown))
+	}
+	defer cancel()
+	cut, err := s.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Shutdown timed out, %d connections cut: %v", cut, err)
+		return
+	}
 	log.Println("Server gracefully stopped")
 }
 
@@ -70,153 +129,62 @@ func basicHtmlWriter(w *response.Writer, req *request.Request, sc response.Statu
 		log.Printf("Error writing headers: %v", err)
 		return
 	}
-	i, err := w.WriteBody(payload)
+	_, err = w.WriteBody(payload)
 	if err != nil {
 		log.Printf("Error writing body: %v", err)
 		return
 	}
-	log.Printf("bytes written: %d\n", i)
 }
 
-func httpbinWriter(w *response.Writer, req *request.Request) {
-	destUrl := "https://httpbin.org" + strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin")
-	fmt.Println("Proxying to", destUrl)
-
-	resp, err := http.Get(destUrl)
-	if err != nil {
-		log.Printf("Error: request to httpbin.com failed: %v", err)
-		basicHtmlWriter(w, req, response.StatusInternalServerError)
-		return
-
-	}
-	sc := response.StatusOK
-
-	err = w.WriteStatusLine(sc)
-	if err != nil {
-		log.Printf("Error writing status line: %v", err)
-		return
-	}
+var wsUpgrader = &websocket.Upgrader{MaxMessageSize: 64 << 10}
 
-	h := response.GetDefaultHeaders(0)
-	h.Remove("content-length")
-	h.Set("transfer-encoding", "chunked")
-	h.Set("Trailer", "X-Content-Length")
-	h.Set("Trailer", "X-Content-SHA256")
-
-	err = w.WriteHeaders(h)
+func wsEchoHandler(w *response.Writer, req *request.Request) {
+	conn, err := wsUpgrader.Upgrade(w, req)
 	if err != nil {
-		log.Printf("Error writing headers: %v", err)
+		log.Printf("Websocket upgrade failed: %v", err)
 		return
 	}
-	fullResp := []byte{}
-	respLen := 0
 	for {
-		buf := make([]byte, 1024, 1024)
-		int, err := resp.Body.Read(buf)
+		messageType, data, err := conn.ReadMessage()
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				// _, err = w.WriteChunkedBodyDone()
-				h := headers.NewHeaders()
-				h.Set("X-Content-Length", fmt.Sprintf("%d", respLen))
-				h.Set("X-Content-SHA256", fmt.Sprintf("%x", sha256.Sum256(fullResp)))
-				err = w.WriteTrailers(h)
-				if err != nil {
-					log.Printf("Error writing chunked body end: %v", err)
-				}
-				return
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseNormalClosure {
+				log.Printf("Websocket closed: %v", err)
 			}
-			log.Printf("Error reading from httpbin to buffer: %v", err)
-			basicHtmlWriter(w, req, response.StatusInternalServerError)
-			break
-		}
-		respLen += int
-		fullResp = append(fullResp, buf[0:int]...)
-		log.Printf("Bytes read: %d", int)
-		_, err = w.WriteChunkedBody(buf)
-		if err != nil {
-			log.Printf("Error writing chunked body: %v", err)
-			basicHtmlWriter(w, req, response.StatusInternalServerError)
 			return
 		}
-	}
-
-}
-
-func fileWriter(w *response.Writer, req *request.Request) {
-	fmt.Println("Reading from /assets/vim.mp4")
-
-	content, err := os.ReadFile("assets/vim.mp4")
-	if err != nil {
-		log.Printf("error reading file: %v", err)
-		basicHtmlWriter(w, req, response.StatusInternalServerError)
-		return
-	}
-
-	sc := response.StatusOK
-	err = w.WriteStatusLine(sc)
-	if err != nil {
-		log.Printf("Error writing status line: %v", err)
-		basicHtmlWriter(w, req, response.StatusInternalServerError)
-		return
-	}
-
-	h := response.GetDefaultHeaders(0)
-	h.Remove("content-length")
-	h.Set("transfer-encoding", "chunked")
-	h.Set("Trailer", "X-Content-Length")
-	h.Set("Trailer", "X-Content-SHA256")
-	h.Override("Content-Type", "video/mp4")
-
-	err = w.WriteHeaders(h)
-	if err != nil {
-		log.Printf("Error writing headers: %v", err)
-		return
-	}
-	current := 0
-	fullLen := len(content)
-	chunkSize := 1024
-	for current < fullLen {
-		maxSize := fullLen - current
-		chunkLen := min(maxSize, chunkSize)
-		chunkEnd := chunkLen + current
-		buf := content[current:chunkEnd]
-		current = chunkEnd
-		log.Printf("Bytes read: %d", chunkLen)
-		_, err = w.WriteChunkedBody(buf)
+		err = conn.WriteMessage(messageType, data)
 		if err != nil {
-			log.Printf("Error writing chunked body: %v", err)
-			basicHtmlWriter(w, req, response.StatusInternalServerError)
+			log.Printf("Websocket write failed: %v", err)
+			conn.Close(websocket.CloseInternalServerError, "")
 			return
 		}
 	}
-	h = headers.NewHeaders()
-	h.Set("X-Content-Length", fmt.Sprintf("%d", current))
-	h.Set("X-Content-SHA256", fmt.Sprintf("%x", sha256.Sum256(content)))
-	err = w.WriteTrailers(h)
-	if err != nil {
-		log.Printf("Error writing chunked body end: %v", err)
-	}
-
 }
 
-func handler(w *response.Writer, req *request.Request) {
-	var sc response.StatusCode
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
-		httpbinWriter(w, req)
-		return
-	}
-	if req.RequestLine.RequestTarget == "/video" {
-		fileWriter(w, req)
-		return
-	} else if req.RequestLine.RequestTarget == "/yourproblem" {
-		sc = response.StatusBadRequest
-	} else if req.RequestLine.RequestTarget == "/myproblem" {
-		sc = response.StatusInternalServerError
-	} else {
-		sc = response.StatusOK
-
+func newRouter(httpbin *proxy.ReverseProxy) *router.Router {
+	r := router.New()
+	for _, method := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"} {
+		r.Handle(method, "/httpbin/{path...}", httpbin.ServeRequest)
+	}
+	assets := static.New("/assets", os.DirFS("assets"))
+	assets.ErrorRenderer = server.RenderHTML
+	r.Get("/assets/{path...}", assets.ServeRequest)
+	r.Handle("HEAD", "/assets/{path...}", assets.ServeRequest)
+	video := func(w *response.Writer, req *request.Request) {
+		assets.ServeFile(w, req, "vim.mp4")
+	}
+	r.Get("/video", video)
+	r.Handle("HEAD", "/video", video)
+	r.Get("/ws/echo", wsEchoHandler)
+	r.Get("/yourproblem", func(w *response.Writer, req *request.Request) {
+		basicHtmlWriter(w, req, response.StatusBadRequest)
+	})
+	r.Get("/myproblem", func(w *response.Writer, req *request.Request) {
+		basicHtmlWriter(w, req, response.StatusInternalServerError)
+	})
+	r.NotFound = func(w *response.Writer, req *request.Request) {
+		basicHtmlWriter(w, req, response.StatusOK)
 	}
-	basicHtmlWriter(w, req, sc)
-	return
-
+	return r
 }
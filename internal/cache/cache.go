@@ -0,0 +1,499 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+)
+
+// name in the Cache-Status field, RFC 9211
+const cacheName = "httpserver"
+
+// at most this many variants are kept per URL, the oldest go first
+const maxVariants = 16
+
+// Cache is a shared HTTP cache (RFC 9111) in front of an upstream
+// RoundTripper, e.g. as the Transport of a proxy. It serves fresh stored
+// responses, revalidates stale ones with conditional requests and can serve
+// them stale per stale-while-revalidate and stale-if-error (RFC 5861).
+type Cache struct {
+	transport http.RoundTripper
+	store     Store
+	// larger responses are passed through without being stored
+	MaxEntryBytes int64
+	// for background revalidations
+	RevalidateTimeout time.Duration
+
+	mu           sync.Mutex
+	revalidating map[string]bool
+	now          func() time.Time
+}
+
+// New caches the responses of transport, http.DefaultTransport if nil, in
+// store
+func New(transport http.RoundTripper, store Store) *Cache {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Cache{
+		transport:         transport,
+		store:             store,
+		MaxEntryBytes:     8 << 20,
+		RevalidateTimeout: 30 * time.Second,
+		revalidating:      map[string]bool{},
+		now:               time.Now,
+	}
+}
+
+type targetKey struct{}
+
+// WithTarget records the URI the client asked for in the context of a
+// request rewritten for an upstream. A proxy balancing over several
+// upstreams then stores each resource once, and an unsafe request
+// invalidates it whichever upstream handled it.
+func WithTarget(ctx context.Context, target *url.URL) context.Context {
+	return context.WithValue(ctx, targetKey{}, target)
+}
+
+// targetURI is the URI recorded by WithTarget, or else the request URL
+func targetURI(req *http.Request) url.URL {
+	if target, ok := req.Context().Value(targetKey{}).(*url.URL); ok {
+		return *target
+	}
+	u := *req.URL
+	if req.Host != "" {
+		u.Host = req.Host
+	}
+	return u
+}
+
+// Key identifies the stored responses of a request's target URI
+func Key(req *http.Request) string {
+	u := targetURI(req)
+	u.Fragment = ""
+	return u.String()
+}
+
+func (c *Cache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		resp, err := c.transport.RoundTrip(req)
+		if err == nil && resp.StatusCode < 400 {
+			c.invalidate(req, resp)
+		}
+		return resp, err
+	}
+
+	key := Key(req)
+	reqCC := requestDirectives(req.Header)
+	entries := c.store.Get(key)
+	e := selectVariant(entries, req)
+	if e == nil {
+		if reqCC.has("only-if-cached") {
+			return c.synthetic(req, http.StatusGatewayTimeout), nil
+		}
+		status := "fwd=uri-miss"
+		if len(entries) > 0 {
+			status = "fwd=vary-miss"
+		}
+		return c.fetch(req, key, status)
+	}
+
+	now := c.now()
+	age, lifetime := e.age(now), e.lifetime()
+	respCC := parseCacheControl(e.Header)
+	switch {
+	case c.fresh(reqCC, respCC, age, lifetime):
+		return c.serve(req, e, now, fmt.Sprintf("hit; ttl=%d", int64((lifetime-age)/time.Second))), nil
+	case reqCC.has("only-if-cached"):
+		return c.synthetic(req, http.StatusGatewayTimeout), nil
+	case req.Method == "HEAD":
+		// revalidating needs the body of a GET
+		return c.fetch(req, key, "fwd=stale")
+	}
+	if window, ok := respCC.seconds("stale-while-revalidate"); ok && !reqCC.has("no-cache") &&
+		!mustRevalidate(respCC) && age-lifetime <= window {
+		c.revalidateInBackground(req, key, e)
+		return c.serve(req, e, now, "hit; detail=stale-while-revalidate"), nil
+	}
+	status := "fwd=stale"
+	if reqCC.has("no-cache") {
+		status = "fwd=request"
+	}
+	return c.revalidate(req, key, e, status)
+}
+
+func mustRevalidate(respCC directives) bool {
+	return respCC.has("must-revalidate") || respCC.has("proxy-revalidate") || respCC.has("s-maxage")
+}
+
+// fresh reports whether a stored response can be used without
+// revalidation, RFC 9111 sections 4.2 and 5.2.1
+func (c *Cache) fresh(reqCC, respCC directives, age, lifetime time.Duration) bool {
+	if reqCC.has("no-cache") || respCC.has("no-cache") {
+		return false
+	}
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok && lifetime-age < minFresh {
+		return false
+	}
+	if age < lifetime {
+		return true
+	}
+	if !reqCC.has("max-stale") || mustRevalidate(respCC) {
+		return false
+	}
+	maxStale, ok := reqCC.seconds("max-stale")
+	return !ok || age-lifetime <= maxStale
+}
+
+// selectVariant finds the entry whose Vary'd request headers match req
+func selectVariant(entries []*Entry, req *http.Request) *Entry {
+	for _, e := range entries {
+		if varyMatches(e, req) {
+			return e
+		}
+	}
+	return nil
+}
+
+func varyMatches(e *Entry, req *http.Request) bool {
+	for name, value := range e.Vary {
+		if varyValue(req.Header, name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// varyValue normalizes the values of a request header for comparison
+func varyValue(h http.Header, name string) string {
+	values := []string{}
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
+		}
+	}
+	return strings.Join(values, ", ")
+}
+
+func varyNames(h http.Header) []string {
+	names := []string{}
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// fetch forwards a request for which no stored response can be used,
+// storing the response as its body is read
+func (c *Cache) fetch(req *http.Request, key, status string) (*http.Response, error) {
+	requestTime := c.now()
+	resp, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	return c.storeResponse(req, key, resp, requestTime, status), nil
+}
+
+// storeResponse arranges for resp to be stored once its body has been read
+// completely, if it's storable and not too large
+func (c *Cache) storeResponse(req *http.Request, key string, resp *http.Response, requestTime time.Time, status string) *http.Response {
+	responseTime := c.now()
+	if !storable(req, resp) || resp.ContentLength > c.MaxEntryBytes {
+		resp.Header.Set("Cache-Status", cacheName+"; "+status)
+		return resp
+	}
+	e := &Entry{
+		Vary:         map[string]string{},
+		Status:       resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	if _, ok := e.Header["Date"]; !ok {
+		e.Header.Set("Date", response.FormatHTTPDate(responseTime))
+	}
+	for _, name := range varyNames(resp.Header) {
+		e.Vary[name] = varyValue(req.Header, name)
+	}
+	resp.Header.Set("Cache-Status", cacheName+"; "+status+"; stored")
+	resp.Body = &storingBody{
+		ReadCloser: resp.Body,
+		limit:      c.MaxEntryBytes,
+		done: func(body []byte) {
+			e.Body = body
+			e.Trailer = resp.Trailer.Clone()
+			c.put(key, e)
+		},
+	}
+	return resp
+}
+
+// put stores e, replacing the entry of the same variant
+func (c *Cache) put(key string, e *Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := []*Entry{e}
+	for _, old := range c.store.Get(key) {
+		if len(entries) == maxVariants {
+			break
+		}
+		if !sameVariant(old, e) {
+			entries = append(entries, old)
+		}
+	}
+	c.store.Put(key, entries)
+}
+
+func sameVariant(a, b *Entry) bool {
+	if len(a.Vary) != len(b.Vary) {
+		return false
+	}
+	for name, value := range a.Vary {
+		if other, ok := b.Vary[name]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// storingBody hands the body it has read to done on EOF, unless it got
+// larger than limit
+type storingBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+	finished bool
+	done     func([]byte)
+}
+
+func (b *storingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		b.buf.Write(p[:n])
+		if int64(b.buf.Len()) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		}
+	}
+	if err == io.EOF && !b.overflow && !b.finished {
+		b.finished = true
+		b.done(bytes.Clone(b.buf.Bytes()))
+	}
+	return n, err
+}
+
+// revalidate sends a conditional request for a stale entry. A 304 freshens
+// it, server errors and failures can be answered with it per
+// stale-if-error.
+func (c *Cache) revalidate(req *http.Request, key string, e *Entry, status string) (*http.Response, error) {
+	out := conditionalRequest(req, e)
+	requestTime := c.now()
+	resp, err := c.transport.RoundTrip(out)
+	if err != nil || resp.StatusCode >= 500 {
+		if c.staleIfError(req, e) {
+			if err == nil {
+				resp.Body.Close()
+			} else {
+				log.Printf("error: revalidating %s: %v", key, err)
+			}
+			return c.serve(req, e, c.now(), "hit; detail=stale-if-error"), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		freshened := c.freshen(e, resp, requestTime)
+		c.put(key, freshened)
+		return c.serve(req, freshened, c.now(), status+"; fwd-status=304"), nil
+	}
+	return c.storeResponse(out, key, resp, requestTime, status+fmt.Sprintf("; fwd-status=%d", resp.StatusCode)), nil
+}
+
+func (c *Cache) staleIfError(req *http.Request, e *Entry) bool {
+	respCC := parseCacheControl(e.Header)
+	if mustRevalidate(respCC) {
+		return false
+	}
+	staleness := e.age(c.now()) - e.lifetime()
+	for _, cc := range []directives{requestDirectives(req.Header), respCC} {
+		if window, ok := cc.seconds("stale-if-error"); ok && staleness <= window {
+			return true
+		}
+	}
+	return false
+}
+
+// conditionalRequest asks for the target of req unless it still matches
+// the validators of e. The client's own preconditions are evaluated
+// against the result instead.
+func conditionalRequest(req *http.Request, e *Entry) *http.Request {
+	out := req.Clone(req.Context())
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		out.Header.Del(name)
+	}
+	if etag := e.Header.Get("ETag"); etag != "" {
+		out.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		out.Header.Set("If-Modified-Since", lastModified)
+	}
+	return out
+}
+
+// freshen updates a copy of e with the fields of a 304, RFC 9111 section
+// 4.3.4
+func (c *Cache) freshen(e *Entry, resp *http.Response, requestTime time.Time) *Entry {
+	updated := *e
+	updated.Header = e.Header.Clone()
+	// the age of the stored response starts over
+	updated.Header.Del("Age")
+	updated.Header.Set("Date", response.FormatHTTPDate(c.now()))
+	for name, values := range resp.Header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Connection", "Cache-Status":
+			continue
+		}
+		updated.Header[name] = values
+	}
+	updated.RequestTime = requestTime
+	updated.ResponseTime = c.now()
+	return &updated
+}
+
+func (c *Cache) revalidateInBackground(req *http.Request, key string, e *Entry) {
+	c.mu.Lock()
+	if c.revalidating[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[key] = true
+	c.mu.Unlock()
+
+	// the client's request may be gone before this is done
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), c.RevalidateTimeout)
+	out := req.Clone(ctx)
+	go func() {
+		defer cancel()
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, key)
+			c.mu.Unlock()
+		}()
+		resp, err := c.revalidate(out, key, e, "fwd=stale")
+		if err != nil {
+			log.Printf("error: revalidating %s: %v", key, err)
+			return
+		}
+		// reading the body stores it
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// serve answers req from e, with a 304 if the client's own validators
+// still match
+func (c *Cache) serve(req *http.Request, e *Entry, now time.Time, status string) *http.Response {
+	h := e.Header.Clone()
+	h.Set("Age", fmt.Sprintf("%d", int64(e.age(now)/time.Second)))
+	h.Set("Cache-Status", cacheName+"; "+status)
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Trailer:       e.Trailer.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+	if req.Method == "HEAD" {
+		resp.Body = http.NoBody
+	}
+
+	v := response.Validators{}
+	if etag, err := response.ParseETag(h.Get("ETag")); err == nil {
+		v.ETag = etag
+	}
+	if lastModified, ok := headerDate(h, "Last-Modified"); ok {
+		v.LastModified = lastModified
+	}
+	reqHeaders := headers.NewHeaders()
+	for name, values := range req.Header {
+		reqHeaders.Override(name, strings.Join(values, ", "))
+	}
+	if e.Status == http.StatusOK && v.Evaluate(req.Method, reqHeaders) == response.StatusNotModified {
+		resp.Status = "304 Not Modified"
+		resp.StatusCode = http.StatusNotModified
+		resp.Body = http.NoBody
+		resp.ContentLength = 0
+		resp.Trailer = nil
+		resp.Header.Del("Content-Length")
+		resp.Header.Del("Content-Type")
+	}
+	return resp
+}
+
+// synthetic is a response made up by the cache
+func (c *Cache) synthetic(req *http.Request, status int) *http.Response {
+	h := http.Header{}
+	h.Set("Cache-Status", cacheName+"; fwd=miss; detail=only-if-cached")
+	h.Set("Content-Length", "0")
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     h,
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+// invalidate drops the responses stored for the target of an unsafe
+// request and the URIs in its Location and Content-Location fields, RFC
+// 9111 section 4.4
+func (c *Cache) invalidate(req *http.Request, resp *http.Response) {
+	target := targetURI(req)
+	keys := []string{Key(req)}
+	for _, name := range []string{"Location", "Content-Location"} {
+		ref, err := url.Parse(resp.Header.Get(name))
+		if err != nil || resp.Header.Get(name) == "" {
+			continue
+		}
+		u := target.ResolveReference(ref)
+		// only the same origin, others could be invalidated at will
+		if u.Scheme == target.Scheme && u.Host == target.Host {
+			keys = append(keys, u.String())
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		c.store.Delete(key)
+	}
+}
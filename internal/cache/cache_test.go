@@ -0,0 +1,444 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// origin is a fake upstream answering with handler
+type origin struct {
+	mu      sync.Mutex
+	calls   int
+	last    *http.Request
+	handler func(req *http.Request) (*http.Response, error)
+}
+
+func (o *origin) RoundTrip(req *http.Request) (*http.Response, error) {
+	o.mu.Lock()
+	o.calls++
+	o.last = req
+	handler := o.handler
+	o.mu.Unlock()
+	return handler(req)
+}
+
+func (o *origin) Calls() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.calls
+}
+
+func (o *origin) Last() *http.Request {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.last
+}
+
+func (o *origin) Handle(handler func(req *http.Request) (*http.Response, error)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.handler = handler
+}
+
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func setup() (*Cache, *origin, *clock) {
+	clk := &clock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	o := &origin{}
+	c := New(o, NewMemoryStore(1<<20))
+	c.now = clk.Now
+	return c, o, clk
+}
+
+// reply answers every request with status, the fields in pairs and body,
+// plus a Date from clk
+func reply(clk *clock, status int, body string, fields ...string) func(req *http.Request) (*http.Response, error) {
+	return func(req *http.Request) (*http.Response, error) {
+		h := http.Header{}
+		h.Set("Date", response.FormatHTTPDate(clk.Now()))
+		for i := 0; i+1 < len(fields); i += 2 {
+			h.Add(fields[i], fields[i+1])
+		}
+		if status == http.StatusNotModified {
+			body = ""
+		}
+		return &http.Response{
+			StatusCode:    status,
+			Header:        h,
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+}
+
+func do(t *testing.T, c *Cache, method, target string, fields ...string) (*http.Response, string) {
+	req, err := http.NewRequest(method, target, nil)
+	require.NoError(t, err)
+	for i := 0; i+1 < len(fields); i += 2 {
+		req.Header.Add(fields[i], fields[i+1])
+	}
+	resp, err := c.RoundTrip(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+func TestCacheFreshness(t *testing.T) {
+	c, o, clk := setup()
+	o.Handle(reply(clk, 200, "hello", "Cache-Control", "max-age=60", "ETag", `"v1"`))
+
+	// Test: Fresh responses are served from the cache with their age
+	resp, body := do(t, c, "GET", "http://origin.test/a")
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, "httpserver; fwd=uri-miss; stored", resp.Header.Get("Cache-Status"))
+	clk.Advance(10 * time.Second)
+	resp, body = do(t, c, "GET", "http://origin.test/a")
+	assert.Equal(t, 1, o.Calls())
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, "10", resp.Header.Get("Age"))
+	assert.Equal(t, "httpserver; hit; ttl=50", resp.Header.Get("Cache-Status"))
+
+	// Test: HEAD is answered from a stored GET
+	resp, body = do(t, c, "HEAD", "http://origin.test/a")
+	assert.Equal(t, 1, o.Calls())
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Empty(t, body)
+
+	// Test: The client's validators get a 304 from the cache
+	resp, _ = do(t, c, "GET", "http://origin.test/a", "If-None-Match", `"v1"`)
+	assert.Equal(t, 1, o.Calls())
+	assert.Equal(t, 304, resp.StatusCode)
+
+	// Test: Stale responses are revalidated with their validators
+	clk.Advance(60 * time.Second)
+	o.Handle(reply(clk, 304, "", "Cache-Control", "max-age=60", "ETag", `"v1"`))
+	resp, body = do(t, c, "GET", "http://origin.test/a")
+	assert.Equal(t, 2, o.Calls())
+	assert.Equal(t, `"v1"`, o.Last().Header.Get("If-None-Match"))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, "0", resp.Header.Get("Age"))
+	assert.Equal(t, "httpserver; fwd=stale; fwd-status=304", resp.Header.Get("Cache-Status"))
+	_, body = do(t, c, "GET", "http://origin.test/a")
+	assert.Equal(t, 2, o.Calls())
+	assert.Equal(t, "hello", body)
+
+	// Test: A changed response replaces the stored one
+	clk.Advance(61 * time.Second)
+	o.Handle(reply(clk, 200, "changed", "Cache-Control", "max-age=60", "ETag", `"v2"`))
+	_, body = do(t, c, "GET", "http://origin.test/a")
+	assert.Equal(t, "changed", body)
+	_, body = do(t, c, "GET", "http://origin.test/a")
+	assert.Equal(t, 3, o.Calls())
+	assert.Equal(t, "changed", body)
+
+	// Test: Request directives force revalidation or forbid forwarding
+	do(t, c, "GET", "http://origin.test/a", "Cache-Control", "no-cache")
+	assert.Equal(t, 4, o.Calls())
+	do(t, c, "GET", "http://origin.test/a", "Pragma", "no-cache")
+	assert.Equal(t, 5, o.Calls())
+	clk.Advance(30 * time.Second)
+	do(t, c, "GET", "http://origin.test/a", "Cache-Control", "max-age=10")
+	assert.Equal(t, 6, o.Calls())
+	resp, _ = do(t, c, "GET", "http://origin.test/missing", "Cache-Control", "only-if-cached")
+	assert.Equal(t, 504, resp.StatusCode)
+	assert.Equal(t, 6, o.Calls())
+
+	// Test: max-stale accepts stale responses
+	clk.Advance(90 * time.Second)
+	resp, _ = do(t, c, "GET", "http://origin.test/a", "Cache-Control", "max-stale=60")
+	assert.Equal(t, 6, o.Calls())
+	assert.Contains(t, resp.Header.Get("Cache-Status"), "hit")
+}
+
+func TestCacheLifetimes(t *testing.T) {
+	c, o, clk := setup()
+
+	// Test: Expires sets the lifetime relative to Date
+	o.Handle(reply(clk, 200, "x", "Expires", response.FormatHTTPDate(clk.Now().Add(time.Minute))))
+	do(t, c, "GET", "http://origin.test/expires")
+	clk.Advance(59 * time.Second)
+	do(t, c, "GET", "http://origin.test/expires")
+	assert.Equal(t, 1, o.Calls())
+	clk.Advance(time.Second)
+	do(t, c, "GET", "http://origin.test/expires")
+	assert.Equal(t, 2, o.Calls())
+
+	// Test: An invalid Expires is already stale
+	o.Handle(reply(clk, 200, "x", "Expires", "0"))
+	do(t, c, "GET", "http://origin.test/invalid")
+	do(t, c, "GET", "http://origin.test/invalid")
+	assert.Equal(t, 4, o.Calls())
+
+	// Test: Without explicit freshness 10% of the time since Last-Modified is used
+	o.Handle(reply(clk, 200, "x", "Last-Modified", response.FormatHTTPDate(clk.Now().Add(-100*time.Second))))
+	do(t, c, "GET", "http://origin.test/heuristic")
+	clk.Advance(9 * time.Second)
+	do(t, c, "GET", "http://origin.test/heuristic")
+	assert.Equal(t, 5, o.Calls())
+
+	// Test: s-maxage wins over max-age for a shared cache
+	o.Handle(reply(clk, 200, "x", "Cache-Control", "max-age=1, s-maxage=100"))
+	do(t, c, "GET", "http://origin.test/shared")
+	clk.Advance(50 * time.Second)
+	do(t, c, "GET", "http://origin.test/shared")
+	assert.Equal(t, 6, o.Calls())
+
+	// Test: An upstream Age counts towards the age
+	o.Handle(reply(clk, 200, "x", "Cache-Control", "max-age=100", "Age", "90"))
+	do(t, c, "GET", "http://origin.test/aged")
+	clk.Advance(5 * time.Second)
+	resp, _ := do(t, c, "GET", "http://origin.test/aged")
+	assert.Equal(t, "95", resp.Header.Get("Age"))
+	clk.Advance(6 * time.Second)
+	do(t, c, "GET", "http://origin.test/aged")
+	assert.Equal(t, 8, o.Calls())
+}
+
+func TestCacheStorable(t *testing.T) {
+	c, o, clk := setup()
+
+	// Test: Responses forbidding storage or without any freshness are not stored
+	for _, tc := range []struct {
+		path   string
+		status int
+		fields []string
+	}{
+		{"/no-store", 200, []string{"Cache-Control", "max-age=60, no-store"}},
+		{"/private", 200, []string{"Cache-Control", `private="x", max-age=60`}},
+		{"/vary-star", 200, []string{"Cache-Control", "max-age=60", "Vary", "*"}},
+		{"/created", 201, nil},
+	} {
+		o.Handle(reply(clk, tc.status, "x", tc.fields...))
+		calls := o.Calls()
+		do(t, c, "GET", "http://origin.test"+tc.path)
+		do(t, c, "GET", "http://origin.test"+tc.path)
+		assert.Equal(t, calls+2, o.Calls(), tc.path)
+	}
+
+	// Test: Authorized requests are only stored when the response allows it
+	o.Handle(reply(clk, 200, "x", "Cache-Control", "max-age=60"))
+	do(t, c, "GET", "http://origin.test/auth", "Authorization", "Bearer a")
+	do(t, c, "GET", "http://origin.test/auth", "Authorization", "Bearer a")
+	calls := o.Calls()
+	o.Handle(reply(clk, 200, "x", "Cache-Control", "public, max-age=60"))
+	do(t, c, "GET", "http://origin.test/auth-public", "Authorization", "Bearer a")
+	do(t, c, "GET", "http://origin.test/auth-public", "Authorization", "Bearer a")
+	assert.Equal(t, calls+1, o.Calls())
+
+	// Test: Responses larger than MaxEntryBytes pass through
+	c.MaxEntryBytes = 4
+	o.Handle(reply(clk, 200, "too large", "Cache-Control", "max-age=60"))
+	calls = o.Calls()
+	_, body := do(t, c, "GET", "http://origin.test/large")
+	assert.Equal(t, "too large", body)
+	do(t, c, "GET", "http://origin.test/large")
+	assert.Equal(t, calls+2, o.Calls())
+
+	// Test: Partially read bodies are not stored
+	c.MaxEntryBytes = 1 << 20
+	req, err := http.NewRequest("GET", "http://origin.test/partial", nil)
+	require.NoError(t, err)
+	resp, err := c.RoundTrip(req)
+	require.NoError(t, err)
+	buf := make([]byte, 3)
+	io.ReadFull(resp.Body, buf)
+	resp.Body.Close()
+	calls = o.Calls()
+	_, body = do(t, c, "GET", "http://origin.test/partial")
+	assert.Equal(t, calls+1, o.Calls())
+	assert.Equal(t, "too large", body)
+}
+
+func TestCacheVary(t *testing.T) {
+	c, o, clk := setup()
+	o.Handle(func(req *http.Request) (*http.Response, error) {
+		lang := req.Header.Get("Accept-Language")
+		return reply(clk, 200, "lang "+lang, "Cache-Control", "max-age=60", "Vary", "accept-language")(req)
+	})
+
+	// Test: Each variant is stored separately
+	_, body := do(t, c, "GET", "http://origin.test/v", "Accept-Language", "en")
+	assert.Equal(t, "lang en", body)
+	resp, body := do(t, c, "GET", "http://origin.test/v", "Accept-Language", "fr")
+	assert.Equal(t, "lang fr", body)
+	assert.Equal(t, "httpserver; fwd=vary-miss; stored", resp.Header.Get("Cache-Status"))
+	_, body = do(t, c, "GET", "http://origin.test/v", "Accept-Language", "en")
+	assert.Equal(t, "lang en", body)
+	_, body = do(t, c, "GET", "http://origin.test/v", "Accept-Language", "fr")
+	assert.Equal(t, "lang fr", body)
+	assert.Equal(t, 2, o.Calls())
+
+	// Test: Header values are compared normalized
+	req, err := http.NewRequest("GET", "http://origin.test/v", nil)
+	require.NoError(t, err)
+	req.Header["Accept-Language"] = []string{" en "}
+	resp, err = c.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 2, o.Calls())
+
+	// Test: A missing header is its own variant
+	_, body = do(t, c, "GET", "http://origin.test/v")
+	assert.Equal(t, "lang ", body)
+	assert.Equal(t, 3, o.Calls())
+}
+
+func TestCacheStale(t *testing.T) {
+	c, o, clk := setup()
+
+	// Test: stale-while-revalidate serves stale and revalidates in the background
+	o.Handle(reply(clk, 200, "old", "Cache-Control", "max-age=10, stale-while-revalidate=30"))
+	do(t, c, "GET", "http://origin.test/swr")
+	clk.Advance(20 * time.Second)
+	o.Handle(reply(clk, 200, "new", "Cache-Control", "max-age=10, stale-while-revalidate=30"))
+	resp, body := do(t, c, "GET", "http://origin.test/swr")
+	assert.Equal(t, "old", body)
+	assert.Equal(t, "httpserver; hit; detail=stale-while-revalidate", resp.Header.Get("Cache-Status"))
+	assert.Eventually(t, func() bool {
+		_, body := do(t, c, "GET", "http://origin.test/swr")
+		return body == "new"
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 2, o.Calls())
+
+	// Test: Beyond the window the response is revalidated first
+	clk.Advance(50 * time.Second)
+	o.Handle(reply(clk, 200, "newer", "Cache-Control", "max-age=10"))
+	_, body = do(t, c, "GET", "http://origin.test/swr")
+	assert.Equal(t, "newer", body)
+
+	// Test: stale-if-error serves stale on server errors and failures
+	o.Handle(reply(clk, 200, "good", "Cache-Control", "max-age=10, stale-if-error=60"))
+	do(t, c, "GET", "http://origin.test/sie")
+	clk.Advance(20 * time.Second)
+	o.Handle(reply(clk, 503, "down"))
+	resp, body = do(t, c, "GET", "http://origin.test/sie")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "good", body)
+	assert.Equal(t, "httpserver; hit; detail=stale-if-error", resp.Header.Get("Cache-Status"))
+	o.Handle(func(*http.Request) (*http.Response, error) { return nil, errors.New("connection refused") })
+	_, body = do(t, c, "GET", "http://origin.test/sie")
+	assert.Equal(t, "good", body)
+
+	// Test: Past stale-if-error the error is returned
+	clk.Advance(60 * time.Second)
+	req, err := http.NewRequest("GET", "http://origin.test/sie", nil)
+	require.NoError(t, err)
+	_, err = c.RoundTrip(req)
+	assert.Error(t, err)
+
+	// Test: A request's stale-if-error works too, but not against must-revalidate
+	o.Handle(reply(clk, 200, "strict", "Cache-Control", "max-age=10, must-revalidate"))
+	do(t, c, "GET", "http://origin.test/strict")
+	clk.Advance(20 * time.Second)
+	o.Handle(reply(clk, 500, "broken"))
+	resp, body = do(t, c, "GET", "http://origin.test/strict", "Cache-Control", "stale-if-error=60")
+	assert.Equal(t, 500, resp.StatusCode)
+	assert.Equal(t, "broken", body)
+	o.Handle(reply(clk, 200, "lax", "Cache-Control", "max-age=10"))
+	do(t, c, "GET", "http://origin.test/lax")
+	clk.Advance(20 * time.Second)
+	o.Handle(reply(clk, 500, "broken"))
+	_, body = do(t, c, "GET", "http://origin.test/lax", "Cache-Control", "stale-if-error=60")
+	assert.Equal(t, "lax", body)
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	c, o, clk := setup()
+	o.Handle(reply(clk, 200, "x", "Cache-Control", "max-age=60"))
+	for _, path := range []string{"/items", "/items/1", "/other"} {
+		do(t, c, "GET", "http://origin.test"+path)
+	}
+	assert.Equal(t, 3, o.Calls())
+
+	// Test: Unsafe requests invalidate their target and Location
+	o.Handle(reply(clk, 201, "", "Location", "/items/1", "Content-Location", "http://elsewhere.test/other"))
+	do(t, c, "POST", "http://origin.test/items")
+	o.Handle(reply(clk, 200, "x", "Cache-Control", "max-age=60"))
+	for _, path := range []string{"/items", "/items/1", "/other"} {
+		do(t, c, "GET", "http://origin.test"+path)
+	}
+	assert.Equal(t, 6, o.Calls())
+
+	// Test: Failed unsafe requests don't
+	o.Handle(reply(clk, 500, ""))
+	do(t, c, "DELETE", "http://origin.test/items")
+	o.Handle(reply(clk, 200, "x", "Cache-Control", "max-age=60"))
+	do(t, c, "GET", "http://origin.test/items")
+	assert.Equal(t, 7, o.Calls())
+
+	// Test: Requests for one target sent to different upstreams share
+	// entries, and unsafe requests through any upstream invalidate them
+	target, err := url.Parse("http://proxy.test/items")
+	require.NoError(t, err)
+	via := func(method, upstream string) {
+		req, err := http.NewRequestWithContext(WithTarget(context.Background(), target), method, upstream+"/items", nil)
+		require.NoError(t, err)
+		resp, err := c.RoundTrip(req)
+		require.NoError(t, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	via("GET", "http://10.0.0.1")
+	via("GET", "http://10.0.0.2")
+	assert.Equal(t, 8, o.Calls())
+	assert.NotNil(t, c.store.Get("http://proxy.test/items"))
+	via("PUT", "http://10.0.0.2")
+	assert.Nil(t, c.store.Get("http://proxy.test/items"))
+	via("GET", "http://10.0.0.1")
+	assert.Equal(t, 10, o.Calls())
+}
+
+func TestCacheControlParsing(t *testing.T) {
+	h := http.Header{}
+	h.Add("Cache-Control", `Max-Age=60, no-cache="Set-Cookie, X-Other", s-maxage="30"`)
+	h.Add("Cache-Control", "max-age=10, max-stale, stale-if-error=abc, stale-while-revalidate=99999999999999999999")
+	d := parseCacheControl(h)
+
+	// Test: Names are lowercased, values unquoted and the first occurrence wins
+	maxAge, ok := d.seconds("max-age")
+	assert.True(t, ok)
+	assert.Equal(t, 60*time.Second, maxAge)
+	assert.Equal(t, "Set-Cookie, X-Other", d["no-cache"])
+	sMaxAge, _ := d.seconds("s-maxage")
+	assert.Equal(t, 30*time.Second, sMaxAge)
+
+	// Test: Flags have no value, invalid values are absent, huge ones capped
+	assert.True(t, d.has("max-stale"))
+	_, ok = d.seconds("stale-if-error")
+	assert.False(t, ok)
+	swr, ok := d.seconds("stale-while-revalidate")
+	assert.True(t, ok)
+	assert.Equal(t, maxDuration, swr)
+	assert.Len(t, d, 6)
+}
@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+)
+
+const maxDuration = time.Duration(1<<63 - 1)
+
+// directives of a Cache-Control field, lowercased names to unquoted values
+type directives map[string]string
+
+func parseCacheControl(h http.Header) directives {
+	d := directives{}
+	for _, field := range h.Values("Cache-Control") {
+		for field != "" {
+			var item string
+			item, field = nextDirective(field)
+			name, value, _ := strings.Cut(item, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			if unquoted, err := strconv.Unquote(value); err == nil && strings.HasPrefix(value, `"`) {
+				value = unquoted
+			}
+			// the first occurrence wins
+			if _, ok := d[name]; !ok {
+				d[name] = value
+			}
+		}
+	}
+	return d
+}
+
+// nextDirective splits off the first comma separated item, keeping commas
+// inside quoted strings like no-cache="Set-Cookie, Set-Cookie2"
+func nextDirective(s string) (item, rest string) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == ',' && !quoted:
+			return s[:i], s[i+1:]
+		}
+	}
+	return s, ""
+}
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// seconds returns a delta-seconds directive. Invalid values are treated
+// as absent, values too large for a Duration as very long.
+func (d directives) seconds(name string) (time.Duration, bool) {
+	v, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if errors.Is(err, strconv.ErrRange) || (err == nil && n > uint64(maxDuration/time.Second)) {
+		return maxDuration, true
+	}
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// requestDirectives also honors Pragma: no-cache when there's no
+// Cache-Control, RFC 9111 section 5.4
+func requestDirectives(h http.Header) directives {
+	d := parseCacheControl(h)
+	if len(h.Values("Cache-Control")) == 0 && strings.Contains(strings.ToLower(h.Get("Pragma")), "no-cache") {
+		d["no-cache"] = ""
+	}
+	return d
+}
+
+// heuristically cacheable status codes, RFC 9110 section 15.1
+var heuristicStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// storable reports whether a shared cache may store resp, RFC 9111
+// section 3
+func storable(req *http.Request, resp *http.Response) bool {
+	if req.Method != "GET" || resp.StatusCode < 200 || resp.StatusCode == 206 || resp.StatusCode == 304 {
+		return false
+	}
+	reqCC, respCC := parseCacheControl(req.Header), parseCacheControl(resp.Header)
+	if reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+	if strings.Contains(resp.Header.Get("Vary"), "*") {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" &&
+		!respCC.has("must-revalidate") && !respCC.has("public") && !respCC.has("s-maxage") {
+		return false
+	}
+	return respCC.has("public") || respCC.has("max-age") || respCC.has("s-maxage") ||
+		resp.Header.Get("Expires") != "" || heuristicStatus[resp.StatusCode]
+}
+
+func headerDate(h http.Header, name string) (time.Time, bool) {
+	v := h.Get(name)
+	if v == "" {
+		return time.Time{}, false
+	}
+	t, err := response.ParseHTTPDate(v)
+	return t, err == nil
+}
+
+// lifetime is the freshness lifetime of a stored response, RFC 9111
+// section 4.2.1, with the usual 10% of its age since Last-Modified as
+// the heuristic
+func (e *Entry) lifetime() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	date, ok := headerDate(e.Header, "Date")
+	if !ok {
+		date = e.ResponseTime
+	}
+	if e.Header.Get("Expires") != "" {
+		// an invalid Expires means already expired
+		expires, ok := headerDate(e.Header, "Expires")
+		if !ok || !expires.After(date) {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if lastModified, ok := headerDate(e.Header, "Last-Modified"); ok && heuristicStatus[e.Status] && date.After(lastModified) {
+		return date.Sub(lastModified) / 10
+	}
+	return 0
+}
+
+// age is the current age of a stored response, RFC 9111 section 4.2.3
+func (e *Entry) age(now time.Time) time.Duration {
+	date, ok := headerDate(e.Header, "Date")
+	if !ok {
+		date = e.ResponseTime
+	}
+	apparentAge := max(0, e.ResponseTime.Sub(date))
+	ageValue := time.Duration(0)
+	if n, err := strconv.ParseUint(strings.TrimSpace(e.Header.Get("Age")), 10, 32); err == nil {
+		ageValue = time.Duration(n) * time.Second
+	}
+	responseDelay := e.ResponseTime.Sub(e.RequestTime)
+	correctedInitialAge := max(apparentAge, ageValue+responseDelay)
+	return correctedInitialAge + now.Sub(e.ResponseTime)
+}
@@ -0,0 +1,322 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is one stored response. A URL has one entry per variant selected
+// by the response's Vary header.
+type Entry struct {
+	// request header values named by Vary
+	Vary    map[string]string
+	Status  int
+	Header  http.Header
+	Trailer http.Header
+	Body    []byte
+	// when the request that got the response was sent, and the response
+	// received
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+// size approximates the memory an entry uses
+func (e *Entry) size() int64 {
+	n := int64(len(e.Body)) + 256
+	for _, h := range []http.Header{e.Header, e.Trailer} {
+		for k, vs := range h {
+			for _, v := range vs {
+				n += int64(len(k) + len(v))
+			}
+		}
+	}
+	return n
+}
+
+func entriesSize(entries []*Entry) int64 {
+	n := int64(0)
+	for _, e := range entries {
+		n += e.size()
+	}
+	return n
+}
+
+// Store keeps the entries of each URL. Stored slices are never modified,
+// Put a new one to change them.
+type Store interface {
+	Get(key string) []*Entry
+	Put(key string, entries []*Entry)
+	Delete(key string)
+}
+
+// MemoryStore is a Store evicting the least recently used URLs beyond
+// MaxBytes
+type MemoryStore struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List
+	items    map[string]*list.Element
+}
+
+type memoryItem struct {
+	key     string
+	entries []*Entry
+	size    int64
+}
+
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{maxBytes: maxBytes, lru: list.New(), items: map[string]*list.Element{}}
+}
+
+func (s *MemoryStore) Get(key string) []*Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(el)
+	return el.Value.(*memoryItem).entries
+}
+
+func (s *MemoryStore) Put(key string, entries []*Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+	size := entriesSize(entries)
+	if len(entries) == 0 || size > s.maxBytes {
+		return
+	}
+	s.items[key] = s.lru.PushFront(&memoryItem{key: key, entries: entries, size: size})
+	s.size += size
+	for s.size > s.maxBytes {
+		s.remove(s.lru.Back().Value.(*memoryItem).key)
+	}
+}
+
+func (s *MemoryStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+}
+
+// Size returns the bytes used by the stored entries
+func (s *MemoryStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+func (s *MemoryStore) remove(key string) {
+	el, ok := s.items[key]
+	if !ok {
+		return
+	}
+	s.lru.Remove(el)
+	delete(s.items, key)
+	s.size -= el.Value.(*memoryItem).size
+}
+
+// DiskStore is a Store keeping one file per URL in a directory, evicting
+// the least recently used beyond MaxBytes. Entries already in the
+// directory are picked up on start.
+type DiskStore struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	size     int64
+	lru      *list.List
+	items    map[string]*list.Element
+}
+
+type diskItem struct {
+	file string
+	size int64
+}
+
+// diskRecord is the content of a file, the key guards against collisions
+type diskRecord struct {
+	Key     string
+	Entries []*Entry
+}
+
+const diskSuffix = ".cache"
+
+func NewDiskStore(dir string, maxBytes int64) (*DiskStore, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("error: creating cache directory: %w", err)
+	}
+	s := &DiskStore{dir: dir, maxBytes: maxBytes, lru: list.New(), items: map[string]*list.Element{}}
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error: reading cache directory: %w", err)
+	}
+	type found struct {
+		file    string
+		size    int64
+		modTime time.Time
+	}
+	files := []found{}
+	for _, de := range dirEntries {
+		if !strings.HasSuffix(de.Name(), diskSuffix) {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, found{de.Name(), info.Size(), info.ModTime()})
+	}
+	// oldest at the back
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		s.items[f.file] = s.lru.PushFront(&diskItem{file: f.file, size: f.size})
+		s.size += f.size
+	}
+	s.evict()
+	return s, nil
+}
+
+func diskFile(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + diskSuffix
+}
+
+func (s *DiskStore) Get(key string) []*Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file := diskFile(key)
+	el, ok := s.items[file]
+	if !ok {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(s.dir, file))
+	if err != nil {
+		s.remove(file)
+		return nil
+	}
+	defer f.Close()
+	record := diskRecord{}
+	err = gob.NewDecoder(f).Decode(&record)
+	if err != nil {
+		log.Printf("error: reading cache file %s: %v", file, err)
+		s.remove(file)
+		return nil
+	}
+	if record.Key != key {
+		return nil
+	}
+	s.lru.MoveToFront(el)
+	return record.Entries
+}
+
+func (s *DiskStore) Put(key string, entries []*Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file := diskFile(key)
+	s.remove(file)
+	if len(entries) == 0 {
+		return
+	}
+	tmp, err := os.CreateTemp(s.dir, "tmp-*")
+	if err != nil {
+		log.Printf("error: writing cache file: %v", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	err = gob.NewEncoder(tmp).Encode(diskRecord{Key: key, Entries: entries})
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		log.Printf("error: writing cache file: %v", err)
+		return
+	}
+	info, err := os.Stat(tmp.Name())
+	if err != nil || info.Size() > s.maxBytes {
+		return
+	}
+	err = os.Rename(tmp.Name(), filepath.Join(s.dir, file))
+	if err != nil {
+		log.Printf("error: writing cache file: %v", err)
+		return
+	}
+	s.items[file] = s.lru.PushFront(&diskItem{file: file, size: info.Size()})
+	s.size += info.Size()
+	s.evict()
+}
+
+func (s *DiskStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(diskFile(key))
+}
+
+// remove must be called with mu held
+func (s *DiskStore) remove(file string) {
+	el, ok := s.items[file]
+	if ok {
+		s.lru.Remove(el)
+		delete(s.items, file)
+		s.size -= el.Value.(*diskItem).size
+	}
+	err := os.Remove(filepath.Join(s.dir, file))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("error: removing cache file: %v", err)
+	}
+}
+
+func (s *DiskStore) evict() {
+	for s.size > s.maxBytes {
+		s.remove(s.lru.Back().Value.(*diskItem).file)
+	}
+}
+
+type tiered []Store
+
+// Tiered looks in each store in turn, copying hits into the earlier ones,
+// e.g. a small MemoryStore in front of a large DiskStore
+func Tiered(stores ...Store) Store {
+	return tiered(stores)
+}
+
+func (t tiered) Get(key string) []*Entry {
+	for i, s := range t {
+		entries := s.Get(key)
+		if entries == nil {
+			continue
+		}
+		for _, earlier := range t[:i] {
+			earlier.Put(key, entries)
+		}
+		return entries
+	}
+	return nil
+}
+
+func (t tiered) Put(key string, entries []*Entry) {
+	for _, s := range t {
+		s.Put(key, entries)
+	}
+}
+
+func (t tiered) Delete(key string) {
+	for _, s := range t {
+		s.Delete(key)
+	}
+}
@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func entry(body string) []*Entry {
+	return []*Entry{{
+		Status:       200,
+		Header:       http.Header{"Content-Type": {"text/plain"}},
+		Body:         []byte(body),
+		RequestTime:  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		ResponseTime: time.Date(2024, 5, 1, 12, 0, 1, 0, time.UTC),
+	}}
+}
+
+func TestMemoryStore(t *testing.T) {
+	one := entriesSize(entry(string(bytes.Repeat([]byte("x"), 100))))
+	s := NewMemoryStore(3 * one)
+	big := string(bytes.Repeat([]byte("x"), 100))
+
+	// Test: Entries are stored and replaced
+	s.Put("a", entry(big))
+	s.Put("b", entry(big))
+	assert.Equal(t, big, string(s.Get("a")[0].Body))
+	s.Put("b", entry(big))
+	assert.Equal(t, 2*one, s.Size())
+
+	// Test: The least recently used entries are evicted beyond the limit
+	s.Put("c", entry(big))
+	s.Get("a")
+	s.Put("d", entry(big))
+	assert.Nil(t, s.Get("b"))
+	assert.NotNil(t, s.Get("a"))
+	assert.NotNil(t, s.Get("c"))
+	assert.NotNil(t, s.Get("d"))
+	assert.Equal(t, 3*one, s.Size())
+
+	// Test: Entries larger than the limit are not stored
+	s.Put("huge", entry(string(bytes.Repeat([]byte("x"), 1000))))
+	assert.Nil(t, s.Get("huge"))
+	assert.NotNil(t, s.Get("a"))
+
+	// Test: Deleted entries are gone
+	s.Delete("a")
+	assert.Nil(t, s.Get("a"))
+	assert.Equal(t, 2*one, s.Size())
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDiskStore(dir, 1<<20)
+	require.NoError(t, err)
+
+	// Test: Entries survive a restart
+	s.Put("http://origin.test/a", entry("stored on disk"))
+	s.Put("http://origin.test/b", entry("b"))
+	s, err = NewDiskStore(dir, 1<<20)
+	require.NoError(t, err)
+	got := s.Get("http://origin.test/a")
+	require.Len(t, got, 1)
+	assert.Equal(t, "stored on disk", string(got[0].Body))
+	assert.Equal(t, "text/plain", got[0].Header.Get("Content-Type"))
+	assert.Equal(t, entry("")[0].ResponseTime, got[0].ResponseTime.UTC())
+
+	// Test: Deleted entries lose their file
+	s.Delete("http://origin.test/b")
+	assert.Nil(t, s.Get("http://origin.test/b"))
+	files, err := filepath.Glob(filepath.Join(dir, "*"+diskSuffix))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	// Test: Corrupt files are dropped
+	require.NoError(t, os.WriteFile(files[0], []byte("garbage"), 0o600))
+	assert.Nil(t, s.Get("http://origin.test/a"))
+	_, err = os.Stat(files[0])
+	assert.True(t, os.IsNotExist(err))
+
+	// Test: The least recently used files are evicted beyond the limit
+	s.Put("key1", entry("1"))
+	info, err := os.Stat(filepath.Join(dir, diskFile("key1")))
+	require.NoError(t, err)
+	s, err = NewDiskStore(dir, 2*info.Size())
+	require.NoError(t, err)
+	s.Put("key2", entry("2"))
+	s.Get("key1")
+	s.Put("key3", entry("3"))
+	assert.NotNil(t, s.Get("key1"))
+	assert.Nil(t, s.Get("key2"))
+	assert.NotNil(t, s.Get("key3"))
+}
+
+func TestTiered(t *testing.T) {
+	mem := NewMemoryStore(1 << 20)
+	disk, err := NewDiskStore(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+	s := Tiered(mem, disk)
+
+	// Test: Puts go to every tier
+	s.Put("a", entry("a"))
+	assert.NotNil(t, mem.Get("a"))
+	assert.NotNil(t, disk.Get("a"))
+
+	// Test: Hits in a later tier are copied to the earlier ones
+	mem.Delete("a")
+	assert.Equal(t, "a", string(s.Get("a")[0].Body))
+	assert.NotNil(t, mem.Get("a"))
+
+	// Test: Deletes go to every tier
+	s.Delete("a")
+	assert.Nil(t, mem.Get("a"))
+	assert.Nil(t, disk.Get("a"))
+}
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+)
+
+// Request is a request to send. Headers may be nil, Host and Connection
+// are filled in when writing it.
+type Request struct {
+	Method  string
+	URL     *url.URL
+	Headers headers.Headers
+	Body    []byte
+	// sent after the body, which is then chunked
+	Trailers headers.Headers
+}
+
+func NewRequest(method, rawURL string, body []byte) (*Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("error: parsing url: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("error: url without host: %q", rawURL)
+	}
+	return &Request{Method: method, URL: u, Headers: headers.NewHeaders(), Body: body}, nil
+}
+
+type Response struct {
+	// HTTP/1.0 or HTTP/1.1
+	Proto      string
+	StatusCode response.StatusCode
+	Reason     string
+	Headers    headers.Headers
+	// the body without its framing, closing it closes the connection
+	Body io.ReadCloser
+	// -1 when the body is chunked or ends with the connection
+	ContentLength int64
+	// set once a chunked body has been read to EOF
+	Trailers headers.Headers
+}
+
+// Client sends each request on a new connection, there is no keep-alive
+type Client struct {
+	// defaults to a net.Dialer
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// used for https URLs, ServerName defaults to the URL's host
+	TLSConfig *tls.Config
+}
+
+var DefaultClient = &Client{}
+
+func Get(ctx context.Context, rawURL string) (*Response, error) {
+	req, err := NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return DefaultClient.Do(ctx, req)
+}
+
+// Do sends req and reads the response head. The connection stays open
+// until Body is closed, cancelling ctx closes it early.
+func (c *Client) Do(ctx context.Context, req *Request) (*Response, error) {
+	conn, err := c.dial(ctx, req.URL)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	resp, err := roundTrip(conn, req)
+	if err != nil {
+		stop()
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	resp.Body = &connBody{r: resp.Body, conn: conn, ctx: ctx, stop: stop}
+	return resp, nil
+}
+
+func roundTrip(conn net.Conn, req *Request) (*Response, error) {
+	err := WriteRequest(conn, req)
+	if err != nil {
+		return nil, err
+	}
+	return ReadResponse(newReader(conn), req.Method)
+}
+
+func (c *Client) dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	port := u.Port()
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https":
+		return nil, fmt.Errorf("error: unsupported scheme: %q", u.Scheme)
+	case port == "" && u.Scheme == "https":
+		port = "443"
+	case port == "":
+		port = "80"
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+	dial := c.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error: connecting to %s: %w", addr, err)
+	}
+	if u.Scheme == "http" {
+		return conn, nil
+	}
+	config := &tls.Config{}
+	if c.TLSConfig != nil {
+		config = c.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = u.Hostname()
+	}
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error: TLS handshake with %s: %w", addr, err)
+	}
+	return tlsConn, nil
+}
+
+type connBody struct {
+	r    io.Reader
+	conn net.Conn
+	ctx  context.Context
+	stop func() bool
+}
+
+func (b *connBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) && b.ctx.Err() != nil {
+		err = b.ctx.Err()
+	}
+	return n, err
+}
+
+func (b *connBody) Close() error {
+	b.stop()
+	return b.conn.Close()
+}
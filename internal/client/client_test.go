@@ -0,0 +1,225 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, resp *Response) string {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+// rawServer answers each connection with reply once the request head is read
+func rawServer(t *testing.T, reply string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(c)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil || line == "\r\n" {
+					break
+				}
+			}
+			c.Write([]byte(reply))
+			c.Close()
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := server.ServeListener(l, func(w *response.Writer, req *request.Request) {
+		switch req.Path() {
+		case "/chunked":
+			w.WriteStatusLine(response.StatusOK)
+			h := headers.NewHeaders()
+			h.Set("Transfer-Encoding", "chunked")
+			h.Set("Trailer", "X-Checksum")
+			w.WriteHeaders(h)
+			w.WriteChunkedBody([]byte("part one, "))
+			w.WriteChunkedBody([]byte("part two"))
+			w.WriteTrailers(headers.Headers{"x-checksum": "abc"})
+		default:
+			body := []byte(req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + req.Headers.Get("X-Test") + " " + string(req.Body))
+			w.WriteStatusLine(response.StatusOK)
+			h := response.GetDefaultHeaders(len(body))
+			h.Set("Set-Cookie", "a=1")
+			h.Set("Set-Cookie", "b=2")
+			w.WriteHeaders(h)
+			w.WriteBody(body)
+		}
+	})
+	defer s.Close()
+	base := "http://" + l.Addr().String()
+	ctx := context.Background()
+
+	// Test: A Content-Length response from our server
+	resp, err := Get(ctx, base+"/echo?q=1")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1", resp.Proto)
+	assert.Equal(t, response.StatusOK, resp.StatusCode)
+	assert.Equal(t, "OK", resp.Reason)
+	assert.Equal(t, "a=1\nb=2", resp.Headers.Get("Set-Cookie"))
+	assert.Equal(t, "GET /echo?q=1  ", readAll(t, resp))
+	assert.Equal(t, int64(15), resp.ContentLength)
+
+	// Test: The request body and headers reach the server
+	req, err := NewRequest("POST", base+"/echo", []byte("hello"))
+	require.NoError(t, err)
+	req.Headers.Set("X-Test", "yes")
+	resp, err = DefaultClient.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "POST /echo yes hello", readAll(t, resp))
+
+	// Test: A chunked response with trailers
+	resp, err = Get(ctx, base+"/chunked")
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Nil(t, resp.Trailers)
+	assert.Equal(t, "part one, part two", readAll(t, resp))
+	assert.Equal(t, "abc", resp.Trailers.Get("X-Checksum"))
+
+	// Test: HEAD responses have no body but keep their length
+	req, err = NewRequest("HEAD", base+"/echo", nil)
+	require.NoError(t, err)
+	resp, err = DefaultClient.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "", readAll(t, resp))
+	assert.Equal(t, int64(len("HEAD /echo  ")), resp.ContentLength)
+
+	// Test: A body delimited by the connection closing, after interim
+	// responses
+	resp, err = Get(ctx, rawServer(t, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </a.css>\r\n\r\n"+
+		"HTTP/1.0 200 \r\nContent-Type: text/plain\r\n\r\nuntil close"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.0", resp.Proto)
+	assert.Equal(t, "", resp.Reason)
+	assert.Equal(t, "", resp.Headers.Get("Link"))
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Equal(t, "until close", readAll(t, resp))
+
+	// Test: Repeated identical Content-Length values are accepted
+	resp, err = Get(ctx, rawServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\nabcdef"))
+	require.NoError(t, err)
+	assert.Equal(t, "abc", readAll(t, resp))
+
+	// Test: Transfer-Encoding overrides Content-Length
+	resp, err = Get(ctx, rawServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"3;ext=1\r\nabc\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "abc", readAll(t, resp))
+
+	// Test: 204 and 304 responses have no body
+	resp, err = Get(ctx, rawServer(t, "HTTP/1.1 304 Not Modified\r\nContent-Length: 10\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "", readAll(t, resp))
+
+	// Test: Malformed responses are errors
+	for _, reply := range []string{
+		"HTTP/2 200 OK\r\n\r\n",
+		"HTTP/1.1 20 OK\r\n\r\n",
+		"HTTP/1.1 200 OK\n\n",
+		"HTTP/1.1 200 OK\r\nBad Header\r\n\r\n",
+		"HTTP/1.1 200 OK\r\n folded\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 3, 4\r\n\r\nabcd",
+		"HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\n",
+	} {
+		_, err = Get(ctx, rawServer(t, reply))
+		assert.Error(t, err, reply)
+	}
+
+	// Test: Bodies cut short are errors
+	for _, reply := range []string{
+		"HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nabc",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nabc",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabcX\r\n0\r\n\r\n",
+	} {
+		resp, err = Get(ctx, rawServer(t, reply))
+		require.NoError(t, err)
+		_, err = io.ReadAll(resp.Body)
+		assert.Error(t, err, reply)
+		resp.Body.Close()
+	}
+
+	// Test: Oversized response heads are rejected
+	_, err = Get(ctx, rawServer(t, "HTTP/1.1 200 OK\r\nX-Big: "+strings.Repeat("x", maxHeaderBytes)+"\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Unsupported schemes are rejected
+	_, err = Get(ctx, "ftp://example.com/")
+	assert.Error(t, err)
+}
+
+func TestClientInterop(t *testing.T) {
+	var gotTrailer http.Header
+	var gotBody string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotBody, gotTrailer = string(b), r.Trailer
+		w.Header().Set("Trailer", "X-Sum")
+		w.Write([]byte("from net/http"))
+		w.Header().Set("X-Sum", "42")
+	}))
+	defer ts.Close()
+	c := &Client{TLSConfig: ts.Client().Transport.(*http.Transport).TLSClientConfig}
+	ctx := context.Background()
+
+	// Test: Chunked requests with trailers over TLS
+	req, err := NewRequest("PUT", ts.URL+"/upload", []byte("payload"))
+	require.NoError(t, err)
+	req.Trailers = headers.Headers{"x-digest": "sha"}
+	resp, err := c.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "from net/http", readAll(t, resp))
+	assert.Equal(t, "42", resp.Trailers.Get("X-Sum"))
+	assert.Equal(t, "payload", gotBody)
+	assert.Equal(t, "sha", gotTrailer.Get("X-Digest"))
+
+	// Test: Certificates are verified without the test config
+	_, err = DefaultClient.Do(ctx, req)
+	assert.Error(t, err)
+
+	// Test: Cancelling the context interrupts a request
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			defer c.Close()
+			io.Copy(io.Discard, c)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = Get(ctx, "http://"+l.Addr().String())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
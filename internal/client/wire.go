@@ -0,0 +1,317 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+)
+
+const maxHeaderBytes = 1 << 20
+
+var ErrHeaderTooLarge = errors.New("error: response header too large")
+
+func newReader(r io.Reader) *bufio.Reader {
+	return bufio.NewReaderSize(r, 4096)
+}
+
+// WriteRequest writes req in origin-form asking the server to close the
+// connection after responding. The body has a Content-Length unless
+// there are Trailers to send after it.
+func WriteRequest(w io.Writer, req *Request) error {
+	if req.Method == "" || strings.ContainsAny(req.Method, " \t\r\n") {
+		return fmt.Errorf("error: invalid method: %q", req.Method)
+	}
+	h := headers.NewHeaders()
+	for k, v := range req.Headers {
+		if strings.ContainsAny(k, ": \t\r\n") || strings.Contains(v, "\r") {
+			return fmt.Errorf("error: invalid header: %q", k)
+		}
+		h.Override(k, v)
+	}
+	if h.Get("Host") == "" {
+		h.Override("Host", req.URL.Host)
+	}
+	h.Override("Connection", "close")
+	chunked := len(req.Trailers) > 0
+	h.Remove("Content-Length")
+	h.Remove("Transfer-Encoding")
+	h.Remove("Trailer")
+	if chunked {
+		h.Override("Transfer-Encoding", "chunked")
+		names := []string{}
+		for k := range req.Trailers {
+			names = append(names, k)
+		}
+		slices.Sort(names)
+		h.Override("Trailer", strings.Join(names, ", "))
+	} else if len(req.Body) > 0 || req.Method == "POST" || req.Method == "PUT" || req.Method == "PATCH" {
+		h.Override("Content-Length", strconv.Itoa(len(req.Body)))
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+	h.Write(bw)
+	if !chunked {
+		bw.Write(req.Body)
+		return bw.Flush()
+	}
+	if len(req.Body) > 0 {
+		fmt.Fprintf(bw, "%x\r\n", len(req.Body))
+		bw.Write(req.Body)
+		bw.WriteString("\r\n")
+	}
+	bw.WriteString("0\r\n")
+	req.Trailers.Write(bw)
+	return bw.Flush()
+}
+
+// ReadResponse reads a response to a request with method, skipping
+// interim 1xx responses except 101 Switching Protocols. The body is framed
+// as in RFC 9112 section 6.3, closing it doesn't close r.
+func ReadResponse(r *bufio.Reader, method string) (*Response, error) {
+	for {
+		resp, err := readHead(r)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 200 || resp.StatusCode == 101 {
+			err = resp.frameBody(r, method)
+			return resp, err
+		}
+	}
+}
+
+func readHead(r *bufio.Reader) (*Response, error) {
+	limit := maxHeaderBytes
+	line, err := readLine(r, &limit)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := parseStatusLine(string(line[:len(line)-2]))
+	if err != nil {
+		return nil, err
+	}
+	resp.Headers, err = readFields(r, &limit)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func parseStatusLine(line string) (*Response, error) {
+	proto, rest, _ := strings.Cut(line, " ")
+	code, reason, _ := strings.Cut(rest, " ")
+	if proto != "HTTP/1.1" && proto != "HTTP/1.0" {
+		return nil, fmt.Errorf("error: unsupported protocol in status line: %q", line)
+	}
+	n, err := strconv.Atoi(code)
+	if err != nil || len(code) != 3 || n < 100 {
+		return nil, fmt.Errorf("error: invalid status code in status line: %q", line)
+	}
+	return &Response{Proto: proto, StatusCode: response.StatusCode(n), Reason: reason}, nil
+}
+
+// readLine reads a CRLF terminated line, charging it to limit
+func readLine(r *bufio.Reader, limit *int) ([]byte, error) {
+	line := []byte{}
+	for {
+		frag, err := r.ReadSlice('\n')
+		*limit -= len(frag)
+		if *limit < 0 {
+			return nil, ErrHeaderTooLarge
+		}
+		line = append(line, frag...)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(line, []byte("\r\n")) {
+			return nil, fmt.Errorf("error: line not ending in CRLF: %q", line)
+		}
+		return line, nil
+	}
+}
+
+// readFields reads header or trailer fields up to the empty line
+func readFields(r *bufio.Reader, limit *int) (headers.Headers, error) {
+	h := headers.NewHeaders()
+	for {
+		line, err := readLine(r, limit)
+		if err != nil {
+			return nil, err
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("error: obsolete line folding: %q", line)
+		}
+		_, done, err := h.Parse(line)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return h, nil
+		}
+	}
+}
+
+func (resp *Response) frameBody(r *bufio.Reader, method string) error {
+	noBody := method == "HEAD" || resp.StatusCode < 200 || resp.StatusCode == 204 || resp.StatusCode == 304
+	if te := resp.Headers.Get("Transfer-Encoding"); te != "" && !noBody {
+		// Content-Length is ignored, only a final chunked coding delimits
+		// the body
+		resp.ContentLength = -1
+		codings := strings.Split(te, ",")
+		if strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			resp.Body = io.NopCloser(&chunkedReader{r: r, resp: resp})
+		} else {
+			resp.Body = io.NopCloser(r)
+		}
+		return nil
+	}
+	n, hasLength, err := contentLength(resp.Headers)
+	switch {
+	case noBody:
+		resp.ContentLength = 0
+		if method == "HEAD" && hasLength && err == nil {
+			resp.ContentLength = n
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(nil))
+		return nil
+	case err != nil:
+		return err
+	case hasLength:
+		resp.ContentLength = n
+		resp.Body = io.NopCloser(&fixedReader{r: r, left: n})
+	default:
+		resp.ContentLength = -1
+		resp.Body = io.NopCloser(r)
+	}
+	return nil
+}
+
+// contentLength allows a list of identical values, as left by repeated
+// fields
+func contentLength(h headers.Headers) (int64, bool, error) {
+	v, ok := h["content-length"]
+	if !ok {
+		return 0, false, nil
+	}
+	values := strings.Split(v, ",")
+	for _, value := range values {
+		if strings.TrimSpace(value) != strings.TrimSpace(values[0]) {
+			return 0, true, fmt.Errorf("error: conflicting Content-Length: %q", v)
+		}
+	}
+	value := strings.TrimSpace(values[0])
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 || strings.HasPrefix(value, "+") {
+		return 0, true, fmt.Errorf("error: invalid Content-Length: %q", v)
+	}
+	return n, true, nil
+}
+
+// fixedReader reads a Content-Length body, a connection closing before
+// its end is an error
+type fixedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (f *fixedReader) Read(p []byte) (int, error) {
+	if f.left == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > f.left {
+		p = p[:f.left]
+	}
+	n, err := f.r.Read(p)
+	f.left -= int64(n)
+	if errors.Is(err, io.EOF) && f.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// chunkedReader decodes a chunked body, storing the trailer fields in
+// resp at the end
+type chunkedReader struct {
+	r    *bufio.Reader
+	resp *Response
+	// bytes left in the current chunk
+	left int64
+	err  error
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.left == 0 {
+		c.err = c.nextChunk()
+		if c.err != nil {
+			return 0, c.err
+		}
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if err == nil && c.left == 0 {
+		err = c.chunkEnd()
+	}
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	c.err = err
+	return n, err
+}
+
+// nextChunk reads a chunk size line, or the trailer section after the
+// last chunk and returns io.EOF
+func (c *chunkedReader) nextChunk() error {
+	limit := 4096
+	line, err := readLine(c.r, &limit)
+	if err != nil {
+		return err
+	}
+	size, _, _ := strings.Cut(string(line[:len(line)-2]), ";")
+	n, err := strconv.ParseInt(strings.TrimRight(size, " \t"), 16, 64)
+	if err != nil || n < 0 || strings.HasPrefix(size, "+") {
+		return fmt.Errorf("error: invalid chunk size: %q", line)
+	}
+	if n > 0 {
+		c.left = n
+		return nil
+	}
+	limit = maxHeaderBytes
+	c.resp.Trailers, err = readFields(c.r, &limit)
+	if err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func (c *chunkedReader) chunkEnd() error {
+	crlf := make([]byte, 2)
+	_, err := io.ReadFull(c.r, crlf)
+	if err != nil {
+		return err
+	}
+	if string(crlf) != "\r\n" {
+		return fmt.Errorf("error: chunk not ending in CRLF")
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"regexp"
 	"strings"
 )
@@ -14,12 +15,19 @@ func NewHeaders() Headers {
 	return Headers{}
 }
 
+// Set adds value to key, joining repeated values with ", ". Set-Cookie
+// values can't be combined that way (RFC 6265), so they are joined with a
+// newline and written as separate fields.
 func (h Headers) Set(key, value string) {
 	key = strings.ToLower(key)
+	sep := ", "
+	if key == "set-cookie" {
+		sep = "\n"
+	}
 	if h[key] == "" {
 		h[key] = value
 	} else {
-		h[key] = fmt.Sprintf("%s, %s", h[key], value)
+		h[key] = h[key] + sep + value
 	}
 }
 
@@ -38,6 +46,33 @@ func (h Headers) Get(key string) string {
 	return h[key]
 }
 
+// HasToken reports whether the comma-separated value of key contains token,
+// ignoring case. A token like "websocket/13" matches "websocket".
+func (h Headers) HasToken(key, token string) bool {
+	for _, v := range strings.Split(h.Get(key), ",") {
+		v = strings.TrimSpace(v)
+		name, _, _ := strings.Cut(v, "/")
+		if strings.EqualFold(v, token) || strings.EqualFold(name, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write serializes the fields followed by the empty line ending them. A
+// multi-line value, see Set, is written as one field per line.
+func (h Headers) Write(w io.Writer) error {
+	p := []byte{}
+	for k, v := range h {
+		for _, line := range strings.Split(v, "\n") {
+			p = fmt.Appendf(p, "%s: %s\r\n", k, line)
+		}
+	}
+	p = append(p, "\r\n"...)
+	_, err := w.Write(p)
+	return err
+}
+
 func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	idx := bytes.Index(data, []byte("\r\n"))
 	if idx == -1 {
@@ -48,6 +83,9 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	}
 
 	parts := bytes.SplitN(data[:idx], []byte(":"), 2)
+	if len(parts) != 2 {
+		return 0, false, errors.New(fmt.Sprintf("Error: field line without colon: '%s'", parts[0]))
+	}
 	fieldName := string(parts[0])
 	match, err := regexp.MatchString("\\s$", fieldName)
 	if err != nil {
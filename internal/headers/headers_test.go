@@ -74,6 +74,14 @@ func TestHeadersParse(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 
+	// Test: Field line without a colon
+	headers = NewHeaders()
+	data = []byte("Host localhost:42069\r\n\r\n")
+	n, done, err = headers.Parse(data)
+	require.Error(t, err)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
 	// Test: 2 headers with same field-name
 	headers = Headers{"set-person": "lane-loves-go;"}
 	data = []byte("Set-Person: prime-loves-zig;\r\n\r\n")
@@ -83,4 +91,25 @@ func TestHeadersParse(t *testing.T) {
 	assert.Equal(t, "lane-loves-go;, prime-loves-zig;", headers["set-person"])
 	assert.Equal(t, 30, n)
 	assert.False(t, done)
+
+	// Test: Repeated Set-Cookie values are kept apart
+	headers = NewHeaders()
+	headers.Set("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+	headers.Set("Set-Cookie", "b=2")
+	assert.Equal(t, "a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT\nb=2", headers.Get("set-cookie"))
+}
+
+func TestHasToken(t *testing.T) {
+	h := Headers{"connection": "keep-alive, Upgrade", "upgrade": "websocket/13, h2c"}
+
+	// Test: Tokens match ignoring case and version
+	assert.True(t, h.HasToken("Connection", "upgrade"))
+	assert.True(t, h.HasToken("Upgrade", "WebSocket"))
+	assert.True(t, h.HasToken("Upgrade", "websocket/13"))
+	assert.True(t, h.HasToken("Upgrade", "h2c"))
+
+	// Test: Partial and missing tokens don't match
+	assert.False(t, h.HasToken("Connection", "keep"))
+	assert.False(t, h.HasToken("Upgrade", "h2"))
+	assert.False(t, h.HasToken("Accept", "text/html"))
 }
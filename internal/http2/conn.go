@@ -0,0 +1,592 @@
+package http2
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/server"
+)
+
+const (
+	initialWindowSize    = 65535
+	maxWindowSize        = 1<<31 - 1
+	defaultMaxFrameSize  = 16384
+	maxFrameSizeLimit    = 1<<24 - 1
+	headerTableSize      = 4096
+	maxConcurrentStreams = 100
+	// limits the header block of a request before and after decoding
+	maxHeaderListSize = 1 << 20
+	// request bodies are buffered whole, like the HTTP/1.1 parser does
+	maxBodySize = 10 << 20
+	// caps the bodies of all of a connection's streams, which are held
+	// until their responses are done
+	maxBufferedBodies = 16 << 20
+)
+
+var errStreamClosed = errors.New("error: http2 stream closed")
+
+// serverConn runs the server side of one HTTP/2 connection. Frames are read
+// by serve, each request runs in its own goroutine and writes its frames
+// under wmu.
+type serverConn struct {
+	pc      *server.ProtocolConn
+	r       io.Reader
+	decoder *Decoder
+	// header block being continued by CONTINUATION frames
+	continuing *headerBlock
+	done       chan struct{}
+	handlers   sync.WaitGroup
+
+	wmu sync.Mutex
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// open streams, removed once the response is done or the stream reset
+	streams           map[uint32]*stream
+	lastStreamID      uint32
+	goingAway         bool
+	closed            bool
+	connSendWindow    int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	// request body bytes held by open streams
+	bufferedBodies int
+}
+
+type headerBlock struct {
+	streamID  uint32
+	endStream bool
+	buf       []byte
+}
+
+type stream struct {
+	id         uint32
+	fields     []HeaderField
+	body       []byte
+	recvWindow int64
+	// set once the client sent END_STREAM and the handler was started
+	dispatched bool
+	sendWindow int64
+	reset      bool
+	ctx        context.Context
+	cancel     context.CancelCauseFunc
+}
+
+func newServerConn(pc *server.ProtocolConn) *serverConn {
+	sc := &serverConn{
+		pc:                pc,
+		r:                 io.MultiReader(bytes.NewReader(pc.Buffered), pc),
+		decoder:           NewDecoder(headerTableSize, maxHeaderListSize),
+		done:              make(chan struct{}),
+		streams:           map[uint32]*stream{},
+		connSendWindow:    initialWindowSize,
+		peerInitialWindow: initialWindowSize,
+		peerMaxFrameSize:  defaultMaxFrameSize,
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	return sc
+}
+
+// serve runs the connection until either side closes it. A connection
+// upgraded from HTTP/1.1 answers the upgrade request as stream 1.
+func (sc *serverConn) serve(upgradeSettings []setting) {
+	defer sc.close()
+	err := sc.writeFrame(frameSettings, 0, 0, appendSettings(nil,
+		setting{settingMaxConcurrentStreams, maxConcurrentStreams},
+		setting{settingMaxHeaderListSize, maxHeaderListSize},
+	))
+	if err != nil {
+		return
+	}
+	if sc.pc.Request != nil {
+		err = sc.applySettings(upgradeSettings)
+		if err == nil {
+			err = sc.readPreface()
+		}
+		if err == nil {
+			sc.startUpgradedStream(sc.pc.Request)
+		}
+	}
+	go sc.watchShutdown()
+
+	first := true
+	for err == nil {
+		var f *frame
+		sc.setIdleDeadline()
+		f, err = readFrame(sc.r, defaultMaxFrameSize)
+		if err != nil {
+			break
+		}
+		if first && f.typ != frameSettings {
+			err = &ConnError{Code: ErrCodeProtocol, Reason: "first frame is not SETTINGS"}
+			break
+		}
+		first = false
+		err = sc.processFrame(f)
+		var streamErr *StreamError
+		if errors.As(err, &streamErr) {
+			sc.resetStream(streamErr.StreamID, streamErr.Code)
+			err = nil
+		}
+	}
+
+	var connErr *ConnError
+	switch {
+	case errors.As(err, &connErr):
+		log.Printf("%v", connErr)
+		sc.writeGoAway(connErr.Code, connErr.Reason)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		sc.writeGoAway(ErrCodeNo, "idle timeout")
+	}
+}
+
+func (sc *serverConn) readPreface() error {
+	preface := make([]byte, len(ClientPreface))
+	_, err := io.ReadFull(sc.r, preface)
+	if err != nil {
+		return err
+	}
+	if string(preface) != ClientPreface {
+		return &ConnError{Code: ErrCodeProtocol, Reason: "invalid connection preface"}
+	}
+	return nil
+}
+
+// setIdleDeadline closes connections that have no open streams for the
+// server's idle timeout
+func (sc *serverConn) setIdleDeadline() {
+	if sc.pc.IdleTimeout <= 0 {
+		return
+	}
+	sc.mu.Lock()
+	idle := len(sc.streams) == 0
+	sc.mu.Unlock()
+	if idle {
+		sc.pc.SetReadDeadline(time.Now().Add(sc.pc.IdleTimeout))
+	} else {
+		sc.pc.SetReadDeadline(time.Time{})
+	}
+}
+
+// watchShutdown sends GOAWAY once the server shuts down and closes the
+// connection when the streams that were already open are done
+func (sc *serverConn) watchShutdown() {
+	select {
+	case <-sc.done:
+		return
+	case <-sc.pc.ShuttingDown():
+	}
+	sc.writeGoAway(ErrCodeNo, "server shutting down")
+	sc.mu.Lock()
+	for len(sc.streams) > 0 && !sc.closed {
+		sc.cond.Wait()
+	}
+	sc.mu.Unlock()
+	sc.pc.Close()
+}
+
+func (sc *serverConn) close() {
+	sc.pc.Close()
+	sc.mu.Lock()
+	sc.closed = true
+	for _, st := range sc.streams {
+		st.cancel(server.ErrClientDisconnected)
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	close(sc.done)
+	sc.handlers.Wait()
+}
+
+func (sc *serverConn) processFrame(f *frame) error {
+	if sc.continuing != nil && (f.typ != frameContinuation || f.streamID != sc.continuing.streamID) {
+		return &ConnError{Code: ErrCodeProtocol, Reason: fmt.Sprintf("%s frame inside a header block", f.typ)}
+	}
+	switch f.typ {
+	case frameSettings:
+		return sc.processSettings(f)
+	case framePing:
+		return sc.processPing(f)
+	case frameHeaders:
+		return sc.processHeaders(f)
+	case frameContinuation:
+		return sc.processContinuation(f)
+	case frameData:
+		return sc.processData(f)
+	case frameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	case frameRSTStream:
+		return sc.processRSTStream(f)
+	case framePriority:
+		return sc.processPriority(f)
+	case frameGoAway:
+		if f.streamID != 0 {
+			return &ConnError{Code: ErrCodeProtocol, Reason: "GOAWAY on a stream"}
+		}
+		// the client opens no new streams, the ones it has are finished
+		sc.mu.Lock()
+		sc.goingAway = true
+		sc.mu.Unlock()
+		return nil
+	case framePushPromise:
+		return &ConnError{Code: ErrCodeProtocol, Reason: "PUSH_PROMISE from a client"}
+	}
+	// unknown frame types are ignored, RFC 9113 section 4.1
+	return nil
+}
+
+func (sc *serverConn) processSettings(f *frame) error {
+	if f.streamID != 0 {
+		return &ConnError{Code: ErrCodeProtocol, Reason: "SETTINGS on a stream"}
+	}
+	if f.has(flagAck) {
+		if len(f.payload) != 0 {
+			return &ConnError{Code: ErrCodeFrameSize, Reason: "SETTINGS ack with a payload"}
+		}
+		return nil
+	}
+	settings, err := parseSettings(f.payload)
+	if err != nil {
+		return err
+	}
+	err = sc.applySettings(settings)
+	if err != nil {
+		return err
+	}
+	return sc.writeFrame(frameSettings, flagAck, 0, nil)
+}
+
+func (sc *serverConn) applySettings(settings []setting) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range settings {
+		switch s.id {
+		case settingEnablePush:
+			if s.value > 1 {
+				return &ConnError{Code: ErrCodeProtocol, Reason: "SETTINGS_ENABLE_PUSH above 1"}
+			}
+		case settingInitialWindowSize:
+			if s.value > maxWindowSize {
+				return &ConnError{Code: ErrCodeFlowControl, Reason: "SETTINGS_INITIAL_WINDOW_SIZE above the maximum"}
+			}
+			// changes the windows of open streams too, section 6.9.2
+			delta := int64(s.value) - sc.peerInitialWindow
+			sc.peerInitialWindow = int64(s.value)
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return &ConnError{Code: ErrCodeFlowControl, Reason: "stream window above the maximum"}
+				}
+			}
+			sc.cond.Broadcast()
+		case settingMaxFrameSize:
+			if s.value < defaultMaxFrameSize || s.value > maxFrameSizeLimit {
+				return &ConnError{Code: ErrCodeProtocol, Reason: fmt.Sprintf("invalid SETTINGS_MAX_FRAME_SIZE %d", s.value)}
+			}
+			sc.peerMaxFrameSize = s.value
+		}
+		// the encoder keeps no dynamic table, so SETTINGS_HEADER_TABLE_SIZE
+		// needs no action, and unknown settings are ignored
+	}
+	return nil
+}
+
+func (sc *serverConn) processPing(f *frame) error {
+	if f.streamID != 0 {
+		return &ConnError{Code: ErrCodeProtocol, Reason: "PING on a stream"}
+	}
+	if len(f.payload) != 8 {
+		return &ConnError{Code: ErrCodeFrameSize, Reason: "PING payload is not 8 bytes"}
+	}
+	if f.has(flagAck) {
+		return nil
+	}
+	return sc.writeFrame(framePing, flagAck, 0, f.payload)
+}
+
+func (sc *serverConn) processHeaders(f *frame) error {
+	if f.streamID == 0 {
+		return &ConnError{Code: ErrCodeProtocol, Reason: "HEADERS without a stream"}
+	}
+	if f.streamID%2 == 0 {
+		return &ConnError{Code: ErrCodeProtocol, Reason: "client opened an even stream"}
+	}
+	p, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if f.has(flagPriority) {
+		if len(p) < 5 {
+			return &ConnError{Code: ErrCodeFrameSize, Reason: "HEADERS too short for its priority"}
+		}
+		if binary.BigEndian.Uint32(p)&0x7fffffff == f.streamID {
+			return &StreamError{StreamID: f.streamID, Code: ErrCodeProtocol, Reason: "stream depends on itself"}
+		}
+		p = p[5:]
+	}
+	block := &headerBlock{streamID: f.streamID, endStream: f.has(flagEndStream), buf: append([]byte{}, p...)}
+	if !f.has(flagEndHeaders) {
+		sc.continuing = block
+		return nil
+	}
+	return sc.processHeaderBlock(block)
+}
+
+func (sc *serverConn) processContinuation(f *frame) error {
+	block := sc.continuing
+	if block == nil {
+		return &ConnError{Code: ErrCodeProtocol, Reason: "CONTINUATION without HEADERS"}
+	}
+	block.buf = append(block.buf, f.payload...)
+	if len(block.buf) > maxHeaderListSize {
+		return &ConnError{Code: ErrCodeEnhanceYourCalm, Reason: "header block too large"}
+	}
+	if !f.has(flagEndHeaders) {
+		return nil
+	}
+	sc.continuing = nil
+	return sc.processHeaderBlock(block)
+}
+
+// processHeaderBlock opens a stream or ends one with trailers. The block is
+// always decoded first so the decoder's table stays in sync with the client.
+func (sc *serverConn) processHeaderBlock(block *headerBlock) error {
+	fields, err := sc.decoder.Decode(block.buf)
+	if err != nil {
+		return &ConnError{Code: ErrCodeCompression, Reason: err.Error()}
+	}
+	id := block.streamID
+
+	sc.mu.Lock()
+	st := sc.streams[id]
+	if st == nil && id <= sc.lastStreamID {
+		sc.mu.Unlock()
+		// stream ids only grow, so this is a closed or skipped stream
+		return &ConnError{Code: ErrCodeProtocol, Reason: "HEADERS on a closed stream"}
+	}
+	if st != nil {
+		sc.mu.Unlock()
+		// trailers, which the request has no place for and are dropped
+		if st.dispatched {
+			return &StreamError{StreamID: id, Code: ErrCodeStreamClosed, Reason: "HEADERS after the end of the stream"}
+		}
+		if !block.endStream {
+			return &StreamError{StreamID: id, Code: ErrCodeProtocol, Reason: "trailers without END_STREAM"}
+		}
+		for _, field := range fields {
+			if len(field.Name) > 0 && field.Name[0] == ':' {
+				return &StreamError{StreamID: id, Code: ErrCodeProtocol, Reason: "pseudo-header in trailers"}
+			}
+		}
+		return sc.endStream(st)
+	}
+	sc.lastStreamID = id
+	if sc.goingAway {
+		sc.mu.Unlock()
+		return &StreamError{StreamID: id, Code: ErrCodeRefusedStream, Reason: "connection is going away"}
+	}
+	if len(sc.streams) >= maxConcurrentStreams {
+		sc.mu.Unlock()
+		return &StreamError{StreamID: id, Code: ErrCodeRefusedStream, Reason: "too many concurrent streams"}
+	}
+	st = sc.newStream(id)
+	st.fields = fields
+	sc.mu.Unlock()
+
+	if block.endStream {
+		return sc.endStream(st)
+	}
+	return nil
+}
+
+// newStream must be called with mu held
+func (sc *serverConn) newStream(id uint32) *stream {
+	st := &stream{
+		id:         id,
+		recvWindow: initialWindowSize,
+		sendWindow: sc.peerInitialWindow,
+	}
+	st.ctx, st.cancel = context.WithCancelCause(sc.pc.Context())
+	sc.streams[id] = st
+	return st
+}
+
+func (sc *serverConn) processData(f *frame) error {
+	if f.streamID == 0 {
+		return &ConnError{Code: ErrCodeProtocol, Reason: "DATA without a stream"}
+	}
+	// padding counts against flow control, section 6.1. Both windows are
+	// given back as each frame is buffered, so memory is bounded by
+	// maxBodySize and maxBufferedBodies rather than by the windows.
+	if len(f.payload) > 0 {
+		err := sc.writeWindowUpdate(0, uint32(len(f.payload)))
+		if err != nil {
+			return err
+		}
+	}
+	sc.mu.Lock()
+	st := sc.streams[f.streamID]
+	idle := f.streamID > sc.lastStreamID
+	sc.mu.Unlock()
+	if idle {
+		return &ConnError{Code: ErrCodeProtocol, Reason: "DATA on an idle stream"}
+	}
+	if st == nil || st.dispatched {
+		return &StreamError{StreamID: f.streamID, Code: ErrCodeStreamClosed, Reason: "DATA on a closed stream"}
+	}
+	st.recvWindow -= int64(len(f.payload))
+	if st.recvWindow < 0 {
+		return &StreamError{StreamID: st.id, Code: ErrCodeFlowControl, Reason: "DATA beyond the stream window"}
+	}
+	data, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if len(st.body)+len(data) > maxBodySize {
+		return &StreamError{StreamID: st.id, Code: ErrCodeEnhanceYourCalm, Reason: "request body too large"}
+	}
+	sc.mu.Lock()
+	full := sc.bufferedBodies+len(data) > maxBufferedBodies
+	if !full {
+		sc.bufferedBodies += len(data)
+	}
+	sc.mu.Unlock()
+	if full {
+		return &StreamError{StreamID: st.id, Code: ErrCodeEnhanceYourCalm, Reason: "too much request body buffered on the connection"}
+	}
+	st.body = append(st.body, data...)
+	if f.has(flagEndStream) {
+		return sc.endStream(st)
+	}
+	if len(f.payload) > 0 {
+		st.recvWindow += int64(len(f.payload))
+		return sc.writeWindowUpdate(st.id, uint32(len(f.payload)))
+	}
+	return nil
+}
+
+func (sc *serverConn) processWindowUpdate(f *frame) error {
+	if len(f.payload) != 4 {
+		return &ConnError{Code: ErrCodeFrameSize, Reason: "WINDOW_UPDATE payload is not 4 bytes"}
+	}
+	increment := int64(binary.BigEndian.Uint32(f.payload) & 0x7fffffff)
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.streamID == 0 {
+		if increment == 0 {
+			return &ConnError{Code: ErrCodeProtocol, Reason: "WINDOW_UPDATE of 0"}
+		}
+		sc.connSendWindow += increment
+		if sc.connSendWindow > maxWindowSize {
+			return &ConnError{Code: ErrCodeFlowControl, Reason: "connection window above the maximum"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+	if f.streamID > sc.lastStreamID {
+		return &ConnError{Code: ErrCodeProtocol, Reason: "WINDOW_UPDATE on an idle stream"}
+	}
+	st := sc.streams[f.streamID]
+	if st == nil {
+		return nil
+	}
+	if increment == 0 {
+		return &StreamError{StreamID: st.id, Code: ErrCodeProtocol, Reason: "WINDOW_UPDATE of 0"}
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return &StreamError{StreamID: st.id, Code: ErrCodeFlowControl, Reason: "stream window above the maximum"}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processRSTStream(f *frame) error {
+	if f.streamID == 0 {
+		return &ConnError{Code: ErrCodeProtocol, Reason: "RST_STREAM without a stream"}
+	}
+	if len(f.payload) != 4 {
+		return &ConnError{Code: ErrCodeFrameSize, Reason: "RST_STREAM payload is not 4 bytes"}
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.streamID > sc.lastStreamID {
+		return &ConnError{Code: ErrCodeProtocol, Reason: "RST_STREAM on an idle stream"}
+	}
+	if st := sc.streams[f.streamID]; st != nil {
+		sc.removeStream(st, server.ErrClientDisconnected)
+	}
+	return nil
+}
+
+func (sc *serverConn) processPriority(f *frame) error {
+	if f.streamID == 0 {
+		return &ConnError{Code: ErrCodeProtocol, Reason: "PRIORITY without a stream"}
+	}
+	if len(f.payload) != 5 {
+		return &StreamError{StreamID: f.streamID, Code: ErrCodeFrameSize, Reason: "PRIORITY payload is not 5 bytes"}
+	}
+	if binary.BigEndian.Uint32(f.payload)&0x7fffffff == f.streamID {
+		return &StreamError{StreamID: f.streamID, Code: ErrCodeProtocol, Reason: "stream depends on itself"}
+	}
+	// streams are served in the order their handlers write, priorities are
+	// only advisory
+	return nil
+}
+
+// removeStream must be called with mu held
+func (sc *serverConn) removeStream(st *stream, cause error) {
+	st.reset = true
+	st.cancel(cause)
+	if sc.streams[st.id] == st {
+		delete(sc.streams, st.id)
+		sc.bufferedBodies -= len(st.body)
+	}
+	sc.cond.Broadcast()
+}
+
+func (sc *serverConn) resetStream(id uint32, code ErrCode) {
+	sc.mu.Lock()
+	if st := sc.streams[id]; st != nil {
+		sc.removeStream(st, errStreamClosed)
+	}
+	sc.mu.Unlock()
+	sc.writeFrame(frameRSTStream, 0, id, binary.BigEndian.AppendUint32(nil, uint32(code)))
+}
+
+func (sc *serverConn) writeFrame(typ frameType, flags uint8, streamID uint32, payload []byte) error {
+	return sc.writeFrames(appendFrame(nil, typ, flags, streamID, payload))
+}
+
+// writeFrames writes already encoded frames in one go, so a header block
+// and its CONTINUATION frames are never interleaved with other frames
+func (sc *serverConn) writeFrames(buf []byte) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	_, err := sc.pc.Write(buf)
+	return err
+}
+
+func (sc *serverConn) writeWindowUpdate(streamID, increment uint32) error {
+	return sc.writeFrame(frameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, increment))
+}
+
+// writeGoAway tells the client the last stream that will be processed
+func (sc *serverConn) writeGoAway(code ErrCode, reason string) {
+	sc.mu.Lock()
+	sc.goingAway = true
+	last := sc.lastStreamID
+	sc.mu.Unlock()
+	payload := binary.BigEndian.AppendUint32(nil, last)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	payload = append(payload, reason...)
+	sc.writeFrame(frameGoAway, 0, 0, payload)
+}
@@ -0,0 +1,416 @@
+package http2
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type client struct {
+	net.Conn
+	r       io.Reader
+	decoder *Decoder
+}
+
+type testResponse struct {
+	fields map[string]string
+	body   string
+	reset  ErrCode
+}
+
+func testServer(t *testing.T, h server.Handler) *server.Server {
+	s, err := server.Serve(0, h, WithH2C())
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func testHandler(w *response.Writer, req *request.Request) {
+	body := []byte(req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + req.RequestLine.HttpVersion +
+		" host=" + req.Headers.Get("Host") + " cookie=" + req.Headers.Get("Cookie") + " body=" + string(req.Body))
+	w.WriteStatusLine(response.StatusOK)
+	h := response.GetDefaultHeaders(len(body))
+	h.Override("Set-Cookie", "id=1")
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// dial connects with prior knowledge and exchanges SETTINGS
+func dial(t *testing.T, s *server.Server, settings ...setting) *client {
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &client{Conn: conn, r: conn, decoder: NewDecoder(4096, 0)}
+	_, err = conn.Write([]byte(ClientPreface))
+	require.NoError(t, err)
+	c.writeFrame(t, frameSettings, 0, 0, appendSettings(nil, settings...))
+	c.expectSettings(t)
+	return c
+}
+
+func (c *client) expectSettings(t *testing.T) {
+	f := c.readFrame(t)
+	require.Equal(t, frameSettings, f.typ)
+	assert.False(t, f.has(flagAck))
+	c.writeFrame(t, frameSettings, flagAck, 0, nil)
+}
+
+func (c *client) writeFrame(t *testing.T, typ frameType, flags uint8, streamID uint32, payload []byte) {
+	_, err := c.Write(appendFrame(nil, typ, flags, streamID, payload))
+	require.NoError(t, err)
+}
+
+// readFrame skips the SETTINGS acks and WINDOW_UPDATEs the server sends
+func (c *client) readFrame(t *testing.T) *frame {
+	for {
+		f, err := readFrame(c.r, maxFrameSizeLimit)
+		require.NoError(t, err)
+		if f.typ != frameWindowUpdate && !(f.typ == frameSettings && f.has(flagAck)) {
+			return f
+		}
+	}
+}
+
+func (c *client) request(t *testing.T, streamID uint32, method, path string, body string, extra ...HeaderField) {
+	fields := append([]HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: path},
+		{Name: ":authority", Value: "example.com"},
+	}, extra...)
+	flags := uint8(flagEndHeaders)
+	if body == "" {
+		flags |= flagEndStream
+	}
+	c.writeFrame(t, frameHeaders, flags, streamID, Encode(nil, fields))
+	for body != "" {
+		chunk := body[:min(len(body), defaultMaxFrameSize)]
+		body = body[len(chunk):]
+		flags = 0
+		if body == "" {
+			flags = flagEndStream
+		}
+		c.writeFrame(t, frameData, flags, streamID, []byte(chunk))
+	}
+}
+
+// responses reads frames until n streams have ended, opening the windows
+// for what was received
+func (c *client) responses(t *testing.T, n int) map[uint32]*testResponse {
+	resps := map[uint32]*testResponse{}
+	get := func(id uint32) *testResponse {
+		if resps[id] == nil {
+			resps[id] = &testResponse{fields: map[string]string{}}
+		}
+		return resps[id]
+	}
+	for ended := 0; ended < n; {
+		f := c.readFrame(t)
+		switch f.typ {
+		case frameHeaders:
+			fields, err := c.decoder.Decode(f.payload)
+			require.NoError(t, err)
+			for _, field := range fields {
+				get(f.streamID).fields[field.Name] = field.Value
+			}
+		case frameData:
+			get(f.streamID).body += string(f.payload)
+			if len(f.payload) > 0 {
+				c.writeFrame(t, frameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, uint32(len(f.payload))))
+				c.writeFrame(t, frameWindowUpdate, 0, f.streamID, binary.BigEndian.AppendUint32(nil, uint32(len(f.payload))))
+			}
+		case frameRSTStream:
+			get(f.streamID).reset = ErrCode(binary.BigEndian.Uint32(f.payload))
+			ended++
+			continue
+		case frameGoAway:
+			t.Fatalf("unexpected GOAWAY: %x", f.payload)
+		default:
+			continue
+		}
+		if f.has(flagEndStream) {
+			ended++
+		}
+	}
+	return resps
+}
+
+func (c *client) expectGoAway(t *testing.T, code ErrCode) uint32 {
+	for {
+		f, err := readFrame(c.r, maxFrameSizeLimit)
+		require.NoError(t, err, "expected GOAWAY")
+		if f.typ == frameGoAway {
+			assert.Equal(t, code, ErrCode(binary.BigEndian.Uint32(f.payload[4:])), string(f.payload[8:]))
+			return binary.BigEndian.Uint32(f.payload)
+		}
+	}
+}
+
+func TestStreams(t *testing.T) {
+	s := testServer(t, testHandler)
+	c := dial(t, s)
+
+	// Test: A request is answered with its headers and body
+	c.request(t, 1, "GET", "/hello?x=1", "", HeaderField{Name: "cookie", Value: "a=1"}, HeaderField{Name: "cookie", Value: "b=2"})
+	resps := c.responses(t, 1)
+	assert.Equal(t, "200", resps[1].fields[":status"])
+	assert.Equal(t, "id=1", resps[1].fields["set-cookie"])
+	assert.Equal(t, "GET /hello?x=1 2.0 host=example.com cookie=a=1; b=2 body=", resps[1].body)
+
+	// Test: Concurrent streams with bodies are multiplexed on one connection
+	c.request(t, 3, "POST", "/a", "first")
+	c.request(t, 5, "POST", "/b", strings.Repeat("x", 20000))
+	resps = c.responses(t, 2)
+	assert.Equal(t, "POST /a 2.0 host=example.com cookie= body=first", resps[3].body)
+	assert.Equal(t, "POST /b 2.0 host=example.com cookie= body="+strings.Repeat("x", 20000), resps[5].body)
+
+	// Test: HEAD gets headers only
+	c.request(t, 7, "HEAD", "/", "")
+	resps = c.responses(t, 1)
+	assert.Equal(t, "200", resps[7].fields[":status"])
+	assert.Empty(t, resps[7].body)
+
+	// Test: PING is echoed
+	c.writeFrame(t, framePing, 0, 0, []byte("12345678"))
+	f := c.readFrame(t)
+	assert.Equal(t, framePing, f.typ)
+	assert.True(t, f.has(flagAck))
+	assert.Equal(t, "12345678", string(f.payload))
+
+	// Test: Malformed requests reset only their stream
+	c.request(t, 9, "GET", "", "")
+	c.writeFrame(t, frameHeaders, flagEndHeaders|flagEndStream, 11, Encode(nil, []HeaderField{
+		{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: "connection", Value: "close"},
+	}))
+	c.request(t, 13, "POST", "/", "short", HeaderField{Name: "content-length", Value: "10"})
+	resps = c.responses(t, 3)
+	assert.Equal(t, ErrCodeProtocol, resps[9].reset)
+	assert.Equal(t, ErrCodeProtocol, resps[11].reset)
+	assert.Equal(t, ErrCodeProtocol, resps[13].reset)
+
+	// Test: The connection keeps working afterwards, with HTTP/1.1 on others
+	c.request(t, 15, "GET", "/", "")
+	assert.Equal(t, "200", c.responses(t, 1)[15].fields[":status"])
+	resp, err := http.Get("http://" + s.Addr().String() + "/old")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "GET /old 1.1 host="+s.Addr().String()+" cookie= body=", string(body))
+}
+
+func TestFlowControl(t *testing.T) {
+	big := strings.Repeat("0123456789", 10000)
+	s := testServer(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(big)))
+		w.WriteBody([]byte(big))
+	})
+
+	// Test: The server stops at the client's window until it is opened
+	c := dial(t, s, setting{settingInitialWindowSize, 10})
+	c.request(t, 1, "GET", "/", "")
+	f := c.readFrame(t)
+	require.Equal(t, frameHeaders, f.typ)
+	f = c.readFrame(t)
+	require.Equal(t, frameData, f.typ)
+	assert.Equal(t, "0123456789", string(f.payload))
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := readFrame(c.r, maxFrameSizeLimit)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: Raising the initial window applies to open streams
+	c.writeFrame(t, frameSettings, 0, 0, appendSettings(nil, setting{settingInitialWindowSize, 1 << 20}))
+	resps := c.responses(t, 1)
+	assert.Equal(t, big[10:], resps[1].body)
+
+	// Test: Overflowing a window is a flow control error
+	c.writeFrame(t, frameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, maxWindowSize))
+	c.expectGoAway(t, ErrCodeFlowControl)
+}
+
+func TestBufferedBodies(t *testing.T) {
+	s := testServer(t, func(w *response.Writer, req *request.Request) {
+		body := []byte(strconv.Itoa(len(req.Body)))
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	})
+	c := dial(t, s)
+	chunk := make([]byte, defaultMaxFrameSize)
+	// open sends n bytes of body on a new stream without ending it
+	open := func(id uint32, n int) {
+		c.writeFrame(t, frameHeaders, flagEndHeaders, id, Encode(nil, []HeaderField{
+			{Name: ":method", Value: "POST"},
+			{Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/"},
+			{Name: ":authority", Value: "example.com"},
+		}))
+		for ; n > 0; n -= len(chunk) {
+			c.writeFrame(t, frameData, 0, id, chunk[:min(n, len(chunk))])
+		}
+	}
+
+	// Test: Bodies past the connection's cap reset the stream that sent them
+	open(1, maxBodySize)
+	open(3, maxBufferedBodies-maxBodySize+1)
+	f := c.readFrame(t)
+	require.Equal(t, frameRSTStream, f.typ)
+	assert.Equal(t, uint32(3), f.streamID)
+	assert.Equal(t, ErrCodeEnhanceYourCalm, ErrCode(binary.BigEndian.Uint32(f.payload)))
+
+	// Test: The other streams carry on and release their bodies when done
+	c.writeFrame(t, frameData, flagEndStream, 1, nil)
+	resps := c.responses(t, 1)
+	assert.Equal(t, strconv.Itoa(maxBodySize), resps[1].body)
+	open(5, maxBodySize)
+	c.writeFrame(t, frameData, flagEndStream, 5, nil)
+	resps = c.responses(t, 1)
+	assert.Equal(t, strconv.Itoa(maxBodySize), resps[5].body)
+}
+
+func TestConnErrors(t *testing.T) {
+	s := testServer(t, testHandler)
+
+	cases := map[string]func(t *testing.T, c *client){
+		"DATA on stream 0": func(t *testing.T, c *client) {
+			c.writeFrame(t, frameData, 0, 0, []byte("x"))
+		},
+		"even stream": func(t *testing.T, c *client) {
+			c.request(t, 2, "GET", "/", "")
+		},
+		"decreasing stream id": func(t *testing.T, c *client) {
+			c.request(t, 5, "GET", "/", "")
+			c.request(t, 3, "GET", "/", "")
+		},
+		"frame inside a header block": func(t *testing.T, c *client) {
+			c.writeFrame(t, frameHeaders, 0, 1, Encode(nil, []HeaderField{{Name: ":method", Value: "GET"}}))
+			c.writeFrame(t, framePing, 0, 0, []byte("12345678"))
+		},
+		"invalid max frame size": func(t *testing.T, c *client) {
+			c.writeFrame(t, frameSettings, 0, 0, appendSettings(nil, setting{settingMaxFrameSize, 100}))
+		},
+		"push promise": func(t *testing.T, c *client) {
+			c.writeFrame(t, framePushPromise, flagEndHeaders, 1, []byte{0, 0, 0, 2})
+		},
+	}
+
+	// Test: Connection errors end with GOAWAY
+	for name, frames := range cases {
+		t.Run(name, func(t *testing.T) {
+			c := dial(t, s)
+			frames(t, c)
+			c.expectGoAway(t, ErrCodeProtocol)
+		})
+	}
+
+	// Test: Invalid header blocks are compression errors
+	c := dial(t, s)
+	c.writeFrame(t, frameHeaders, flagEndHeaders|flagEndStream, 1, []byte{0x80})
+	c.expectGoAway(t, ErrCodeCompression)
+
+	// Test: The first frame after the preface must be SETTINGS
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(ClientPreface))
+	conn.Write(appendFrame(nil, framePing, 0, 0, []byte("12345678")))
+	c = &client{Conn: conn, r: conn}
+	c.expectGoAway(t, ErrCodeProtocol)
+}
+
+func TestUpgrade(t *testing.T) {
+	s := testServer(t, testHandler)
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: An h2c upgrade answers the request on stream 1
+	settings := base64.RawURLEncoding.EncodeToString(appendSettings(nil, setting{settingMaxFrameSize, 1 << 20}))
+	_, err = conn.Write([]byte("POST /up HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n" +
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: " + settings + "\r\n\r\nbody"))
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 101, resp.StatusCode)
+	assert.Equal(t, "h2c", resp.Header.Get("Upgrade"))
+
+	c := &client{Conn: conn, r: br, decoder: NewDecoder(4096, 0)}
+	_, err = conn.Write([]byte(ClientPreface))
+	require.NoError(t, err)
+	c.writeFrame(t, frameSettings, 0, 0, nil)
+	c.expectSettings(t)
+	resps := c.responses(t, 1)
+	assert.Equal(t, "POST /up 2.0 host=localhost cookie= body=body", resps[1].body)
+
+	// Test: Upgrades without valid HTTP2-Settings are served as HTTP/1.1
+	conn2, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	conn2.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: !!\r\n\r\n"))
+	resp, err = http.ReadResponse(bufio.NewReader(conn2), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan context.Context, 1)
+	s := testServer(t, func(w *response.Writer, req *request.Request) {
+		started <- req.Context()
+		<-release
+		testHandler(w, req)
+	})
+
+	// Test: Resetting a stream cancels the handler's context
+	c := dial(t, s)
+	c.request(t, 1, "GET", "/", "")
+	ctx := <-started
+	c.writeFrame(t, frameRSTStream, 0, 1, binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel)))
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("handler context not cancelled")
+	}
+	release <- struct{}{}
+
+	// Test: Shutdown sends GOAWAY and lets open streams finish
+	c.request(t, 3, "GET", "/slow", "")
+	<-started
+	done := make(chan error)
+	go func() {
+		_, err := s.Shutdown(context.Background())
+		done <- err
+	}()
+	assert.Equal(t, uint32(3), c.expectGoAway(t, ErrCodeNo))
+	close(release)
+	f := c.readFrame(t)
+	require.Equal(t, frameHeaders, f.typ)
+	fields, err := c.decoder.Decode(f.payload)
+	require.NoError(t, err)
+	assert.Contains(t, fields, HeaderField{Name: ":status", Value: "200"})
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+}
@@ -0,0 +1,181 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ClientPreface starts every HTTP/2 connection, RFC 9113 section 3.4
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const frameHeaderLen = 9
+
+type frameType uint8
+
+const (
+	frameData         frameType = 0x0
+	frameHeaders      frameType = 0x1
+	framePriority     frameType = 0x2
+	frameRSTStream    frameType = 0x3
+	frameSettings     frameType = 0x4
+	framePushPromise  frameType = 0x5
+	framePing         frameType = 0x6
+	frameGoAway       frameType = 0x7
+	frameWindowUpdate frameType = 0x8
+	frameContinuation frameType = 0x9
+)
+
+func (t frameType) String() string {
+	names := []string{"DATA", "HEADERS", "PRIORITY", "RST_STREAM", "SETTINGS", "PUSH_PROMISE", "PING", "GOAWAY", "WINDOW_UPDATE", "CONTINUATION"}
+	if int(t) < len(names) {
+		return names[t]
+	}
+	return fmt.Sprintf("UNKNOWN_%d", t)
+}
+
+const (
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+type settingID uint16
+
+const (
+	settingHeaderTableSize      settingID = 0x1
+	settingEnablePush           settingID = 0x2
+	settingMaxConcurrentStreams settingID = 0x3
+	settingInitialWindowSize    settingID = 0x4
+	settingMaxFrameSize         settingID = 0x5
+	settingMaxHeaderListSize    settingID = 0x6
+)
+
+type setting struct {
+	id    settingID
+	value uint32
+}
+
+// ErrCode is sent in RST_STREAM and GOAWAY frames, RFC 9113 section 7
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+// ConnError ends the whole connection with a GOAWAY
+type ConnError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e *ConnError) Error() string {
+	return fmt.Sprintf("error: http2 connection error %d: %s", e.Code, e.Reason)
+}
+
+// StreamError resets a single stream with RST_STREAM
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+	Reason   string
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("error: http2 stream %d error %d: %s", e.StreamID, e.Code, e.Reason)
+}
+
+type frame struct {
+	typ      frameType
+	flags    uint8
+	streamID uint32
+	payload  []byte
+}
+
+func (f *frame) has(flag uint8) bool {
+	return f.flags&flag != 0
+}
+
+// readFrame reads one frame whose payload may be at most maxSize bytes
+func readFrame(r io.Reader, maxSize uint32) (*frame, error) {
+	var head [frameHeaderLen]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		return nil, err
+	}
+	length := uint32(head[0])<<16 | uint32(head[1])<<8 | uint32(head[2])
+	f := &frame{
+		typ:   frameType(head[3]),
+		flags: head[4],
+		// the reserved bit is ignored on receipt
+		streamID: binary.BigEndian.Uint32(head[5:]) & 0x7fffffff,
+	}
+	if length > maxSize {
+		return nil, &ConnError{Code: ErrCodeFrameSize, Reason: fmt.Sprintf("%s frame of %d bytes exceeds %d", f.typ, length, maxSize)}
+	}
+	f.payload = make([]byte, length)
+	_, err = io.ReadFull(r, f.payload)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func appendFrame(dst []byte, typ frameType, flags uint8, streamID uint32, payload []byte) []byte {
+	n := len(payload)
+	dst = append(dst, byte(n>>16), byte(n>>8), byte(n), byte(typ), flags)
+	dst = binary.BigEndian.AppendUint32(dst, streamID&0x7fffffff)
+	return append(dst, payload...)
+}
+
+// stripPadding removes the pad length byte and padding of a PADDED frame
+func stripPadding(f *frame) ([]byte, error) {
+	p := f.payload
+	if !f.has(flagPadded) {
+		return p, nil
+	}
+	if len(p) == 0 {
+		return nil, &ConnError{Code: ErrCodeFrameSize, Reason: "padded frame without a pad length"}
+	}
+	padLen := int(p[0])
+	if padLen >= len(p) {
+		return nil, &ConnError{Code: ErrCodeProtocol, Reason: "padding longer than the frame"}
+	}
+	return p[1 : len(p)-padLen], nil
+}
+
+func parseSettings(p []byte) ([]setting, error) {
+	if len(p)%6 != 0 {
+		return nil, &ConnError{Code: ErrCodeFrameSize, Reason: "SETTINGS payload is not a multiple of 6"}
+	}
+	settings := make([]setting, 0, len(p)/6)
+	for i := 0; i < len(p); i += 6 {
+		settings = append(settings, setting{
+			id:    settingID(binary.BigEndian.Uint16(p[i:])),
+			value: binary.BigEndian.Uint32(p[i+2:]),
+		})
+	}
+	return settings, nil
+}
+
+func appendSettings(dst []byte, settings ...setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.id))
+		dst = binary.BigEndian.AppendUint32(dst, s.value)
+	}
+	return dst
+}
@@ -0,0 +1,51 @@
+package http2
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/server"
+)
+
+// WithH2C serves HTTP/2 over cleartext next to HTTP/1.1, both to clients
+// that start with the connection preface and to HTTP/1.1 requests with
+// "Upgrade: h2c". Every stream is dispatched to the server's handler.
+func WithH2C() server.Option {
+	return server.WithProtocol(server.Protocol{
+		Preface: ClientPreface,
+		Upgrade: "h2c",
+		Accept: func(req *request.Request) bool {
+			_, err := upgradeSettings(req)
+			return err == nil
+		},
+		Serve: func(pc *server.ProtocolConn) {
+			var settings []setting
+			if pc.Request != nil {
+				settings, _ = upgradeSettings(pc.Request)
+			}
+			newServerConn(pc).serve(settings)
+		},
+	})
+}
+
+// upgradeSettings decodes the HTTP2-Settings header an upgrade request must
+// carry, RFC 7540 section 3.2.1
+func upgradeSettings(req *request.Request) ([]setting, error) {
+	if !req.Headers.HasToken("Connection", "HTTP2-Settings") {
+		return nil, &ConnError{Code: ErrCodeProtocol, Reason: "HTTP2-Settings is not listed in Connection"}
+	}
+	v, ok := req.Headers["http2-settings"]
+	if !ok {
+		return nil, &ConnError{Code: ErrCodeProtocol, Reason: "missing HTTP2-Settings"}
+	}
+	v = strings.TrimRight(v, "=")
+	if strings.Contains(v, ",") {
+		return nil, &ConnError{Code: ErrCodeProtocol, Reason: "more than one HTTP2-Settings header"}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, &ConnError{Code: ErrCodeProtocol, Reason: "HTTP2-Settings is not base64url"}
+	}
+	return parseSettings(payload)
+}
@@ -0,0 +1,341 @@
+package http2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HeaderField is one decoded header, names are lowercase
+type HeaderField struct {
+	Name  string
+	Value string
+	// must never be added to a compression table, e.g. cookies
+	Sensitive bool
+}
+
+func (f HeaderField) size() int {
+	// RFC 7541 section 4.1
+	return len(f.Name) + len(f.Value) + 32
+}
+
+// RFC 7541 Appendix A
+var staticTable = []HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+var errCompression = errors.New("error: invalid header block")
+
+// dynamicTable is the FIFO of RFC 7541 section 2.3.2, newest entry first
+type dynamicTable struct {
+	entries []HeaderField
+	size    int
+	maxSize int
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.entries = append([]HeaderField{f}, t.entries...)
+	t.size += f.size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n int) {
+	t.maxSize = n
+	t.evict()
+}
+
+func (t *dynamicTable) evict() {
+	for t.size > t.maxSize && len(t.entries) > 0 {
+		last := t.entries[len(t.entries)-1]
+		t.entries = t.entries[:len(t.entries)-1]
+		t.size -= last.size()
+	}
+}
+
+// Decoder decodes header blocks from one connection, keeping the dynamic
+// table between them
+type Decoder struct {
+	table dynamicTable
+	// upper bound the peer may raise the table to, our SETTINGS_HEADER_TABLE_SIZE
+	allowedMaxSize int
+	maxStringLen   int
+}
+
+func NewDecoder(maxTableSize, maxStringLen int) *Decoder {
+	return &Decoder{
+		table:          dynamicTable{maxSize: maxTableSize},
+		allowedMaxSize: maxTableSize,
+		maxStringLen:   maxStringLen,
+	}
+}
+
+func (d *Decoder) at(index uint64) (HeaderField, error) {
+	switch {
+	case index == 0:
+		return HeaderField{}, fmt.Errorf("%w: index 0", errCompression)
+	case index <= uint64(len(staticTable)):
+		return staticTable[index-1], nil
+	case index-uint64(len(staticTable)) <= uint64(len(d.table.entries)):
+		return d.table.entries[index-uint64(len(staticTable))-1], nil
+	}
+	return HeaderField{}, fmt.Errorf("%w: index %d out of range", errCompression, index)
+}
+
+// Decode returns the fields of a complete header block
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	fields := []HeaderField{}
+	sawField := false
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		// indexed header field, section 6.1
+		case b&0x80 != 0:
+			index, rest, err := readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			f, err := d.at(index)
+			if err != nil {
+				return nil, err
+			}
+			block = rest
+			fields = append(fields, f)
+			sawField = true
+		// literal with incremental indexing, section 6.2.1
+		case b&0xc0 == 0x40:
+			f, rest, err := d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			block = rest
+			d.table.add(f)
+			fields = append(fields, f)
+			sawField = true
+		// dynamic table size update, section 6.3
+		case b&0xe0 == 0x20:
+			if sawField {
+				return nil, fmt.Errorf("%w: table size update after a header field", errCompression)
+			}
+			size, rest, err := readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.allowedMaxSize) {
+				return nil, fmt.Errorf("%w: table size %d above the limit of %d", errCompression, size, d.allowedMaxSize)
+			}
+			block = rest
+			d.table.setMaxSize(int(size))
+		// literal without indexing (0000) or never indexed (0001), 6.2.2 and 6.2.3
+		default:
+			f, rest, err := d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			f.Sensitive = b&0x10 != 0
+			block = rest
+			fields = append(fields, f)
+			sawField = true
+		}
+	}
+	return fields, nil
+}
+
+func (d *Decoder) readLiteral(block []byte, prefix uint8) (HeaderField, []byte, error) {
+	index, rest, err := readInt(block, prefix)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	f := HeaderField{}
+	if index > 0 {
+		named, err := d.at(index)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+		f.Name = named.Name
+	} else {
+		f.Name, rest, err = d.readString(rest)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+	}
+	f.Value, rest, err = d.readString(rest)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	return f, rest, nil
+}
+
+// readString decodes a string literal, section 5.2
+func (d *Decoder) readString(p []byte) (string, []byte, error) {
+	if len(p) == 0 {
+		return "", nil, fmt.Errorf("%w: truncated string", errCompression)
+	}
+	huffman := p[0]&0x80 != 0
+	length, rest, err := readInt(p, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(rest)) {
+		return "", nil, fmt.Errorf("%w: truncated string", errCompression)
+	}
+	if d.maxStringLen > 0 && length > uint64(d.maxStringLen) {
+		return "", nil, fmt.Errorf("%w: string longer than %d bytes", errCompression, d.maxStringLen)
+	}
+	raw := rest[:length]
+	rest = rest[length:]
+	if !huffman {
+		return string(raw), rest, nil
+	}
+	decoded, err := huffmanDecode(raw)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", errCompression, err)
+	}
+	return string(decoded), rest, nil
+}
+
+// readInt decodes an integer with an n bit prefix, section 5.1
+func readInt(p []byte, n uint8) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, nil, fmt.Errorf("%w: truncated integer", errCompression)
+	}
+	limit := uint64(1)<<n - 1
+	v := uint64(p[0]) & limit
+	p = p[1:]
+	if v < limit {
+		return v, p, nil
+	}
+	shift := uint(0)
+	for {
+		if len(p) == 0 {
+			return 0, nil, fmt.Errorf("%w: truncated integer", errCompression)
+		}
+		b := p[0]
+		p = p[1:]
+		v += uint64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			return v, p, nil
+		}
+		// nothing we accept needs more than 32 bits
+		if shift > 28 {
+			return 0, nil, fmt.Errorf("%w: integer overflow", errCompression)
+		}
+	}
+}
+
+func appendInt(dst []byte, first byte, n uint8, v uint64) []byte {
+	limit := uint64(1)<<n - 1
+	if v < limit {
+		return append(dst, first|byte(v))
+	}
+	dst = append(dst, first|byte(limit))
+	v -= limit
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+func appendString(dst []byte, s string) []byte {
+	if n := huffmanEncodedLen(s); n < len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(n))
+		return huffmanEncode(dst, s)
+	}
+	dst = appendInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// Encode writes a header block using only the static table, so encoding
+// keeps no state and blocks can be written in any order
+func Encode(dst []byte, fields []HeaderField) []byte {
+	for _, f := range fields {
+		nameIndex := 0
+		fullIndex := 0
+		for i, s := range staticTable {
+			if s.Name != f.Name {
+				continue
+			}
+			if nameIndex == 0 {
+				nameIndex = i + 1
+			}
+			if s.Value == f.Value && !f.Sensitive {
+				fullIndex = i + 1
+				break
+			}
+		}
+		if fullIndex > 0 {
+			dst = appendInt(dst, 0x80, 7, uint64(fullIndex))
+			continue
+		}
+		first := byte(0x00)
+		if f.Sensitive {
+			first = 0x10
+		}
+		dst = appendInt(dst, first, 4, uint64(nameIndex))
+		if nameIndex == 0 {
+			dst = appendString(dst, f.Name)
+		}
+		dst = appendString(dst, f.Value)
+	}
+	return dst
+}
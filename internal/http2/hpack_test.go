@@ -0,0 +1,132 @@
+package http2
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func TestDecoder(t *testing.T) {
+	// Test: Integer encodings from RFC 7541 C.1
+	assert.Equal(t, []byte{0x0a}, appendInt(nil, 0, 5, 10))
+	assert.Equal(t, []byte{0x1f, 0x9a, 0x0a}, appendInt(nil, 0, 5, 1337))
+	v, rest, err := readInt([]byte{0x1f, 0x9a, 0x0a}, 5)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1337), v)
+	assert.Empty(t, rest)
+
+	// Test: Requests without Huffman coding from RFC 7541 C.3 share a table
+	d := NewDecoder(4096, 0)
+	fields, err := d.Decode(unhex(t, "8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+	}, fields)
+	fields, err = d.Decode(unhex(t, "8286 84be 5808 6e6f 2d63 6163 6865"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: ":authority", Value: "www.example.com"}, fields[3])
+	assert.Equal(t, HeaderField{Name: "cache-control", Value: "no-cache"}, fields[4])
+	fields, err = d.Decode(unhex(t, "8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: ":scheme", Value: "https"}, fields[1])
+	assert.Equal(t, HeaderField{Name: ":path", Value: "/index.html"}, fields[2])
+	assert.Equal(t, HeaderField{Name: "custom-key", Value: "custom-value"}, fields[4])
+	assert.Equal(t, 164, d.table.size)
+
+	// Test: The same requests with Huffman coding, RFC 7541 C.4
+	d = NewDecoder(4096, 0)
+	fields, err = d.Decode(unhex(t, "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: ":authority", Value: "www.example.com"}, fields[3])
+	fields, err = d.Decode(unhex(t, "8286 84be 5886 a8eb 1064 9cbf"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: "cache-control", Value: "no-cache"}, fields[4])
+	fields, err = d.Decode(unhex(t, "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: "custom-key", Value: "custom-value"}, fields[4])
+
+	// Test: Responses evict old entries from a small table, RFC 7541 C.6
+	d = NewDecoder(256, 0)
+	_, err = d.Decode(unhex(t, "4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3"))
+	require.NoError(t, err)
+	fields, err = d.Decode(unhex(t, "4883 640e ffc1 c0bf"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{
+		{Name: ":status", Value: "307"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+	}, fields)
+	assert.Equal(t, 222, d.table.size)
+	assert.Len(t, d.table.entries, 4)
+
+	// Test: Never indexed literals are marked sensitive and not added
+	d = NewDecoder(4096, 0)
+	fields, err = d.Decode(unhex(t, "1008 7061 7373 776f 7264 0673 6563 7265 74"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: "password", Value: "secret", Sensitive: true}}, fields)
+	assert.Empty(t, d.table.entries)
+
+	// Test: Invalid blocks are rejected
+	invalid := map[string]string{
+		"index 0":                  "80",
+		"index out of range":       "ff00",
+		"truncated string":         "400a 6375",
+		"truncated integer":        "ff",
+		"size update above limit":  "3fe2 1f",
+		"size update after fields": "82 20",
+		"huffman eos padding":      "4082 ffff 00",
+	}
+	for name, block := range invalid {
+		_, err := NewDecoder(4096, 0).Decode(unhex(t, block))
+		assert.ErrorIs(t, err, errCompression, name)
+	}
+
+	// Test: Strings above the limit are rejected
+	_, err = NewDecoder(4096, 4).Decode(unhex(t, "400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65"))
+	assert.ErrorIs(t, err, errCompression)
+}
+
+func TestEncode(t *testing.T) {
+	fields := []HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: ":status", Value: "302"},
+		{Name: "content-type", Value: "text/html; charset=utf-8"},
+		{Name: "x-custom", Value: "\x00\xff binary"},
+		{Name: "set-cookie", Value: "id=1", Sensitive: true},
+	}
+	block := Encode(nil, fields)
+
+	// Test: Fully indexed static entries take one byte
+	assert.Equal(t, byte(0x88), block[0])
+
+	// Test: Encoded blocks decode to the same fields and leave no table state
+	d := NewDecoder(4096, 0)
+	decoded, err := d.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields, decoded)
+	assert.Empty(t, d.table.entries)
+
+	// Test: Huffman coding round trips every byte value
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	encoded := huffmanEncode(nil, string(all))
+	assert.Len(t, encoded, huffmanEncodedLen(string(all)))
+	decodedBytes, err := huffmanDecode(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, all, decodedBytes)
+}
@@ -0,0 +1,298 @@
+package http2
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+)
+
+// connection-specific headers have no meaning in HTTP/2, section 8.2.2
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// endStream runs the handler once the client has sent the whole request
+func (sc *serverConn) endStream(st *stream) error {
+	st.dispatched = true
+	req, err := newRequest(st.fields, st.body)
+	if err != nil {
+		return &StreamError{StreamID: st.id, Code: ErrCodeProtocol, Reason: err.Error()}
+	}
+	sc.dispatch(st, req)
+	return nil
+}
+
+func (sc *serverConn) dispatch(st *stream, req *request.Request) {
+	sc.handlers.Add(1)
+	go func() {
+		defer sc.handlers.Done()
+		sc.runHandler(st, req.WithContext(st.ctx))
+	}()
+}
+
+// startUpgradedStream answers the request that upgraded the connection on
+// stream 1, which the client has already half closed
+func (sc *serverConn) startUpgradedStream(upgrade *request.Request) {
+	h := headers.NewHeaders()
+	for k, v := range upgrade.Headers {
+		if connectionHeaders[k] || k == "http2-settings" {
+			continue
+		}
+		h.Override(k, v)
+	}
+	req := &request.Request{
+		RequestLine: request.RequestLine{
+			HttpVersion:   "2.0",
+			RequestTarget: upgrade.RequestLine.RequestTarget,
+			Method:        upgrade.RequestLine.Method,
+		},
+		Headers: h,
+		Body:    upgrade.Body,
+	}
+	sc.mu.Lock()
+	sc.lastStreamID = 1
+	st := sc.newStream(1)
+	st.dispatched = true
+	sc.mu.Unlock()
+	sc.dispatch(st, req)
+}
+
+// newRequest checks the decoded header fields of a request, section 8.3,
+// and turns them into a request.Request
+func newRequest(fields []HeaderField, body []byte) (*request.Request, error) {
+	pseudo := map[string]string{}
+	h := headers.NewHeaders()
+	cookies := []string{}
+	regular := false
+	for _, f := range fields {
+		if f.Name != strings.ToLower(f.Name) {
+			return nil, fmt.Errorf("error: uppercase header name %q", f.Name)
+		}
+		if strings.HasPrefix(f.Name, ":") {
+			if regular {
+				return nil, fmt.Errorf("error: pseudo-header %s after regular headers", f.Name)
+			}
+			switch f.Name {
+			case ":method", ":scheme", ":authority", ":path":
+			default:
+				return nil, fmt.Errorf("error: invalid pseudo-header %s", f.Name)
+			}
+			if _, ok := pseudo[f.Name]; ok {
+				return nil, fmt.Errorf("error: duplicate pseudo-header %s", f.Name)
+			}
+			pseudo[f.Name] = f.Value
+			continue
+		}
+		regular = true
+		if connectionHeaders[f.Name] {
+			return nil, fmt.Errorf("error: connection-specific header %s", f.Name)
+		}
+		if f.Name == "te" && f.Value != "trailers" {
+			return nil, fmt.Errorf("error: te header other than trailers")
+		}
+		// cookies may be split across fields, section 8.2.3
+		if f.Name == "cookie" {
+			cookies = append(cookies, f.Value)
+			continue
+		}
+		h.Set(f.Name, f.Value)
+	}
+	if len(cookies) > 0 {
+		h.Override("cookie", strings.Join(cookies, "; "))
+	}
+
+	method := pseudo[":method"]
+	target := pseudo[":path"]
+	switch {
+	case method == "":
+		return nil, fmt.Errorf("error: missing :method")
+	case method == "CONNECT":
+		target = pseudo[":authority"]
+		if target == "" || pseudo[":scheme"] != "" || pseudo[":path"] != "" {
+			return nil, fmt.Errorf("error: CONNECT needs only :authority")
+		}
+	case pseudo[":scheme"] == "" || target == "":
+		return nil, fmt.Errorf("error: missing :scheme or :path")
+	}
+	// :authority takes the place of Host, section 8.3.1
+	if authority := pseudo[":authority"]; authority != "" {
+		h.Override("host", authority)
+	}
+	if cl := h.Get("content-length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n != len(body) {
+			return nil, fmt.Errorf("error: content-length %q does not match a body of %d bytes", cl, len(body))
+		}
+	}
+	if body == nil {
+		body = []byte{}
+	}
+	return &request.Request{
+		RequestLine: request.RequestLine{HttpVersion: "2.0", RequestTarget: target, Method: method},
+		Headers:     h,
+		Body:        body,
+	}, nil
+}
+
+// runHandler serves one stream. The handler writes an HTTP/1.1 response
+// into a pipe, which is parsed back and sent as HEADERS and DATA frames.
+func (sc *serverConn) runHandler(st *stream, req *request.Request) {
+	defer func() {
+		sc.mu.Lock()
+		sc.removeStream(st, errStreamClosed)
+		sc.mu.Unlock()
+	}()
+
+	pr, pw := io.Pipe()
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		w := response.Writer{W: pw}
+		sc.pc.ServeRequest(&w, req)
+		pw.Close()
+	}()
+	// a handler may write a body the response has no room for, e.g. for
+	// HEAD, which is discarded unless the stream was cut short
+	complete := false
+	defer func() {
+		if complete {
+			io.Copy(io.Discard, pr)
+		}
+		pr.Close()
+		<-handlerDone
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(pr), &http.Request{Method: req.RequestLine.Method})
+	if err != nil {
+		log.Printf("error: could not parse handler response: %v", err)
+		sc.resetStream(st.id, ErrCodeInternal)
+		return
+	}
+	defer resp.Body.Close()
+
+	fields := []HeaderField{{Name: ":status", Value: strconv.Itoa(resp.StatusCode)}}
+	fields = appendHeaderFields(fields, resp.Header)
+	endStream := resp.Body == http.NoBody
+	err = sc.writeHeaders(st, fields, endStream)
+	if err != nil {
+		return
+	}
+	if endStream {
+		complete = true
+		return
+	}
+
+	buf := make([]byte, defaultMaxFrameSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			werr := sc.writeData(st, buf[:n])
+			if werr != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("error: could not read handler response body: %v", err)
+			sc.resetStream(st.id, ErrCodeInternal)
+			return
+		}
+	}
+	complete = true
+	if len(resp.Trailer) > 0 {
+		sc.writeHeaders(st, appendHeaderFields(nil, resp.Trailer), true)
+		return
+	}
+	sc.writeFrame(frameData, flagEndStream, st.id, nil)
+}
+
+func appendHeaderFields(fields []HeaderField, h http.Header) []HeaderField {
+	for k, vv := range h {
+		name := strings.ToLower(k)
+		if connectionHeaders[name] {
+			continue
+		}
+		for _, v := range vv {
+			fields = append(fields, HeaderField{
+				Name:      name,
+				Value:     v,
+				Sensitive: name == "set-cookie",
+			})
+		}
+	}
+	return fields
+}
+
+// writeHeaders sends a header block, split into CONTINUATION frames when it
+// is larger than the client's maximum frame size
+func (sc *serverConn) writeHeaders(st *stream, fields []HeaderField, endStream bool) error {
+	block := Encode(nil, fields)
+	sc.mu.Lock()
+	maxSize := int(sc.peerMaxFrameSize)
+	reset := st.reset
+	sc.mu.Unlock()
+	if reset {
+		return errStreamClosed
+	}
+
+	flags := uint8(0)
+	if endStream {
+		flags |= flagEndStream
+	}
+	typ := frameHeaders
+	buf := []byte{}
+	for {
+		chunk := block[:min(len(block), maxSize)]
+		block = block[len(chunk):]
+		if len(block) == 0 {
+			flags |= flagEndHeaders
+		}
+		buf = appendFrame(buf, typ, flags, st.id, chunk)
+		if len(block) == 0 {
+			break
+		}
+		typ = frameContinuation
+		flags = 0
+	}
+	return sc.writeFrames(buf)
+}
+
+// writeData sends p as DATA frames, waiting for the client to open the
+// stream and connection windows as needed
+func (sc *serverConn) writeData(st *stream, p []byte) error {
+	for len(p) > 0 {
+		sc.mu.Lock()
+		for !st.reset && !sc.closed && (st.sendWindow <= 0 || sc.connSendWindow <= 0) {
+			sc.cond.Wait()
+		}
+		if st.reset || sc.closed {
+			sc.mu.Unlock()
+			return errStreamClosed
+		}
+		n := min(int64(len(p)), st.sendWindow, sc.connSendWindow, int64(sc.peerMaxFrameSize))
+		st.sendWindow -= n
+		sc.connSendWindow -= n
+		sc.mu.Unlock()
+
+		err := sc.writeFrame(frameData, 0, st.id, p[:n])
+		if err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package httpcompat
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/server"
+)
+
+// FromHTTPHandler runs a net/http handler on this project's parser and writer
+func FromHTTPHandler(h http.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		httpReq, err := ToHTTPRequest(req)
+		if err != nil {
+			log.Printf("error: could not convert request: %v", err)
+			w.WriteStatusLine(response.StatusBadRequest)
+			body := []byte(fmt.Sprintf("Error converting request: %v", err))
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody(body)
+			return
+		}
+		rw := &responseWriter{w: w, header: http.Header{}}
+		h.ServeHTTP(rw, httpReq)
+		err = rw.finish()
+		if err != nil {
+			log.Printf("error: could not finish response: %v", err)
+		}
+	}
+}
+
+func ToHTTPRequest(req *request.Request) (*http.Request, error) {
+	u, err := url.ParseRequestURI(req.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, fmt.Errorf("error: invalid request target: %v", err)
+	}
+	h := http.Header{}
+	for k, v := range req.Headers {
+		h.Set(k, v)
+	}
+	host := h.Get("Host")
+	h.Del("Host")
+	u.Host = host
+
+	major, minor := 1, 1
+	parts := strings.SplitN(req.RequestLine.HttpVersion, ".", 2)
+	if len(parts) == 2 {
+		major, _ = strconv.Atoi(parts[0])
+		minor, _ = strconv.Atoi(parts[1])
+	}
+
+	httpReq := &http.Request{
+		Method:        req.RequestLine.Method,
+		URL:           u,
+		Proto:         "HTTP/" + req.RequestLine.HttpVersion,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(req.Body)),
+		ContentLength: int64(len(req.Body)),
+		Host:          host,
+		RemoteAddr:    req.RemoteAddr,
+		RequestURI:    req.RequestLine.RequestTarget,
+		TLS:           req.TLS,
+	}
+	if len(req.Body) == 0 {
+		httpReq.Body = http.NoBody
+	}
+	return httpReq.WithContext(req.Context()), nil
+}
+
+type responseWriter struct {
+	w           *response.Writer
+	header      http.Header
+	wroteHeader bool
+	chunked     bool
+	trailers    []string
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *responseWriter) WriteHeader(statusCode int) {
+	if rw.wroteHeader {
+		log.Printf("error: superfluous WriteHeader call with status %d", statusCode)
+		return
+	}
+	rw.wroteHeader = true
+
+	err := rw.w.WriteStatusLine(response.StatusCode(statusCode))
+	if err != nil {
+		log.Printf("Error writing status line: %v", err)
+		return
+	}
+
+	h := headers.NewHeaders()
+	for k, vv := range rw.header {
+		if k == "Trailer" {
+			continue
+		}
+		for _, v := range vv {
+			h.Set(k, v)
+		}
+	}
+	for _, v := range rw.header.Values("Trailer") {
+		for _, k := range strings.Split(v, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			rw.trailers = append(rw.trailers, k)
+			h.Set("Trailer", k)
+		}
+	}
+	bodyless := statusCode == http.StatusNoContent || statusCode == http.StatusNotModified || statusCode < 200
+	if h.Get("Content-Length") == "" && !bodyless {
+		rw.chunked = true
+		h.Override("Transfer-Encoding", "chunked")
+	}
+	h.Override("Connection", "close")
+
+	err = rw.w.WriteHeaders(h)
+	if err != nil {
+		log.Printf("Error writing headers: %v", err)
+	}
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if !rw.wroteHeader {
+		if rw.header.Get("Content-Type") == "" && rw.header.Get("Transfer-Encoding") == "" {
+			rw.header.Set("Content-Type", http.DetectContentType(p))
+		}
+		rw.WriteHeader(http.StatusOK)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if rw.chunked {
+		_, err := rw.w.WriteChunkedBody(p)
+		if err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return rw.w.WriteBody(p)
+}
+
+// Flush is a no-op beyond committing the headers, response.Writer does not buffer
+func (rw *responseWriter) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// Hijack implements http.Hijacker. Bytes the client already sent are
+// served from the returned reader before the connection.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buffered, err := rw.w.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn))
+	return conn, bufio.NewReadWriter(r, bufio.NewWriter(conn)), nil
+}
+
+func (rw *responseWriter) finish() error {
+	if rw.w.Hijacked() {
+		return nil
+	}
+	if !rw.wroteHeader {
+		if rw.header.Get("Content-Length") == "" {
+			rw.header.Set("Content-Length", "0")
+		}
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.chunked {
+		return nil
+	}
+	h := headers.NewHeaders()
+	for _, k := range rw.trailers {
+		for _, v := range rw.header.Values(k) {
+			h.Set(k, v)
+		}
+	}
+	for k, vv := range rw.header {
+		if !strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+		for _, v := range vv {
+			h.Set(strings.TrimPrefix(k, http.TrailerPrefix), v)
+		}
+	}
+	return rw.w.WriteTrailers(h)
+}
+
+// ToHTTPHandler mounts a server.Handler inside net/http. The raw response
+// written by the handler is parsed back with http.ReadResponse and relayed
+// to the http.ResponseWriter, so chunked bodies and trailers are preserved.
+func ToHTTPHandler(h server.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		req, err := FromHTTPRequest(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		pr, pw := io.Pipe()
+		go func() {
+			defer func() {
+				// net/http's recovery doesn't cover this goroutine
+				if recovered := recover(); recovered != nil {
+					log.Printf("error: panic serving %s %s: %v\n%s", r.Method, r.URL, recovered, debug.Stack())
+					pw.CloseWithError(fmt.Errorf("error: handler panic: %v", recovered))
+				}
+			}()
+			w := response.Writer{W: pw}
+			h(&w, req)
+			pw.Close()
+		}()
+		defer pr.Close()
+
+		resp, err := http.ReadResponse(bufio.NewReader(pr), r)
+		if err != nil {
+			log.Printf("error: could not parse handler response: %v", err)
+			http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer resp.Body.Close()
+
+		for k, vv := range resp.Header {
+			if k == "Connection" || k == "Content-Length" {
+				continue
+			}
+			rw.Header()[k] = vv
+		}
+		for k := range resp.Trailer {
+			rw.Header().Add("Trailer", k)
+		}
+		if resp.ContentLength >= 0 {
+			rw.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		}
+		rw.WriteHeader(resp.StatusCode)
+
+		flusher, _ := rw.(http.Flusher)
+		buf := make([]byte, 1024)
+		for {
+			n, err := resp.Body.Read(buf)
+			if n > 0 {
+				_, werr := rw.Write(buf[:n])
+				if werr != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("error: could not read handler response body: %v", err)
+					// don't let a cut off body look complete
+					panic(http.ErrAbortHandler)
+				}
+				break
+			}
+		}
+		for k, vv := range resp.Trailer {
+			rw.Header()[k] = vv
+		}
+	})
+}
+
+func FromHTTPRequest(r *http.Request) (*request.Request, error) {
+	body := []byte{}
+	if r.Body != nil {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error: could not read request body: %v", err)
+		}
+		body = b
+	}
+	h := headers.NewHeaders()
+	for k, vv := range r.Header {
+		for _, v := range vv {
+			h.Set(k, v)
+		}
+	}
+	if r.Host != "" {
+		h.Override("Host", r.Host)
+	}
+	if len(body) > 0 {
+		h.Override("Content-Length", strconv.Itoa(len(body)))
+	}
+	target := r.URL.RequestURI()
+	if r.Method == "OPTIONS" && r.RequestURI == "*" {
+		target = "*"
+	}
+	req := &request.Request{
+		RequestLine: request.RequestLine{
+			HttpVersion:   fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor),
+			RequestTarget: target,
+			Method:        r.Method,
+		},
+		Headers:    h,
+		Body:       body,
+		RemoteAddr: r.RemoteAddr,
+		TLS:        r.TLS,
+	}
+	return req.WithContext(r.Context()), nil
+}
@@ -0,0 +1,149 @@
+package httpcompat
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromHTTPHandler(t *testing.T) {
+	req := &request.Request{
+		RequestLine: request.RequestLine{HttpVersion: "1.1", RequestTarget: "/echo?x=1", Method: "POST"},
+		Headers:     headers.Headers{"host": "localhost:42069", "x-test": "yes", "content-length": "5"},
+		Body:        []byte("hello"),
+	}
+
+	// Test: Chunked response with trailer
+	h := FromHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/echo", r.URL.Path)
+		assert.Equal(t, "1", r.URL.Query().Get("x"))
+		assert.Equal(t, "localhost:42069", r.Host)
+		assert.Equal(t, "yes", r.Header.Get("X-Test"))
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "hello", string(body))
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Trailer", "X-Done")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("abc"))
+		w.(http.Flusher).Flush()
+		w.Header().Set("X-Done", "true")
+	}))
+	buf := &bytes.Buffer{}
+	h(&response.Writer{W: buf}, req)
+	resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, "abc", string(body))
+	assert.Equal(t, "true", resp.Trailer.Get("X-Done"))
+
+	// Test: Handler that writes nothing
+	h = FromHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	buf = &bytes.Buffer{}
+	h(&response.Writer{W: buf}, req)
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, buf.String(), "content-length: 0\r\n")
+
+	// Test: Content-Length set by handler disables chunking
+	h = FromHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "2")
+		w.Write([]byte("ok"))
+	}))
+	buf = &bytes.Buffer{}
+	h(&response.Writer{W: buf}, req)
+	assert.NotContains(t, buf.String(), "transfer-encoding")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nok"))
+
+	// Test: Hijack hands over buffered bytes and skips finishing the response
+	h = FromHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		line, _ := rw.ReadString('\n')
+		rw.WriteString("raw " + line)
+		rw.Flush()
+	}))
+	server, client := net.Pipe()
+	go h(&response.Writer{W: hijackable{server, []byte("early\n")}}, req)
+	raw, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "raw early\n", string(raw))
+}
+
+type hijackable struct {
+	net.Conn
+	buffered []byte
+}
+
+func (h hijackable) Hijack() (net.Conn, []byte, error) {
+	return h.Conn, h.buffered, nil
+}
+
+func TestToHTTPHandler(t *testing.T) {
+	h := ToHTTPHandler(func(w *response.Writer, req *request.Request) {
+		assert.Equal(t, "/stream", req.RequestLine.RequestTarget)
+		assert.Equal(t, "example.com", req.Headers.Get("Host"))
+		w.WriteStatusLine(response.StatusOK)
+		hs := response.GetDefaultHeaders(0)
+		hs.Remove("Content-Length")
+		hs.Set("Transfer-Encoding", "chunked")
+		hs.Set("Trailer", "X-Content-Length")
+		w.WriteHeaders(hs)
+		w.WriteChunkedBody([]byte("hello "))
+		w.WriteChunkedBody([]byte("world"))
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Content-Length", "11")
+		w.WriteTrailers(trailers)
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/stream", nil))
+	res := rec.Result()
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "hello world", string(body))
+	assert.Equal(t, "text/plain", res.Header.Get("Content-Type"))
+	assert.Equal(t, "11", res.Trailer.Get("X-Content-Length"))
+}
+
+func TestToHTTPHandlerPanic(t *testing.T) {
+	h := ToHTTPHandler(func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/late" {
+			w.WriteStatusLine(response.StatusOK)
+			hs := response.GetDefaultHeaders(0)
+			hs.Remove("Content-Length")
+			hs.Set("Transfer-Encoding", "chunked")
+			w.WriteHeaders(hs)
+			w.WriteChunkedBody([]byte("partial"))
+		}
+		panic("boom")
+	})
+
+	// Test: A panic before the response starts is a 500
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+	assert.Equal(t, 500, rec.Code)
+
+	// Test: A panic during the body aborts the response
+	rec = httptest.NewRecorder()
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/late", nil))
+	})
+	assert.Equal(t, "partial", rec.Body.String())
+}
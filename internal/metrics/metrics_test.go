@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExposition(t *testing.T) {
+	reg := NewRegistry()
+	requests := reg.NewCounter("requests_total", "Requests served.", "method", "path")
+	inFlight := reg.NewGauge("in_flight", "In flight\nrequests.")
+	latency := reg.NewHistogram("latency_seconds", "Latency.", []float64{1, 0.1})
+
+	requests.Inc("GET", "/")
+	requests.Add(2, "POST", "/a\"b")
+	requests.Inc("GET", "/")
+	inFlight.Inc()
+	inFlight.Inc()
+	inFlight.Dec()
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+
+	// Test: Text exposition format
+	buf := &bytes.Buffer{}
+	reg.WriteTo(buf)
+	assert.Equal(t, `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{method="GET",path="/"} 2
+requests_total{method="POST",path="/a\"b"} 2
+# HELP in_flight In flight\nrequests.
+# TYPE in_flight gauge
+in_flight 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+`, buf.String())
+
+	// Test: Accessors
+	assert.Equal(t, float64(2), requests.Value("GET", "/"))
+	assert.Equal(t, uint64(3), latency.Count())
+
+	// Test: Misuse panics
+	assert.Panics(t, func() { requests.Inc("GET") })
+	assert.Panics(t, func() { requests.Add(-1, "GET", "/") })
+	assert.Panics(t, func() { reg.NewGauge("in_flight", "again") })
+}
+
+func TestHandler(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounter("hits_total", "Hits.").Inc()
+
+	// Test: Handler serves the registry
+	buf := &bytes.Buffer{}
+	reg.Handler()(&response.Writer{W: buf}, &request.Request{})
+	assert.Contains(t, buf.String(), "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, buf.String(), "content-type: "+ContentType+"\r\n")
+	assert.Contains(t, buf.String(), "\r\n\r\n# HELP hits_total Hits.\n# TYPE hits_total counter\nhits_total 1\n")
+}
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+)
+
+type Strategy int
+
+const (
+	RoundRobin Strategy = iota
+	LeastConnections
+	// ConsistentHash sends requests with the same HashHeader value to the
+	// same upstream, moving few keys when upstreams come and go
+	ConsistentHash
+)
+
+// replicas of each upstream on the hash ring, evening out its share
+const ringReplicas = 100
+
+// Upstream is one backend of a Pool
+type Upstream struct {
+	URL *url.URL
+	// guarded by the pool's mu
+	active       int
+	failures     int
+	healthy      bool
+	ejectedUntil time.Time
+}
+
+// Pool balances requests over upstreams, skipping those failing their
+// health check or ejected after MaxFails consecutive failed requests.
+// Configure it before use.
+type Pool struct {
+	mu        sync.Mutex
+	upstreams []*Upstream
+	ring      []ringPoint
+	next      int
+
+	Strategy Strategy
+	// header hashed by ConsistentHash, requests without it use round robin
+	HashHeader string
+	// extra attempts of idempotent requests on other upstreams
+	Retries int
+	// consecutive failures before ejection, and for how long
+	MaxFails int
+	EjectFor time.Duration
+	// active checks GET HealthPath, expecting 2xx or 3xx. None if empty.
+	HealthPath     string
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+
+	now func() time.Time
+}
+
+type ringPoint struct {
+	hash     uint32
+	upstream *Upstream
+}
+
+// NewPool balances over targets, http or https URLs with optional base paths
+func NewPool(targets ...string) (*Pool, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("error: upstream pool needs at least one target")
+	}
+	p := &Pool{
+		Retries:        2,
+		MaxFails:       3,
+		EjectFor:       30 * time.Second,
+		HealthInterval: 10 * time.Second,
+		HealthTimeout:  2 * time.Second,
+		now:            time.Now,
+	}
+	for _, target := range targets {
+		u, err := parseTarget(target)
+		if err != nil {
+			return nil, err
+		}
+		up := &Upstream{URL: u, healthy: true}
+		p.upstreams = append(p.upstreams, up)
+		for i := 0; i < ringReplicas; i++ {
+			p.ring = append(p.ring, ringPoint{hash: hashKey(u.String() + "#" + strconv.Itoa(i)), upstream: up})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	return p, nil
+}
+
+func hashKey(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	// FNV leaves similar keys close together, mix them over the ring
+	// with the murmur3 finalizer
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// available must be called with mu held
+func (p *Pool) available(u *Upstream, tried map[*Upstream]bool) bool {
+	return u.healthy && !tried[u] && !p.now().Before(u.ejectedUntil)
+}
+
+// acquire picks an upstream that hasn't been tried yet and counts the
+// request as active on it, nil if none is available
+func (p *Pool) acquire(req *request.Request, tried map[*Upstream]bool) *Upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var picked *Upstream
+	key := ""
+	if p.HashHeader != "" {
+		key = req.Headers.Get(p.HashHeader)
+	}
+	switch {
+	case p.Strategy == ConsistentHash && key != "":
+		h := hashKey(key)
+		start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+		for i := range p.ring {
+			point := p.ring[(start+i)%len(p.ring)]
+			if p.available(point.upstream, tried) {
+				picked = point.upstream
+				break
+			}
+		}
+	case p.Strategy == LeastConnections:
+		// ties go round robin
+		for i := range p.upstreams {
+			u := p.upstreams[(p.next+i)%len(p.upstreams)]
+			if p.available(u, tried) && (picked == nil || u.active < picked.active) {
+				picked = u
+			}
+		}
+		p.next++
+	default:
+		for i := range p.upstreams {
+			u := p.upstreams[(p.next+i)%len(p.upstreams)]
+			if p.available(u, tried) {
+				picked = u
+				p.next += i + 1
+				break
+			}
+		}
+	}
+	if picked != nil {
+		picked.active++
+	}
+	return picked
+}
+
+// release ends a request on u, ejecting u after MaxFails failures in a row
+// unless it's the only upstream
+func (p *Pool) release(u *Upstream, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u.active--
+	if !failed {
+		u.failures = 0
+		return
+	}
+	u.failures++
+	if p.MaxFails > 0 && u.failures >= p.MaxFails && len(p.upstreams) > 1 {
+		log.Printf("Upstream %s ejected for %v after %d failures", u.URL, p.EjectFor, u.failures)
+		u.ejectedUntil = p.now().Add(p.EjectFor)
+		u.failures = 0
+	}
+}
+
+// Healthy reports whether u passes its health check and isn't ejected
+func (p *Pool) Healthy(u *Upstream) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.available(u, nil)
+}
+
+func (p *Pool) Upstreams() []*Upstream {
+	return p.upstreams
+}
+
+// CheckHealth runs one round of active health checks
+func (p *Pool) CheckHealth(ctx context.Context) {
+	if p.HealthPath == "" {
+		return
+	}
+	client := &http.Client{
+		Timeout: p.HealthTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	wg := sync.WaitGroup{}
+	for _, u := range p.upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			healthy := p.check(ctx, client, u)
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if healthy != u.healthy {
+				log.Printf("Upstream %s healthy: %v", u.URL, healthy)
+			}
+			u.healthy = healthy
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Pool) check(ctx context.Context, client *http.Client, u *Upstream) bool {
+	target := *u.URL
+	target.RawPath = ""
+	target.Path = joinPath(u.URL.Path, p.HealthPath)
+	req, err := http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+// StartHealthChecks checks every HealthInterval until ctx is done
+func (p *Pool) StartHealthChecks(ctx context.Context) {
+	if p.HealthPath == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(p.HealthInterval)
+		defer ticker.Stop()
+		for {
+			p.CheckHealth(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/cache"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type backend struct {
+	*httptest.Server
+	name    string
+	hits    atomic.Int32
+	healthy atomic.Bool
+}
+
+func newBackend(name string) *backend {
+	b := &backend{name: name}
+	b.healthy.Store(true)
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			if !b.healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		b.hits.Add(1)
+		w.Write([]byte(b.name))
+	}))
+	return b
+}
+
+func deadURL(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return "http://" + l.Addr().String()
+}
+
+func TestPoolStrategies(t *testing.T) {
+	a, b, c := newBackend("a"), newBackend("b"), newBackend("c")
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	pool, err := NewPool(a.URL, b.URL, c.URL)
+	require.NoError(t, err)
+	p := NewBalanced(pool)
+
+	// Test: Round robin takes turns
+	got := []string{}
+	for i := 0; i < 6; i++ {
+		got = append(got, serve(t, p, newRequest("GET", "/", "", nil)).body)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, got)
+
+	// Test: Least connections picks the least busy upstream
+	pool.Strategy = LeastConnections
+	busyA := pool.acquire(newRequest("GET", "/", "", nil), nil)
+	busyB := pool.acquire(newRequest("GET", "/", "", nil), nil)
+	assert.NotEqual(t, busyA, busyB)
+	names := map[*Upstream]string{}
+	for i, u := range pool.Upstreams() {
+		names[u] = []string{"a", "b", "c"}[i]
+	}
+	for i := 0; i < 3; i++ {
+		res := serve(t, p, newRequest("GET", "/", "", nil))
+		assert.NotEqual(t, names[busyA], res.body)
+		assert.NotEqual(t, names[busyB], res.body)
+	}
+	pool.release(busyA, false)
+	pool.release(busyB, false)
+
+	// Test: Consistent hashing keeps a key on one upstream
+	pool.Strategy = ConsistentHash
+	pool.HashHeader = "X-User"
+	owners := map[string]string{}
+	for i := 0; i < 50; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		first := serve(t, p, newRequest("GET", "/", "", headers.Headers{"x-user": user})).body
+		again := serve(t, p, newRequest("GET", "/", "", headers.Headers{"x-user": user})).body
+		assert.Equal(t, first, again)
+		owners[user] = first
+	}
+	counts := map[string]int{}
+	for _, owner := range owners {
+		counts[owner]++
+	}
+	assert.Len(t, counts, 3)
+
+	// Test: Only the keys of an ejected upstream move
+	pool.mu.Lock()
+	pool.upstreams[1].ejectedUntil = time.Now().Add(time.Hour)
+	pool.mu.Unlock()
+	for user, owner := range owners {
+		res := serve(t, p, newRequest("GET", "/", "", headers.Headers{"x-user": user}))
+		if owner != "b" {
+			assert.Equal(t, owner, res.body, user)
+		} else {
+			assert.NotEqual(t, "b", res.body, user)
+		}
+	}
+}
+
+func TestPoolHealth(t *testing.T) {
+	a, b := newBackend("a"), newBackend("b")
+	defer a.Close()
+	defer b.Close()
+	dead := deadURL(t)
+	pool, err := NewPool(a.URL, dead, b.URL)
+	require.NoError(t, err)
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+	p := NewBalanced(pool)
+
+	// Test: Idempotent requests are retried on another upstream
+	for i := 0; i < 4; i++ {
+		res := serve(t, p, newRequest("GET", "/", "", nil))
+		assert.Equal(t, 200, res.StatusCode)
+	}
+
+	// Test: Other requests are not retried
+	pool.next = 1
+	res := serve(t, p, newRequest("POST", "/", "body", nil))
+	assert.Equal(t, 502, res.StatusCode)
+
+	// Test: Consecutive failures eject an upstream until EjectFor has passed
+	assert.False(t, pool.Healthy(pool.Upstreams()[1]))
+	pool.next = 1
+	res = serve(t, p, newRequest("POST", "/", "body", nil))
+	assert.Equal(t, 200, res.StatusCode)
+	now = now.Add(pool.EjectFor)
+	assert.True(t, pool.Healthy(pool.Upstreams()[1]))
+
+	// Test: Active checks take failing upstreams out and back in
+	pool.HealthPath = "/healthz"
+	a.healthy.Store(false)
+	pool.CheckHealth(context.Background())
+	assert.False(t, pool.Healthy(pool.Upstreams()[0]))
+	assert.False(t, pool.Healthy(pool.Upstreams()[1]))
+	assert.True(t, pool.Healthy(pool.Upstreams()[2]))
+	hits := a.hits.Load()
+	for i := 0; i < 3; i++ {
+		res = serve(t, p, newRequest("GET", "/", "", nil))
+		assert.Equal(t, "b", res.body)
+	}
+	assert.Equal(t, hits, a.hits.Load())
+	a.healthy.Store(true)
+	pool.CheckHealth(context.Background())
+	assert.True(t, pool.Healthy(pool.Upstreams()[0]))
+
+	// Test: Without a healthy upstream the service is unavailable
+	b.Close()
+	a.healthy.Store(false)
+	pool.CheckHealth(context.Background())
+	res = serve(t, p, newRequest("GET", "/", "", nil))
+	assert.Equal(t, 503, res.StatusCode)
+
+	// Test: Pools need valid targets
+	_, err = NewPool()
+	assert.Error(t, err)
+	_, err = NewPool(a.URL, "ftp://example.com")
+	assert.Error(t, err)
+}
+
+func TestPoolCache(t *testing.T) {
+	var hits atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.Method == "GET" {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("v" + fmt.Sprint(hits.Load())))
+		}
+	})
+	a, b := httptest.NewServer(handler), httptest.NewServer(handler)
+	defer a.Close()
+	defer b.Close()
+	pool, err := NewPool(a.URL, b.URL)
+	require.NoError(t, err)
+	p := NewBalanced(pool)
+	p.Transport = cache.New(nil, cache.NewMemoryStore(1<<20))
+
+	// Test: Responses are cached once whichever upstream served them
+	assert.Equal(t, "v1", serve(t, p, newRequest("GET", "/items", "", nil)).body)
+	assert.Equal(t, "v1", serve(t, p, newRequest("GET", "/items", "", nil)).body)
+	assert.Equal(t, "v1", serve(t, p, newRequest("GET", "/items", "", nil)).body)
+	assert.Equal(t, int32(1), hits.Load())
+
+	// Test: An unsafe request through one upstream invalidates them for all
+	assert.Equal(t, 200, serve(t, p, newRequest("PUT", "/items", "new", nil)).StatusCode)
+	assert.Equal(t, "v3", serve(t, p, newRequest("GET", "/items", "", nil)).body)
+	assert.Equal(t, "v3", serve(t, p, newRequest("GET", "/items", "", nil)).body)
+	assert.Equal(t, int32(3), hits.Load())
+}
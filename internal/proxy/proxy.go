@@ -0,0 +1,390 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/cache"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/server"
+)
+
+const copyBufferSize = 32 << 10
+
+// hopHeaders only describe one connection and are never forwarded, RFC 9110
+// section 7.6.1. Fields named in Connection are removed as well.
+var hopHeaders = []string{
+	"connection",
+	"proxy-connection",
+	"keep-alive",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+// ReverseProxy forwards requests to an upstream server and relays its
+// responses. The request path, minus StripPrefix, is appended to the
+// target's path and the queries of both are combined.
+type ReverseProxy struct {
+	// one of target and pool
+	target *url.URL
+	pool   *Pool
+	// removed from the front of the request path before forwarding
+	StripPrefix string
+	// send the client's Host upstream instead of the target's
+	PreserveHost bool
+	// http.DefaultTransport if nil. Redirects are relayed, not followed.
+	Transport http.RoundTripper
+	// Rewrite, if set, can change the outgoing request last
+	Rewrite func(out *http.Request, in *request.Request)
+	// RenderText if nil
+	ErrorRenderer server.ErrorRenderer
+}
+
+// New proxies to target, an http or https URL with an optional base path
+func New(target string) (*ReverseProxy, error) {
+	u, err := parseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	return &ReverseProxy{target: u}, nil
+}
+
+// NewBalanced proxies to the upstreams of pool
+func NewBalanced(pool *Pool) *ReverseProxy {
+	return &ReverseProxy{pool: pool}
+}
+
+func parseTarget(target string) (*url.URL, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("error: invalid proxy target '%s': %w", target, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("error: proxy target must be an http or https URL: '%s'", target)
+	}
+	return u, nil
+}
+
+func (p *ReverseProxy) ServeRequest(w *response.Writer, req *request.Request) {
+	server.HandleErrors(p.serve, p.ErrorRenderer)(w, req)
+}
+
+func (p *ReverseProxy) transport() http.RoundTripper {
+	if p.Transport == nil {
+		return http.DefaultTransport
+	}
+	return p.Transport
+}
+
+func (p *ReverseProxy) serve(w *response.Writer, req *request.Request) *server.HandlerError {
+	if p.pool != nil {
+		return p.serveBalanced(w, req)
+	}
+	out, herr := p.outgoing(req, p.target)
+	if herr != nil {
+		return herr
+	}
+	resp, err := p.transport().RoundTrip(out)
+	if err != nil {
+		return gatewayError(err)
+	}
+	defer resp.Body.Close()
+	return p.relay(w, req, resp)
+}
+
+// serveBalanced retries idempotent requests on another upstream when the
+// round trip fails. Gateway errors from an upstream count against it but
+// are relayed.
+func (p *ReverseProxy) serveBalanced(w *response.Writer, req *request.Request) *server.HandlerError {
+	tried := map[*Upstream]bool{}
+	attempts := 1
+	if idempotent[req.RequestLine.Method] {
+		attempts += p.pool.Retries
+	}
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		u := p.pool.acquire(req, tried)
+		if u == nil {
+			break
+		}
+		tried[u] = true
+		out, herr := p.outgoing(req, u.URL)
+		if herr != nil {
+			p.pool.release(u, false)
+			return herr
+		}
+		resp, err := p.transport().RoundTrip(out)
+		if err != nil {
+			p.pool.release(u, true)
+			lastErr = err
+			if req.Context().Err() != nil {
+				break
+			}
+			continue
+		}
+		failed := resp.StatusCode == 502 || resp.StatusCode == 503 || resp.StatusCode == 504
+		herr = p.relay(w, req, resp)
+		resp.Body.Close()
+		p.pool.release(u, failed || (herr != nil && herr.StatusCode == response.StatusBadGateway))
+		return herr
+	}
+	if lastErr != nil {
+		return gatewayError(lastErr)
+	}
+	return &server.HandlerError{StatusCode: response.StatusServiceUnavailable, Message: "No healthy upstream"}
+}
+
+// idempotent methods can be sent again after a failed attempt, RFC 9110
+// section 9.2.2
+var idempotent = map[string]bool{
+	"GET": true, "HEAD": true, "OPTIONS": true, "TRACE": true, "PUT": true, "DELETE": true,
+}
+
+// outgoing builds the upstream request for req
+func (p *ReverseProxy) outgoing(req *request.Request, target *url.URL) (*http.Request, *server.HandlerError) {
+	in, err := url.ParseRequestURI(req.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, &server.HandlerError{StatusCode: response.StatusBadRequest, Message: "Invalid request target", Err: err}
+	}
+	path := in.EscapedPath()
+	if p.StripPrefix != "" {
+		rest, ok := strings.CutPrefix(path, p.StripPrefix)
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			return nil, &server.HandlerError{StatusCode: response.StatusNotFound}
+		}
+		path = rest
+	}
+	u := *target
+	u.RawPath = joinPath(target.EscapedPath(), path)
+	u.Path, err = url.PathUnescape(u.RawPath)
+	if err != nil {
+		return nil, &server.HandlerError{StatusCode: response.StatusBadRequest, Message: "Invalid request target", Err: err}
+	}
+	switch {
+	case target.RawQuery == "":
+		u.RawQuery = in.RawQuery
+	case in.RawQuery != "":
+		u.RawQuery = target.RawQuery + "&" + in.RawQuery
+	}
+
+	var body io.Reader = http.NoBody
+	if len(req.Body) > 0 {
+		body = bytes.NewReader(req.Body)
+	}
+	client := &url.URL{Scheme: "http", Host: req.Host(), Path: in.Path, RawPath: in.RawPath, RawQuery: in.RawQuery}
+	if req.TLS != nil {
+		client.Scheme = "https"
+	}
+	ctx := cache.WithTarget(req.Context(), client)
+	out, err := http.NewRequestWithContext(ctx, req.RequestLine.Method, u.String(), body)
+	if err != nil {
+		return nil, &server.HandlerError{StatusCode: response.StatusBadRequest, Err: err}
+	}
+	out.ContentLength = int64(len(req.Body))
+
+	h := removeHopHeaders(req.Headers)
+	for k, v := range h {
+		for _, line := range strings.Split(v, "\n") {
+			out.Header.Add(k, line)
+		}
+	}
+	out.Header.Del("Host")
+	out.Header.Del("Content-Length")
+	// asking for trailers is end to end, even though TE is hop-by-hop
+	if req.Headers.HasToken("TE", "trailers") {
+		out.Header.Set("Te", "trailers")
+	}
+	if _, ok := out.Header["User-Agent"]; !ok {
+		// keep Go's default out of the request
+		out.Header.Set("User-Agent", "")
+	}
+	if p.PreserveHost {
+		out.Host = req.Headers.Get("Host")
+	}
+	setForwarded(out, req)
+
+	if p.Rewrite != nil {
+		p.Rewrite(out, req)
+	}
+	return out, nil
+}
+
+func joinPath(base, path string) string {
+	switch {
+	case path == "":
+		if base == "" {
+			return "/"
+		}
+		return base
+	case strings.HasSuffix(base, "/") && strings.HasPrefix(path, "/"):
+		return base + path[1:]
+	case !strings.HasSuffix(base, "/") && !strings.HasPrefix(path, "/"):
+		return base + "/" + path
+	}
+	return base + path
+}
+
+// removeHopHeaders copies h without hop-by-hop fields
+func removeHopHeaders(h headers.Headers) headers.Headers {
+	out := headers.NewHeaders()
+	for k, v := range h {
+		out[k] = v
+	}
+	for _, name := range strings.Split(h.Get("Connection"), ",") {
+		out.Remove(strings.TrimSpace(name))
+	}
+	for _, name := range hopHeaders {
+		out.Remove(name)
+	}
+	return out
+}
+
+// setForwarded appends the client to X-Forwarded-For and Forwarded (RFC
+// 7239) and records the original host and scheme
+func setForwarded(out *http.Request, req *request.Request) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	host := req.Headers.Get("Host")
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+
+	node := "unknown"
+	if clientIP != "" {
+		if prior := out.Header.Get("X-Forwarded-For"); prior != "" {
+			out.Header.Set("X-Forwarded-For", prior+", "+clientIP)
+		} else {
+			out.Header.Set("X-Forwarded-For", clientIP)
+		}
+		node = clientIP
+		if strings.Contains(clientIP, ":") {
+			node = `"[` + clientIP + `]"`
+		}
+	}
+	forwarded := "for=" + node + ";proto=" + proto
+	if host != "" {
+		forwarded += ";host=" + quoteForwarded(host)
+	}
+	if prior := out.Header.Get("Forwarded"); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	out.Header.Set("Forwarded", forwarded)
+	out.Header.Set("X-Forwarded-Host", host)
+	out.Header.Set("X-Forwarded-Proto", proto)
+}
+
+// quoteForwarded quotes a value that isn't a plain token, like host:port
+func quoteForwarded(v string) string {
+	for _, c := range v {
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", c) &&
+			!('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+// gatewayError turns a failed round trip into 504 for timeouts, 502 otherwise
+func gatewayError(err error) *server.HandlerError {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &server.HandlerError{StatusCode: response.StatusGatewayTimeout, Err: fmt.Errorf("upstream: %w", err)}
+	}
+	return &server.HandlerError{StatusCode: response.StatusBadGateway, Err: fmt.Errorf("upstream: %w", err)}
+}
+
+// relay writes resp to w. Bodies of known length keep their Content-Length,
+// others and those with trailers are chunked.
+func (p *ReverseProxy) relay(w *response.Writer, req *request.Request, resp *http.Response) *server.HandlerError {
+	h := headers.NewHeaders()
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			h.Set(k, v)
+		}
+	}
+	h = removeHopHeaders(h)
+
+	noBody := req.RequestLine.Method == "HEAD" || resp.StatusCode == 204 || resp.StatusCode == 304 ||
+		(resp.StatusCode >= 100 && resp.StatusCode < 200)
+	chunked := !noBody && (resp.ContentLength < 0 || len(resp.Trailer) > 0)
+	if chunked {
+		h.Remove("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		names := make([]string, 0, len(resp.Trailer))
+		for k := range resp.Trailer {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		if len(names) > 0 {
+			h.Set("Trailer", strings.Join(names, ", "))
+		}
+	} else if !noBody {
+		h.Override("Content-Length", fmt.Sprintf("%d", resp.ContentLength))
+	}
+
+	err := w.WriteStatusLine(response.StatusCode(resp.StatusCode))
+	if err != nil {
+		return &server.HandlerError{StatusCode: response.StatusInternalServerError, Err: err}
+	}
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return &server.HandlerError{StatusCode: response.StatusInternalServerError, Err: err}
+	}
+	if noBody {
+		return nil
+	}
+
+	buf := make([]byte, copyBufferSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			var werr error
+			if chunked {
+				_, werr = w.WriteChunkedBody(buf[:n])
+			} else {
+				_, werr = w.WriteBody(buf[:n])
+			}
+			if werr != nil {
+				return &server.HandlerError{StatusCode: response.StatusInternalServerError, Err: werr}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &server.HandlerError{StatusCode: response.StatusBadGateway, Err: fmt.Errorf("reading upstream body: %w", err)}
+		}
+	}
+	if !chunked {
+		return nil
+	}
+
+	trailers := headers.NewHeaders()
+	for k, vs := range resp.Trailer {
+		for _, v := range vs {
+			trailers.Set(k, v)
+		}
+	}
+	err = w.WriteTrailers(trailers)
+	if err != nil {
+		return &server.HandlerError{StatusCode: response.StatusInternalServerError, Err: err}
+	}
+	return nil
+}
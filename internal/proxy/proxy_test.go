@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type result struct {
+	*http.Response
+	body string
+}
+
+func newRequest(method, target string, body string, h headers.Headers) *request.Request {
+	if h == nil {
+		h = headers.NewHeaders()
+	}
+	h.Set("Host", "proxy.test:42069")
+	return &request.Request{
+		RequestLine: request.RequestLine{HttpVersion: "1.1", RequestTarget: target, Method: method},
+		Headers:     h,
+		Body:        []byte(body),
+		RemoteAddr:  "192.0.2.7:5555",
+	}
+}
+
+func serve(t *testing.T, p *ReverseProxy, req *request.Request) result {
+	buf := &bytes.Buffer{}
+	p.ServeRequest(&response.Writer{W: buf}, req)
+	resp, err := http.ReadResponse(bufio.NewReader(buf), &http.Request{Method: req.RequestLine.Method})
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return result{resp, string(body)}
+}
+
+func TestReverseProxy(t *testing.T) {
+	var got *http.Request
+	var gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		switch r.URL.Path {
+		case "/base/trailers":
+			w.Header().Set("Trailer", "X-Checksum")
+			w.Write([]byte("part one, "))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("part two"))
+			w.Header().Set("X-Checksum", "abc")
+		case "/base/stream":
+			for i := 0; i < 5; i++ {
+				w.Write([]byte("short"))
+				w.(http.Flusher).Flush()
+			}
+		case "/base/teapot":
+			w.Header().Set("Connection", "X-Hop")
+			w.Header().Set("X-Hop", "secret")
+			w.Header().Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+			w.Header().Add("Set-Cookie", "b=2")
+			w.Header().Set("Location", "/elsewhere")
+			w.WriteHeader(http.StatusTeapot)
+			w.Write([]byte("short and stout"))
+		case "/base/slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("ok " + r.Method))
+		}
+	}))
+	defer upstream.Close()
+
+	p, err := New(upstream.URL + "/base?key=1")
+	require.NoError(t, err)
+	p.StripPrefix = "/api"
+
+	// Test: Method, body and end to end headers are forwarded
+	h := headers.Headers{
+		"content-type": "application/json",
+		"x-custom":     "yes",
+		"connection":   "keep-alive, X-Drop",
+		"x-drop":       "gone",
+		"keep-alive":   "timeout=5",
+		"upgrade":      "h2c",
+	}
+	res := serve(t, p, newRequest("PUT", "/api/items/a%2Fb?q=2", `{"a":1}`, h))
+	require.NotNil(t, got)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "ok PUT", res.body)
+	assert.Equal(t, "PUT", got.Method)
+	assert.Equal(t, `{"a":1}`, gotBody)
+	assert.Equal(t, "application/json", got.Header.Get("Content-Type"))
+	assert.Equal(t, "yes", got.Header.Get("X-Custom"))
+	assert.Empty(t, got.Header.Get("X-Drop"))
+	assert.Empty(t, got.Header.Get("Keep-Alive"))
+	assert.Empty(t, got.Header.Get("Upgrade"))
+
+	// Test: The path is rewritten and the queries combined
+	assert.Equal(t, "/base/items/a%2Fb", got.URL.EscapedPath())
+	assert.Equal(t, "key=1&q=2", got.URL.RawQuery)
+	assert.Equal(t, strings.TrimPrefix(upstream.URL, "http://"), got.Host)
+
+	// Test: The client is added to X-Forwarded-For and Forwarded
+	assert.Equal(t, "192.0.2.7", got.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, `for=192.0.2.7;proto=http;host="proxy.test:42069"`, got.Header.Get("Forwarded"))
+	assert.Equal(t, "proxy.test:42069", got.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "http", got.Header.Get("X-Forwarded-Proto"))
+	h = headers.Headers{"x-forwarded-for": "198.51.100.1", "forwarded": "for=198.51.100.1"}
+	req := newRequest("GET", "/api", "", h)
+	req.RemoteAddr = "[2001:db8::1]:5555"
+	serve(t, p, req)
+	assert.Equal(t, "198.51.100.1, 2001:db8::1", got.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, `for=198.51.100.1, for="[2001:db8::1]";proto=http;host="proxy.test:42069"`, got.Header.Get("Forwarded"))
+	assert.Equal(t, "/base", got.URL.Path)
+
+	// Test: Status, headers and cookies are relayed, without hop-by-hop fields
+	res = serve(t, p, newRequest("GET", "/api/teapot", "", nil))
+	assert.Equal(t, http.StatusTeapot, res.StatusCode)
+	assert.Equal(t, "short and stout", res.body)
+	assert.Equal(t, "/elsewhere", res.Header.Get("Location"))
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT", "b=2"}, res.Header.Values("Set-Cookie"))
+	assert.Empty(t, res.Header.Get("X-Hop"))
+
+	// Test: Trailers are relayed
+	res = serve(t, p, newRequest("GET", "/api/trailers", "", headers.Headers{"te": "trailers"}))
+	assert.Equal(t, "part one, part two", res.body)
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	assert.Equal(t, "abc", res.Trailer.Get("X-Checksum"))
+	assert.Equal(t, "trailers", got.Header.Get("Te"))
+
+	// Test: Short reads from upstream are relayed exactly
+	res = serve(t, p, newRequest("GET", "/api/stream", "", nil))
+	assert.Equal(t, strings.Repeat("short", 5), res.body)
+
+	// Test: HEAD responses have no body
+	res = serve(t, p, newRequest("HEAD", "/api/", "", nil))
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Empty(t, res.body)
+
+	// Test: The client's Host can be preserved
+	p.PreserveHost = true
+	serve(t, p, newRequest("GET", "/api/", "", nil))
+	assert.Equal(t, "proxy.test:42069", got.Host)
+	p.PreserveHost = false
+
+	// Test: Paths outside the prefix are not found
+	res = serve(t, p, newRequest("GET", "/apix", "", nil))
+	assert.Equal(t, 404, res.StatusCode)
+
+	// Test: Slow upstreams time out with 504
+	p.Transport = &http.Transport{ResponseHeaderTimeout: 50 * time.Millisecond}
+	res = serve(t, p, newRequest("GET", "/api/slow", "", nil))
+	assert.Equal(t, 504, res.StatusCode)
+
+	// Test: Unreachable upstreams are a bad gateway
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	p, err = New("http://" + addr)
+	require.NoError(t, err)
+	res = serve(t, p, newRequest("GET", "/", "", nil))
+	assert.Equal(t, 502, res.StatusCode)
+
+	// Test: Targets must be http URLs
+	_, err = New("ftp://example.com")
+	assert.Error(t, err)
+	_, err = New("/relative")
+	assert.Error(t, err)
+}
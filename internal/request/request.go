@@ -1,9 +1,14 @@
 package request
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -19,13 +24,42 @@ const (
 	done
 )
 
+// default initial size of the read buffer
 const bufferSize = 8
 
+// Limits bound what RequestFromReaderLimits reads, 0 leaves a limit off
+type Limits struct {
+	// initial size of the read buffer, which grows as needed. Defaults to
+	// 8 bytes.
+	BufferSize int
+	// bytes of the request line and headers together
+	MaxHeaderBytes int
+	MaxBodyBytes   int
+}
+
+var (
+	ErrHeaderTooLarge = errors.New("error: request line and headers too large")
+	ErrBodyTooLarge   = errors.New("error: request body too large")
+)
+
 type Request struct {
 	RequestLine RequestLine
 	Headers     headers.Headers
 	Body        []byte
-	state       int
+	RemoteAddr  string
+	// nil for plaintext connections
+	TLS *tls.ConnectionState
+	// route pattern that matched the request, set by the router
+	Pattern string
+	// shared with copies made by WithContext, see SetPattern
+	matched    *string
+	pathValues map[string]string
+	ctx        context.Context
+	buffered   []byte
+	state      int
+	hostCount  int
+	limits     Limits
+	headBytes  int
 }
 
 type RequestLine struct {
@@ -34,6 +68,168 @@ type RequestLine struct {
 	Method        string
 }
 
+// Context returns the request's context, cancelled when the client goes away,
+// the server stops or the request deadline passes
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r using ctx, for example to attach
+// values in a middleware before calling the next handler
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("request: nil context")
+	}
+	if r.matched == nil {
+		r.matched = new(string)
+	}
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+	return r2
+}
+
+// SetPattern records the route pattern that matched. Unlike setting
+// Pattern, it is seen by MatchedPattern on the request a middleware copied
+// with WithContext, e.g. by the server's metrics.
+func (r *Request) SetPattern(pattern string) {
+	r.Pattern = pattern
+	if r.matched != nil {
+		*r.matched = pattern
+	}
+}
+
+// MatchedPattern returns the pattern set on r or any copy of it
+func (r *Request) MatchedPattern() string {
+	if r.matched != nil && *r.matched != "" {
+		return *r.matched
+	}
+	return r.Pattern
+}
+
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+func (r *Request) SetPathValue(name, value string) {
+	if r.pathValues == nil {
+		r.pathValues = map[string]string{}
+	}
+	r.pathValues[name] = value
+}
+
+// Path returns the request target without its query string
+func (r *Request) Path() string {
+	path, _, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	return path
+}
+
+// Buffered returns bytes read from the connection past the end of the
+// request, e.g. the start of a protocol the connection is upgraded to
+func (r *Request) Buffered() []byte {
+	return r.buffered
+}
+
+// AppendBuffered adds bytes read past the end of the request outside the
+// parser, e.g. by a reader wrapping the connection that read ahead
+func (r *Request) AppendBuffered(p []byte) {
+	r.buffered = append(r.buffered, p...)
+}
+
+// Host returns the host the request is for, lowercased and without a
+// trailing dot or the default port of the connection. An absolute-form
+// request target takes precedence over the Host header.
+func (r *Request) Host() string {
+	host := r.Headers.Get("Host")
+	if u, err := url.Parse(r.RequestLine.RequestTarget); err == nil && u.IsAbs() && u.Host != "" {
+		host = u.Host
+	}
+	defaultPort := "80"
+	if r.TLS != nil {
+		defaultPort = "443"
+	}
+	return NormalizeHost(host, defaultPort)
+}
+
+// NormalizeHost lowercases host and removes a trailing dot and defaultPort,
+// so "Example.COM.:80" becomes "example.com"
+func NormalizeHost(host, defaultPort string) string {
+	host = strings.ToLower(host)
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = host, ""
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			name = host[1 : len(host)-1]
+		}
+	}
+	name = strings.TrimSuffix(name, ".")
+	if port == "" || port == defaultPort {
+		if strings.Contains(name, ":") {
+			return "[" + name + "]"
+		}
+		return name
+	}
+	return net.JoinHostPort(name, port)
+}
+
+// validateHost enforces RFC 9112 section 3.2: an HTTP/1.1 request carries
+// exactly one Host header with a valid host and optional port
+func (r *Request) validateHost() error {
+	switch {
+	case r.hostCount == 0:
+		return errors.New("error: missing Host header")
+	case r.hostCount > 1:
+		return errors.New("error: multiple Host headers")
+	case !validHost(r.Headers.Get("Host")):
+		return fmt.Errorf("error: invalid Host header: %q", r.Headers.Get("Host"))
+	}
+	return nil
+}
+
+// validHost accepts the uri-host [ ":" port ] of RFC 3986, or nothing
+func validHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	name, port := host, ""
+	if strings.HasPrefix(host, "[") {
+		end := strings.Index(host, "]")
+		if end < 0 || net.ParseIP(host[1:end]) == nil {
+			return false
+		}
+		name, port = "", host[end+1:]
+		if port != "" && !strings.HasPrefix(port, ":") {
+			return false
+		}
+		port = strings.TrimPrefix(port, ":")
+	} else if i := strings.LastIndex(host, ":"); i >= 0 {
+		name, port = host[:i], host[i+1:]
+		if name == "" {
+			return false
+		}
+	}
+	for _, c := range port {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	if len(port) > 5 {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("-._~!$&'()*+,;=%", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 func (r *Request) parse(data []byte) (int, error) {
 	bytesParsed := 0
 	for r.state != done {
@@ -59,6 +255,10 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		if b == 0 {
 			return 0, nil
 		}
+		err = r.addHeadBytes(b)
+		if err != nil {
+			return 0, err
+		}
 		r.RequestLine = *rl
 		r.state = requestStateParsingHeaders
 		return b, nil
@@ -70,8 +270,22 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		if i == 0 {
 			return 0, nil
 		}
+		err = r.addHeadBytes(i)
+		if err != nil {
+			return 0, err
+		}
 		if d {
+			err = r.validateHost()
+			if err != nil {
+				return 0, err
+			}
 			r.state = requestStateParsingBody
+			return i, nil
+		}
+		// repeated headers are joined by Parse, so Host lines are counted here
+		name, _, _ := bytes.Cut(data[:i], []byte(":"))
+		if strings.EqualFold(strings.TrimSpace(string(name)), "host") {
+			r.hostCount++
 		}
 		return i, nil
 	case requestStateParsingBody:
@@ -84,15 +298,20 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		if err != nil {
 			return 0, fmt.Errorf("error: could not convert content-length to int: %s", err)
 		}
-		r.Body = append(r.Body, data...)
-		if len(r.Body) > aInt {
-			return 0, errors.New("error: request body larger than content-length")
+		if aInt < 0 {
+			return 0, fmt.Errorf("error: negative content-length: %d", aInt)
+		}
+		if r.limits.MaxBodyBytes > 0 && aInt > r.limits.MaxBodyBytes {
+			return 0, ErrBodyTooLarge
 		}
+		// anything past content-length belongs to whatever follows the request
+		n := min(len(data), aInt-len(r.Body))
+		r.Body = append(r.Body, data[:n]...)
 
 		if len(r.Body) == aInt {
 			r.state = done
 		}
-		return len(data), nil
+		return n, nil
 	case done:
 		return 0, errors.New("error: trying to read data in done state")
 	default:
@@ -100,13 +319,54 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	}
 }
 
+// addHeadBytes counts n more bytes of the request line and headers
+// against the limit
+func (r *Request) addHeadBytes(n int) error {
+	r.headBytes += n
+	if r.limits.MaxHeaderBytes > 0 && r.headBytes > r.limits.MaxHeaderBytes {
+		return ErrHeaderTooLarge
+	}
+	return nil
+}
+
+// ParseError is returned by RequestFromReader, Kind is one of
+// "request_line", "headers", "body", "header_too_large", "body_too_large",
+// "incomplete" or "read"
+type ParseError struct {
+	Kind string
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// HeaderObserver can be implemented by the reader passed to RequestFromReader
+// to be notified once the request line and headers have been parsed
+type HeaderObserver interface {
+	HeadersRead()
+}
+
 func RequestFromReader(reader io.Reader) (*Request, error) {
+	return RequestFromReaderLimits(reader, Limits{})
+}
+
+func RequestFromReaderLimits(reader io.Reader, limits Limits) (*Request, error) {
 	r := Request{
 		state:   initialized,
 		Headers: headers.NewHeaders(),
 		Body:    make([]byte, 0),
+		limits:  limits,
+	}
+	size := limits.BufferSize
+	if size <= 0 {
+		size = bufferSize
 	}
-	buf := make([]byte, bufferSize, bufferSize)
+	buf := make([]byte, size, size)
 	readToIndex := 0
 	for r.state != done {
 		if readToIndex >= len(buf) {
@@ -116,25 +376,46 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				if r.state != done {
-					return nil, errors.New(fmt.Sprintf("Error: Incomplete request, in state %v, read %v bytes on EOF\n", r.state, i))
+					return nil, &ParseError{Kind: "incomplete", Err: errors.New(fmt.Sprintf("Error: Incomplete request, in state %v, read %v bytes on EOF\n", r.state, i))}
 				}
 				break
 			}
-			return nil, errors.New(fmt.Sprintf("Error: Could not read from reader: %v\n", err))
+			return nil, &ParseError{Kind: "read", Err: fmt.Errorf("Error: Could not read from reader: %w\n", err)}
 		}
 		readToIndex += i
 
+		prevState := r.state
 		i, err = r.parse(buf[:readToIndex])
 		if err != nil {
+			switch {
+			case errors.Is(err, ErrHeaderTooLarge):
+				return nil, &ParseError{Kind: "header_too_large", Err: err}
+			case errors.Is(err, ErrBodyTooLarge):
+				return nil, &ParseError{Kind: "body_too_large", Err: err}
+			}
 			switch r.state {
 			case initialized:
-				return nil, errors.New(fmt.Sprintf("Error: Could not parse request line: %v\n", err))
+				return nil, &ParseError{Kind: "request_line", Err: errors.New(fmt.Sprintf("Error: Could not parse request line: %v\n", err))}
 			case requestStateParsingHeaders:
-				return nil, errors.New(fmt.Sprintf("Error: Could not parse headers: %v\n", err))
+				return nil, &ParseError{Kind: "headers", Err: errors.New(fmt.Sprintf("Error: Could not parse headers: %v\n", err))}
+			case requestStateParsingBody:
+				return nil, &ParseError{Kind: "body", Err: errors.New(fmt.Sprintf("Error: Could not parse body: %v\n", err))}
+			}
+		}
+		if prevState <= requestStateParsingHeaders && r.state > requestStateParsingHeaders {
+			if o, ok := reader.(HeaderObserver); ok {
+				o.HeadersRead()
 			}
 		}
 		copy(buf, buf[i:])
 		readToIndex -= i
+		// a line without its end yet counts too
+		if r.state <= requestStateParsingHeaders && limits.MaxHeaderBytes > 0 && r.headBytes+readToIndex > limits.MaxHeaderBytes {
+			return nil, &ParseError{Kind: "header_too_large", Err: ErrHeaderTooLarge}
+		}
+	}
+	if readToIndex > 0 {
+		r.buffered = append([]byte{}, buf[:readToIndex]...)
 	}
 	return &r, nil
 }
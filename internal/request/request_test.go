@@ -2,6 +2,7 @@ package request
 
 import (
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
@@ -141,15 +142,24 @@ func TestHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.Error(t, err)
 
-	// Test: Empty Headers
+	// Test: Empty Headers, HTTP/1.1 requires Host
 	reader = &chunkReader{
 		data:            "GET / HTTP/1.1\r\n\r\n",
 		numBytesPerRead: 3,
 	}
 	r, err = RequestFromReader(reader)
+	require.Error(t, err)
+	assert.Nil(t, r)
+
+	// Test: Only a Host Header
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: \r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, r.Headers, headers.NewHeaders())
+	assert.Equal(t, headers.Headers{"host": ""}, r.Headers)
 
 	// Test: Duplicate, case insensitive Headers
 	reader = &chunkReader{
@@ -234,4 +244,121 @@ func TestBodyParse(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, r)
 	assert.Equal(t, len(r.Body), 0)
+
+	// Test: Invalid content length
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: four\r\n" +
+			"\r\n" +
+			"body",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	var parseErr *ParseError
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, "body", parseErr.Kind)
+
+	// Test: Bytes past the end of the request are kept
+	reader = &chunkReader{
+		data: "GET /chat HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 2\r\n" +
+			"\r\n" +
+			"hinext protocol",
+		numBytesPerRead: 1024,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(r.Body))
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "next protocol", string(r.Buffered())+string(rest))
+}
+
+func TestHostHeader(t *testing.T) {
+	parse := func(hostLines string) (*Request, error) {
+		return RequestFromReader(&chunkReader{
+			data:            "GET / HTTP/1.1\r\n" + hostLines + "Accept: */*\r\n\r\n",
+			numBytesPerRead: 3,
+		})
+	}
+
+	// Test: Valid hosts are accepted
+	for _, host := range []string{"localhost", "localhost:42069", "Example.COM", "127.0.0.1:80", "[::1]:8080", "[2001:db8::1]", "xn--bcher-kva.example"} {
+		_, err := parse("Host: " + host + "\r\n")
+		assert.NoError(t, err, host)
+	}
+
+	// Test: Missing, repeated and invalid hosts are rejected
+	cases := map[string]string{
+		"missing":           "",
+		"repeated":          "Host: a.example\r\nHost: b.example\r\n",
+		"repeated empty":    "Host:\r\nhost: b.example\r\n",
+		"with a path":       "Host: example.com/path\r\n",
+		"with userinfo":     "Host: user@example.com\r\n",
+		"bad port":          "Host: example.com:http\r\n",
+		"port only":         "Host: :80\r\n",
+		"unclosed ipv6":     "Host: [::1\r\n",
+		"invalid ipv6":      "Host: [not-ip]\r\n",
+		"unbracketed ipv6":  "Host: ::1\r\n",
+		"with whitespace":   "Host: exa mple.com\r\n",
+		"two comma hosts":   "Host: a.example, b.example\r\n",
+		"port out of range": "Host: example.com:123456\r\n",
+	}
+	for name, lines := range cases {
+		_, err := parse(lines)
+		var parseErr *ParseError
+		require.ErrorAs(t, err, &parseErr, name)
+		assert.Equal(t, "headers", parseErr.Kind, name)
+	}
+
+	// Test: Host is normalized
+	r, err := parse("Host: WWW.Example.com.:80\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "www.example.com", r.Host())
+	r, err = parse("Host: example.com:8080\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "example.com:8080", r.Host())
+	r, err = parse("Host: [::1]:80\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "[::1]", r.Host())
+
+	// Test: An absolute-form target overrides the Host header
+	r, err = RequestFromReader(&chunkReader{
+		data:            "GET http://Other.example:8080/x HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "other.example:8080", r.Host())
+	assert.Equal(t, "example.com:443", NormalizeHost("example.com:443", "80"))
+	assert.Equal(t, "[::1]", NormalizeHost("[::1]", "80"))
+}
+
+func TestLimits(t *testing.T) {
+	head := "POST /submit HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 13\r\n\r\n"
+	data := head + "hello world!\n"
+
+	// Test: Requests within the limits parse, whatever the buffer size
+	for _, size := range []int{1, 8, 4096} {
+		r, err := RequestFromReaderLimits(&chunkReader{data: data, numBytesPerRead: 7},
+			Limits{BufferSize: size, MaxHeaderBytes: len(head), MaxBodyBytes: 13})
+		require.NoError(t, err, size)
+		assert.Equal(t, "hello world!\n", string(r.Body))
+	}
+
+	// Test: Headers beyond the limit are rejected, even before their end
+	var parseErr *ParseError
+	for _, data := range []string{data, "GET /" + strings.Repeat("a", 100)} {
+		_, err := RequestFromReaderLimits(&chunkReader{data: data, numBytesPerRead: 3}, Limits{MaxHeaderBytes: 40})
+		require.ErrorIs(t, err, ErrHeaderTooLarge)
+		require.ErrorAs(t, err, &parseErr)
+		assert.Equal(t, "header_too_large", parseErr.Kind)
+	}
+
+	// Test: Bodies beyond the limit are rejected before they're read
+	_, err := RequestFromReaderLimits(&chunkReader{data: head, numBytesPerRead: 3}, Limits{MaxBodyBytes: 12})
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, "body_too_large", parseErr.Kind)
 }
@@ -0,0 +1,215 @@
+package response
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+)
+
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+type ETag struct {
+	Tag  string
+	Weak bool
+}
+
+func StrongETag(tag string) ETag {
+	return ETag{Tag: tag}
+}
+
+func WeakETag(tag string) ETag {
+	return ETag{Tag: tag, Weak: true}
+}
+
+func (e ETag) IsZero() bool {
+	return e.Tag == ""
+}
+
+func (e ETag) String() string {
+	if e.Weak {
+		return fmt.Sprintf("W/\"%s\"", e.Tag)
+	}
+	return fmt.Sprintf("\"%s\"", e.Tag)
+}
+
+// strong comparison: both must be strong and have identical tags
+func (e ETag) StrongMatch(o ETag) bool {
+	return !e.Weak && !o.Weak && e.Tag == o.Tag
+}
+
+// weak comparison: tags must be identical, weakness is ignored
+func (e ETag) WeakMatch(o ETag) bool {
+	return e.Tag == o.Tag
+}
+
+func ParseETag(s string) (ETag, error) {
+	s = strings.TrimSpace(s)
+	e := ETag{}
+	if strings.HasPrefix(s, "W/") {
+		e.Weak = true
+		s = s[2:]
+	}
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return ETag{}, fmt.Errorf("error: invalid entity-tag: '%s'", s)
+	}
+	e.Tag = s[1 : len(s)-1]
+	if strings.Contains(e.Tag, "\"") {
+		return ETag{}, fmt.Errorf("error: invalid entity-tag: '%s'", s)
+	}
+	return e, nil
+}
+
+// parseETagList parses an If-Match / If-None-Match field value. wildcard is true
+// when the value is "*". Malformed members are skipped.
+func parseETagList(s string) (tags []ETag, wildcard bool) {
+	s = strings.TrimSpace(s)
+	if s == "*" {
+		return nil, true
+	}
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			break
+		}
+		start := 0
+		if strings.HasPrefix(s, "W/") {
+			start = 2
+		}
+		if start >= len(s) || s[start] != '"' {
+			next := strings.IndexByte(s, ',')
+			if next == -1 {
+				break
+			}
+			s = s[next:]
+			continue
+		}
+		end := strings.IndexByte(s[start+1:], '"')
+		if end == -1 {
+			break
+		}
+		end += start + 2
+		if e, err := ParseETag(s[:end]); err == nil {
+			tags = append(tags, e)
+		}
+		s = s[end:]
+	}
+	return tags, false
+}
+
+func ParseHTTPDate(s string) (time.Time, error) {
+	for _, layout := range []string{TimeFormat, time.RFC850, time.ANSIC} {
+		t, err := time.Parse(layout, strings.TrimSpace(s))
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("error: invalid HTTP-date: '%s'", s)
+}
+
+func FormatHTTPDate(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
+
+type Validators struct {
+	ETag         ETag
+	LastModified time.Time
+	// set when the target has no current representation, e.g. a PUT
+	// creating it, so that "If-Match: *" fails and "If-None-Match: *" passes
+	Missing bool
+}
+
+// SetHeaders adds the ETag and Last-Modified fields for any validators that are set
+func (v Validators) SetHeaders(h headers.Headers) {
+	if !v.ETag.IsZero() {
+		h.Override("ETag", v.ETag.String())
+	}
+	if !v.LastModified.IsZero() {
+		h.Override("Last-Modified", FormatHTTPDate(v.LastModified))
+	}
+}
+
+// Evaluate applies the conditional request headers in reqHeaders in the
+// order given by RFC 9110 section 13.2.2. It returns StatusOK when the
+// request should be processed normally, otherwise StatusNotModified or
+// StatusPreconditionFailed.
+func (v Validators) Evaluate(method string, reqHeaders headers.Headers) StatusCode {
+	// HTTP-dates only have second resolution
+	lastModified := v.LastModified.Truncate(time.Second)
+	isGetOrHead := method == "GET" || method == "HEAD"
+
+	if ifMatch := reqHeaders.Get("If-Match"); ifMatch != "" {
+		tags, wildcard := parseETagList(ifMatch)
+		if (wildcard && v.Missing) || (!wildcard && !v.anyStrongMatch(tags)) {
+			return StatusPreconditionFailed
+		}
+	} else if ius := reqHeaders.Get("If-Unmodified-Since"); ius != "" && !v.LastModified.IsZero() {
+		t, err := ParseHTTPDate(ius)
+		if err == nil && lastModified.After(t) {
+			return StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch := reqHeaders.Get("If-None-Match"); ifNoneMatch != "" {
+		tags, wildcard := parseETagList(ifNoneMatch)
+		if (wildcard && !v.Missing) || v.anyWeakMatch(tags) {
+			if isGetOrHead {
+				return StatusNotModified
+			}
+			return StatusPreconditionFailed
+		}
+	} else if ims := reqHeaders.Get("If-Modified-Since"); ims != "" && isGetOrHead && !v.LastModified.IsZero() {
+		t, err := ParseHTTPDate(ims)
+		if err == nil && !lastModified.After(t) {
+			return StatusNotModified
+		}
+	}
+
+	return StatusOK
+}
+
+func (v Validators) anyStrongMatch(tags []ETag) bool {
+	if v.ETag.IsZero() {
+		return false
+	}
+	for _, t := range tags {
+		if v.ETag.StrongMatch(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v Validators) anyWeakMatch(tags []ETag) bool {
+	if v.ETag.IsZero() {
+		return false
+	}
+	for _, t := range tags {
+		if v.ETag.WeakMatch(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// WritePreconditions evaluates the request against v and, if a precondition
+// short-circuits the request, writes the complete 304 or 412 response.
+// When written is true the caller must not write a body.
+func (w *Writer) WritePreconditions(method string, reqHeaders headers.Headers, v Validators) (written bool, err error) {
+	sc := v.Evaluate(method, reqHeaders)
+	if sc == StatusOK {
+		return false, nil
+	}
+	err = w.WriteStatusLine(sc)
+	if err != nil {
+		return true, err
+	}
+	h := GetDefaultHeaders(0)
+	if sc == StatusNotModified {
+		h.Remove("Content-Length")
+		h.Remove("Content-Type")
+		v.SetHeaders(h)
+	}
+	return true, w.WriteHeaders(h)
+}
@@ -0,0 +1,139 @@
+package response
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseETag(t *testing.T) {
+	// Test: Strong ETag
+	e, err := ParseETag("\"abc\"")
+	require.NoError(t, err)
+	assert.Equal(t, StrongETag("abc"), e)
+	assert.Equal(t, "\"abc\"", e.String())
+
+	// Test: Weak ETag
+	e, err = ParseETag("W/\"abc\"")
+	require.NoError(t, err)
+	assert.Equal(t, WeakETag("abc"), e)
+	assert.Equal(t, "W/\"abc\"", e.String())
+
+	// Test: Unquoted ETag
+	_, err = ParseETag("abc")
+	require.Error(t, err)
+
+	// Test: ETag list with weak and strong members
+	tags, wildcard := parseETagList("\"a\", W/\"b\",\"c\"")
+	assert.False(t, wildcard)
+	assert.Equal(t, []ETag{StrongETag("a"), WeakETag("b"), StrongETag("c")}, tags)
+
+	// Test: Wildcard
+	_, wildcard = parseETagList(" * ")
+	assert.True(t, wildcard)
+}
+
+func TestEvaluatePreconditions(t *testing.T) {
+	modified := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	v := Validators{ETag: StrongETag("v1"), LastModified: modified}
+
+	// Test: No conditional headers
+	assert.Equal(t, StatusOK, v.Evaluate("GET", headers.NewHeaders()))
+
+	// Test: If-None-Match matches on GET
+	h := headers.Headers{"if-none-match": "\"v0\", \"v1\""}
+	assert.Equal(t, StatusNotModified, v.Evaluate("GET", h))
+
+	// Test: If-None-Match uses weak comparison
+	h = headers.Headers{"if-none-match": "W/\"v1\""}
+	assert.Equal(t, StatusNotModified, v.Evaluate("HEAD", h))
+
+	// Test: If-None-Match matches on POST
+	h = headers.Headers{"if-none-match": "*"}
+	assert.Equal(t, StatusPreconditionFailed, v.Evaluate("POST", h))
+
+	// Test: If-None-Match takes precedence over If-Modified-Since
+	h = headers.Headers{
+		"if-none-match":     "\"v0\"",
+		"if-modified-since": FormatHTTPDate(modified),
+	}
+	assert.Equal(t, StatusOK, v.Evaluate("GET", h))
+
+	// Test: If-Modified-Since not modified
+	h = headers.Headers{"if-modified-since": FormatHTTPDate(modified)}
+	assert.Equal(t, StatusNotModified, v.Evaluate("GET", h))
+
+	// Test: If-Modified-Since modified
+	h = headers.Headers{"if-modified-since": FormatHTTPDate(modified.Add(-time.Hour))}
+	assert.Equal(t, StatusOK, v.Evaluate("GET", h))
+
+	// Test: If-Modified-Since ignored for POST
+	h = headers.Headers{"if-modified-since": FormatHTTPDate(modified)}
+	assert.Equal(t, StatusOK, v.Evaluate("POST", h))
+
+	// Test: If-Match fails with weak comparison
+	h = headers.Headers{"if-match": "W/\"v1\""}
+	assert.Equal(t, StatusPreconditionFailed, v.Evaluate("PUT", h))
+
+	// Test: If-Match succeeds
+	h = headers.Headers{"if-match": "\"v1\""}
+	assert.Equal(t, StatusOK, v.Evaluate("PUT", h))
+
+	// Test: If-Match takes precedence over If-Unmodified-Since
+	h = headers.Headers{
+		"if-match":            "\"v1\"",
+		"if-unmodified-since": FormatHTTPDate(modified.Add(-time.Hour)),
+	}
+	assert.Equal(t, StatusOK, v.Evaluate("PUT", h))
+
+	// Test: If-Unmodified-Since fails
+	h = headers.Headers{"if-unmodified-since": FormatHTTPDate(modified.Add(-time.Hour))}
+	assert.Equal(t, StatusPreconditionFailed, v.Evaluate("PUT", h))
+
+	// Test: Invalid date is ignored
+	h = headers.Headers{"if-unmodified-since": "yesterday"}
+	assert.Equal(t, StatusOK, v.Evaluate("PUT", h))
+
+	// Test: RFC 850 date
+	h = headers.Headers{"if-modified-since": "Thursday, 02-Jan-25 03:04:05 UTC"}
+	assert.Equal(t, StatusNotModified, v.Evaluate("GET", h))
+
+	// Test: An empty entity-tag never matches a resource without one
+	h = headers.Headers{"if-match": "\"\""}
+	assert.Equal(t, StatusPreconditionFailed, Validators{}.Evaluate("PUT", h))
+
+	// Test: If-Match wildcard needs a current representation
+	h = headers.Headers{"if-match": "*"}
+	assert.Equal(t, StatusOK, Validators{}.Evaluate("PUT", h))
+	assert.Equal(t, StatusPreconditionFailed, Validators{Missing: true}.Evaluate("PUT", h))
+
+	// Test: If-None-Match wildcard passes without a current representation
+	h = headers.Headers{"if-none-match": "*"}
+	assert.Equal(t, StatusOK, Validators{Missing: true}.Evaluate("PUT", h))
+}
+
+func TestWritePreconditions(t *testing.T) {
+	v := Validators{ETag: StrongETag("v1")}
+
+	// Test: 304 response has validators and no body
+	buf := &bytes.Buffer{}
+	w := Writer{W: buf}
+	written, err := w.WritePreconditions("GET", headers.Headers{"if-none-match": "\"v1\""}, v)
+	require.NoError(t, err)
+	assert.True(t, written)
+	assert.Contains(t, buf.String(), "HTTP/1.1 304 Not Modified\r\n")
+	assert.Contains(t, buf.String(), "etag: \"v1\"\r\n")
+	assert.NotContains(t, buf.String(), "content-length")
+
+	// Test: Nothing written when preconditions pass
+	buf = &bytes.Buffer{}
+	w = Writer{W: buf}
+	written, err = w.WritePreconditions("GET", headers.NewHeaders(), v)
+	require.NoError(t, err)
+	assert.False(t, written)
+	assert.Empty(t, buf.String())
+}
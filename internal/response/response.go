@@ -1,8 +1,11 @@
 package response
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"net"
 
 	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
 )
@@ -10,16 +13,92 @@ import (
 type StatusCode int
 
 const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	StatusSwitchingProtocols          StatusCode = 101
+	StatusOK                          StatusCode = 200
+	StatusNoContent                   StatusCode = 204
+	StatusMovedPermanently            StatusCode = 301
+	StatusNotModified                 StatusCode = 304
+	StatusBadRequest                  StatusCode = 400
+	StatusForbidden                   StatusCode = 403
+	StatusNotFound                    StatusCode = 404
+	StatusMethodNotAllowed            StatusCode = 405
+	StatusRequestTimeout              StatusCode = 408
+	StatusPreconditionFailed          StatusCode = 412
+	StatusContentTooLarge             StatusCode = 413
+	StatusMisdirectedRequest          StatusCode = 421
+	StatusUpgradeRequired             StatusCode = 426
+	StatusRequestHeaderFieldsTooLarge StatusCode = 431
+	StatusInternalServerError         StatusCode = 500
+	StatusBadGateway                  StatusCode = 502
+	StatusServiceUnavailable          StatusCode = 503
+	StatusGatewayTimeout              StatusCode = 504
 )
 
+func StatusText(statusCode StatusCode) string {
+	switch statusCode {
+	case StatusSwitchingProtocols:
+		return "Switching Protocols"
+	case StatusOK:
+		return "OK"
+	case StatusNoContent:
+		return "No Content"
+	case StatusMovedPermanently:
+		return "Moved Permanently"
+	case StatusNotModified:
+		return "Not Modified"
+	case StatusBadRequest:
+		return "Bad Request"
+	case StatusForbidden:
+		return "Forbidden"
+	case StatusNotFound:
+		return "Not Found"
+	case StatusMethodNotAllowed:
+		return "Method Not Allowed"
+	case StatusRequestTimeout:
+		return "Request Timeout"
+	case StatusPreconditionFailed:
+		return "Precondition Failed"
+	case StatusContentTooLarge:
+		return "Content Too Large"
+	case StatusMisdirectedRequest:
+		return "Misdirected Request"
+	case StatusUpgradeRequired:
+		return "Upgrade Required"
+	case StatusRequestHeaderFieldsTooLarge:
+		return "Request Header Fields Too Large"
+	case StatusInternalServerError:
+		return "Internal Server Error"
+	case StatusBadGateway:
+		return "Bad Gateway"
+	case StatusServiceUnavailable:
+		return "Service Unavailable"
+	case StatusGatewayTimeout:
+		return "Gateway Timeout"
+	}
+	return ""
+}
+
 type Writer struct {
-	W           io.Writer
-	writerState WriterState
+	W            io.Writer
+	writerState  WriterState
+	statusCode   StatusCode
+	bytesWritten int
+	hijacked     bool
+	defaults     headers.Headers
+	discardBody  bool
+}
+
+// Hijacker is implemented by a Writer's W when the connection can be taken
+// over by the handler
+type Hijacker interface {
+	// Hijack returns the connection and any bytes already read from it. The
+	// caller becomes responsible for closing it.
+	Hijack() (net.Conn, []byte, error)
 }
 
+var ErrHijacked = errors.New("error: connection has been hijacked")
+var ErrNotHijackable = errors.New("error: connection does not support hijacking")
+
 type WriterState int
 
 const (
@@ -29,24 +108,72 @@ const (
 )
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	if w.hijacked {
+		return ErrHijacked
+	}
 	if w.writerState != WriteStatusLineState {
 		return fmt.Errorf("Incorrect writer state: %d - WriteStatusLine should be called first", w.writerState)
 	}
-	statusLine := "HTTP/1.1 " + fmt.Sprintf("%d", statusCode) + " "
-	switch statusCode {
-	case StatusOK:
-		statusLine += "OK"
-	case StatusBadRequest:
-		statusLine += "Bad Request"
-	case StatusInternalServerError:
-		statusLine += "Internal Server Error"
-	}
-	statusLine += "\r\n"
+	statusLine := "HTTP/1.1 " + fmt.Sprintf("%d", statusCode) + " " + StatusText(statusCode) + "\r\n"
 	_, err := w.W.Write([]byte(statusLine))
 	w.writerState = WriteHeadersState
+	w.statusCode = statusCode
 	return err
 }
 
+// Status returns the status code written, or 0 if no status line has been written yet
+func (w *Writer) Status() StatusCode {
+	return w.statusCode
+}
+
+// BytesWritten returns the number of body bytes written, excluding chunk framing
+func (w *Writer) BytesWritten() int {
+	return w.bytesWritten
+}
+
+// Started reports whether anything has been written to the connection
+func (w *Writer) Started() bool {
+	return w.writerState != WriteStatusLineState
+}
+
+// Hijack hands the connection over to the caller. Whatever was written
+// before stays written, the Writer can't be used afterwards.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	h, ok := w.W.(Hijacker)
+	if !ok {
+		return nil, nil, ErrNotHijackable
+	}
+	conn, buffered, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	return conn, buffered, nil
+}
+
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
+
+// SetDefaultHeader adds a field to the ones passed to WriteHeaders, unless
+// they set it themselves. It lets code wrapping a handler add fields, like a
+// router's Allow on a custom 405.
+func (w *Writer) SetDefaultHeader(key, value string) {
+	if w.defaults == nil {
+		w.defaults = headers.NewHeaders()
+	}
+	w.defaults.Override(key, value)
+}
+
+// DiscardBody keeps the body and trailers from being written, e.g. when a
+// GET handler answers a HEAD request. BytesWritten stays 0.
+func (w *Writer) DiscardBody() {
+	w.discardBody = true
+}
+
 func GetDefaultHeaders(contentLen int) headers.Headers {
 	newHeaders := headers.NewHeaders()
 	newHeaders.Set("Content-Length", fmt.Sprintf("%d", contentLen))
@@ -57,15 +184,10 @@ func GetDefaultHeaders(contentLen int) headers.Headers {
 }
 
 func internalWriteHeaders(w *Writer, headers headers.Headers) error {
-	for k, v := range headers {
-		p := []byte{}
-		_, err := w.W.Write(fmt.Appendf(p, "%s: %s\r\n", k, v))
-		if err != nil {
-			return err
-		}
+	if w.hijacked {
+		return ErrHijacked
 	}
-
-	_, err := w.W.Write([]byte("\r\n"))
+	err := headers.Write(w.W)
 	if err != nil {
 		return err
 	}
@@ -77,23 +199,46 @@ func (w *Writer) WriteHeaders(headers headers.Headers) error {
 	if w.writerState != WriteHeadersState {
 		return fmt.Errorf("Incorrect writer state %d - WriteHeaders should be called second", w.writerState)
 	}
+	if len(w.defaults) > 0 {
+		merged := maps.Clone(w.defaults)
+		maps.Copy(merged, headers)
+		headers = merged
+	}
 	return internalWriteHeaders(w, headers)
 }
 
 func (w *Writer) WriteTrailers(headers headers.Headers) error {
 	payload := []byte("0\r\n")
-	_, err := w.WriteBody(payload)
+	_, err := w.writeBody(payload, 0)
 	if err != nil {
 		return fmt.Errorf("error writing Trailer: %v", err)
 	}
+	if w.discardBody {
+		return nil
+	}
 	return internalWriteHeaders(w, headers)
 }
 
 func (w *Writer) WriteBody(p []byte) (int, error) {
+	return w.writeBody(p, len(p))
+}
+
+func (w *Writer) writeBody(p []byte, bodyLen int) (int, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
 	if w.writerState != WriteBodyState {
 		return 0, fmt.Errorf("Incorrect writer state %d - WriteBody should be called last", w.writerState)
 	}
-	return w.W.Write(p)
+	if w.discardBody {
+		return len(p), nil
+	}
+	n, err := w.W.Write(p)
+	if err != nil {
+		return n, err
+	}
+	w.bytesWritten += bodyLen
+	return n, nil
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
@@ -101,7 +246,7 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	payload = fmt.Appendf(payload, "%X\r\n", len(p))
 	payload = append(payload, p...)
 	payload = append(payload, []byte("\r\n")...)
-	return w.WriteBody(payload)
+	return w.writeBody(payload, len(p))
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
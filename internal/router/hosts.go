@@ -0,0 +1,105 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/server"
+)
+
+// Hosts dispatches requests by their normalized Host. Patterns are one of:
+//   - a host name, "example.com", matching it on any port
+//   - a host and port, "example.com:8080", winning over the plain host. The
+//     default port of the connection is never part of the request's host.
+//   - a wildcard, "*.example.com", matching any subdomain at any depth but
+//     not example.com itself. The longest wildcard wins.
+//
+// Requests for no known host go to Default, or get 421 Misdirected Request.
+type Hosts struct {
+	exact     map[string]server.Handler
+	wildcards []hostWildcard
+	Default   server.Handler
+}
+
+type hostWildcard struct {
+	// ".example.com" or ".example.com:8080"
+	suffix  string
+	port    string
+	handler server.Handler
+}
+
+func NewHosts() *Hosts {
+	return &Hosts{exact: map[string]server.Handler{}}
+}
+
+func (hs *Hosts) Handle(pattern string, h server.Handler) {
+	pattern = request.NormalizeHost(pattern, "")
+	name, port, err := net.SplitHostPort(pattern)
+	if err != nil {
+		name, port = pattern, ""
+	}
+	if name == "" {
+		panic(fmt.Sprintf("router: empty host pattern: '%s'", pattern))
+	}
+	if strings.Contains(name, "*") {
+		suffix, ok := strings.CutPrefix(name, "*")
+		if !ok || !strings.HasPrefix(suffix, ".") || strings.Contains(suffix, "*") {
+			panic(fmt.Sprintf("router: wildcard must be a leading '*.': '%s'", pattern))
+		}
+		for _, w := range hs.wildcards {
+			if w.suffix == suffix && w.port == port {
+				panic(fmt.Sprintf("router: duplicate host '%s'", pattern))
+			}
+		}
+		hs.wildcards = append(hs.wildcards, hostWildcard{suffix: suffix, port: port, handler: h})
+		// longest suffix first, then those with a port
+		sort.SliceStable(hs.wildcards, func(i, j int) bool {
+			if len(hs.wildcards[i].suffix) != len(hs.wildcards[j].suffix) {
+				return len(hs.wildcards[i].suffix) > len(hs.wildcards[j].suffix)
+			}
+			return hs.wildcards[i].port != "" && hs.wildcards[j].port == ""
+		})
+		return
+	}
+	if _, ok := hs.exact[pattern]; ok {
+		panic(fmt.Sprintf("router: duplicate host '%s'", pattern))
+	}
+	hs.exact[pattern] = h
+}
+
+// lookup finds the handler for a normalized host, nil if none matches
+func (hs *Hosts) lookup(host string) server.Handler {
+	name, port := host, ""
+	if _, p, err := net.SplitHostPort(host); err == nil {
+		// keeps the brackets of an IPv6 address
+		name, port = host[:len(host)-len(p)-1], p
+	}
+	if h, ok := hs.exact[host]; ok {
+		return h
+	}
+	if h, ok := hs.exact[name]; ok && port != "" {
+		return h
+	}
+	for _, w := range hs.wildcards {
+		if (w.port == "" || w.port == port) && strings.HasSuffix(name, w.suffix) && len(name) > len(w.suffix) {
+			return w.handler
+		}
+	}
+	return nil
+}
+
+func (hs *Hosts) ServeRequest(w *response.Writer, req *request.Request) {
+	h := hs.lookup(req.Host())
+	if h == nil {
+		h = hs.Default
+	}
+	if h == nil {
+		writeEmpty(w, response.StatusMisdirectedRequest, "")
+		return
+	}
+	h(w, req)
+}
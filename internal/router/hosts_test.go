@@ -0,0 +1,58 @@
+package router
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/stretchr/testify/assert"
+)
+
+func serveHost(hs *Hosts, host string) string {
+	req := newRequest("GET", "/")
+	req.Headers.Set("Host", host)
+	buf := &bytes.Buffer{}
+	hs.ServeRequest(&response.Writer{W: buf}, req)
+	return buf.String()
+}
+
+func TestHosts(t *testing.T) {
+	hs := NewHosts()
+	hs.Handle("example.com", named("apex"))
+	hs.Handle("Example.com:8080", named("apex 8080"))
+	hs.Handle("*.example.com", named("sub"))
+	hs.Handle("*.api.example.com", named("api"))
+	hs.Handle("*.example.com:9000", named("sub 9000"))
+	hs.Handle("[::1]", named("ipv6"))
+
+	// Test: Exact hosts match on any port, after normalization
+	assert.Equal(t, "apex", serveHost(hs, "example.com"))
+	assert.Equal(t, "apex", serveHost(hs, "EXAMPLE.com.:80"))
+	assert.Equal(t, "apex", serveHost(hs, "example.com:1234"))
+	assert.Equal(t, "ipv6", serveHost(hs, "[::1]:42069"))
+
+	// Test: A host with a port wins over the plain host
+	assert.Equal(t, "apex 8080", serveHost(hs, "example.com:8080"))
+
+	// Test: Wildcards match subdomains, longest first
+	assert.Equal(t, "sub", serveHost(hs, "www.example.com"))
+	assert.Equal(t, "sub", serveHost(hs, "a.b.example.com"))
+	assert.Equal(t, "api", serveHost(hs, "v1.api.example.com"))
+	assert.Equal(t, "sub 9000", serveHost(hs, "www.example.com:9000"))
+	assert.Equal(t, "sub", serveHost(hs, "www.example.com:9001"))
+
+	// Test: Unknown hosts are misdirected without a default
+	assert.Contains(t, serveHost(hs, "other.org"), "421 Misdirected Request")
+	assert.Contains(t, serveHost(hs, "notexample.com"), "421 Misdirected Request")
+
+	// Test: Unknown hosts go to the default
+	hs.Default = named("default")
+	assert.Equal(t, "default", serveHost(hs, "other.org"))
+
+	// Test: Invalid and duplicate patterns panic
+	assert.Panics(t, func() { hs.Handle("example.com", named("again")) })
+	assert.Panics(t, func() { hs.Handle("*.example.com", named("again")) })
+	assert.Panics(t, func() { hs.Handle("www.*.com", named("middle")) })
+	assert.Panics(t, func() { hs.Handle("*example.com", named("no dot")) })
+	assert.Panics(t, func() { hs.Handle("", named("empty")) })
+}
@@ -0,0 +1,355 @@
+package router
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/server"
+)
+
+// Router dispatches requests by method and path pattern. Patterns are made
+// of "/" separated segments, each one of:
+//   - a static segment, matched exactly
+//   - {name}, matching any single segment, available as req.PathValue("name")
+//   - {name...} or *, only as the last segment, matching the rest of the path
+//
+// Static segments win over parameters, which win over wildcards.
+type Router struct {
+	root             *node
+	middlewares      []server.Middleware
+	NotFound         server.Handler
+	MethodNotAllowed server.Handler
+}
+
+type node struct {
+	pattern      string
+	static       map[string]*node
+	param        *node
+	paramName    string
+	wildcard     *node
+	wildcardName string
+	handlers     map[string]server.Handler
+}
+
+func New() *Router {
+	return &Router{root: &node{}}
+}
+
+// Use adds middleware that runs for every request, including 404, 405 and
+// automatic OPTIONS responses
+func (r *Router) Use(mws ...server.Middleware) {
+	r.middlewares = append(r.middlewares, mws...)
+}
+
+// Handle registers h for method and pattern, wrapped in the route specific mws
+func (r *Router) Handle(method, pattern string, h server.Handler, mws ...server.Middleware) {
+	h = server.Chain(h, mws...)
+	if !strings.HasPrefix(pattern, "/") {
+		panic(fmt.Sprintf("router: pattern must begin with '/': '%s'", pattern))
+	}
+	segments := strings.Split(pattern[1:], "/")
+	n := r.root
+	for i, seg := range segments {
+		name, isParam, isWildcard := parseSegment(seg)
+		switch {
+		case isWildcard:
+			if i != len(segments)-1 {
+				panic(fmt.Sprintf("router: wildcard must be the last segment: '%s'", pattern))
+			}
+			if n.wildcard == nil {
+				n.wildcard = &node{}
+				n.wildcardName = name
+			} else if n.wildcardName != name {
+				panic(fmt.Sprintf("router: conflicting wildcard names '%s' and '%s': '%s'", n.wildcardName, name, pattern))
+			}
+			n = n.wildcard
+		case isParam:
+			if n.param == nil {
+				n.param = &node{}
+				n.paramName = name
+			} else if n.paramName != name {
+				panic(fmt.Sprintf("router: conflicting parameter names '%s' and '%s': '%s'", n.paramName, name, pattern))
+			}
+			n = n.param
+		default:
+			if n.static == nil {
+				n.static = map[string]*node{}
+			}
+			child, ok := n.static[seg]
+			if !ok {
+				child = &node{}
+				n.static[seg] = child
+			}
+			n = child
+		}
+	}
+	if n.handlers == nil {
+		n.handlers = map[string]server.Handler{}
+	}
+	n.pattern = pattern
+	if _, ok := n.handlers[method]; ok {
+		panic(fmt.Sprintf("router: duplicate route %s %s", method, pattern))
+	}
+	n.handlers[method] = h
+}
+
+func (r *Router) Get(pattern string, h server.Handler, mws ...server.Middleware) {
+	r.Handle("GET", pattern, h, mws...)
+}
+
+func (r *Router) Post(pattern string, h server.Handler, mws ...server.Middleware) {
+	r.Handle("POST", pattern, h, mws...)
+}
+
+func (r *Router) Put(pattern string, h server.Handler, mws ...server.Middleware) {
+	r.Handle("PUT", pattern, h, mws...)
+}
+
+func (r *Router) Delete(pattern string, h server.Handler, mws ...server.Middleware) {
+	r.Handle("DELETE", pattern, h, mws...)
+}
+
+func parseSegment(seg string) (name string, isParam, isWildcard bool) {
+	if seg == "*" {
+		return "*", false, true
+	}
+	if !strings.HasPrefix(seg, "{") || !strings.HasSuffix(seg, "}") {
+		return "", false, false
+	}
+	name = seg[1 : len(seg)-1]
+	if strings.HasSuffix(name, "...") {
+		return strings.TrimSuffix(name, "..."), false, true
+	}
+	return name, true, false
+}
+
+type match struct {
+	n      *node
+	values map[string]string
+}
+
+// lookup walks the tree in priority order, returning every node whose
+// pattern matches the full path
+func (n *node) lookup(segments []string, values map[string]string, matches []match) []match {
+	if len(segments) == 0 {
+		if n.handlers != nil {
+			matches = append(matches, match{n: n, values: copyValues(values)})
+		}
+		return matches
+	}
+	seg, rest := segments[0], segments[1:]
+	if child, ok := n.static[seg]; ok {
+		matches = child.lookup(rest, values, matches)
+	}
+	if n.param != nil && seg != "" {
+		values[n.paramName] = seg
+		matches = n.param.lookup(rest, values, matches)
+		delete(values, n.paramName)
+	}
+	if n.wildcard != nil && n.wildcard.handlers != nil {
+		values[n.wildcardName] = strings.Join(segments, "/")
+		matches = append(matches, match{n: n.wildcard, values: copyValues(values)})
+		delete(values, n.wildcardName)
+	}
+	return matches
+}
+
+func copyValues(values map[string]string) map[string]string {
+	c := make(map[string]string, len(values))
+	for k, v := range values {
+		c[k] = v
+	}
+	return c
+}
+
+func (r *Router) ServeRequest(w *response.Writer, req *request.Request) {
+	server.Chain(r.dispatch, r.middlewares...)(w, req)
+}
+
+func (r *Router) dispatch(w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method == "OPTIONS" && req.RequestLine.RequestTarget == "*" {
+		// asks about the server as a whole, RFC 9110 section 9.3.7
+		seen := map[string]bool{}
+		r.root.methods(seen)
+		writeEmpty(w, response.StatusNoContent, joinMethods(seen))
+		return
+	}
+	path := req.Path()
+	if !strings.HasPrefix(path, "/") {
+		r.notFound(w, req)
+		return
+	}
+	segments := strings.Split(path[1:], "/")
+	for i, seg := range segments {
+		unescaped, err := url.PathUnescape(seg)
+		if err == nil {
+			segments[i] = unescaped
+		}
+	}
+	matches := r.root.lookup(segments, map[string]string{}, nil)
+	if len(matches) == 0 {
+		r.notFound(w, req)
+		return
+	}
+
+	method := req.RequestLine.Method
+	for _, m := range matches {
+		h, ok := m.n.handlers[method]
+		if !ok && method == "HEAD" {
+			// HEAD is supported wherever GET is, RFC 9110 section 9.1
+			h, ok = m.n.handlers["GET"]
+			if ok {
+				w.DiscardBody()
+			}
+		}
+		if !ok {
+			continue
+		}
+		for k, v := range m.values {
+			req.SetPathValue(k, v)
+		}
+		req.SetPattern(m.n.pattern)
+		h(w, req)
+		return
+	}
+
+	allow := allowedMethods(matches)
+	if method == "OPTIONS" {
+		writeEmpty(w, response.StatusNoContent, allow)
+		return
+	}
+	if r.MethodNotAllowed != nil {
+		w.SetDefaultHeader("Allow", allow)
+		r.MethodNotAllowed(w, req)
+		return
+	}
+	writeEmpty(w, response.StatusMethodNotAllowed, allow)
+}
+
+func (r *Router) notFound(w *response.Writer, req *request.Request) {
+	if r.NotFound != nil {
+		r.NotFound(w, req)
+		return
+	}
+	writeEmpty(w, response.StatusNotFound, "")
+}
+
+// methods adds the methods registered on n and every node below it to seen
+func (n *node) methods(seen map[string]bool) {
+	for method := range n.handlers {
+		seen[method] = true
+	}
+	for _, child := range n.static {
+		child.methods(seen)
+	}
+	if n.param != nil {
+		n.param.methods(seen)
+	}
+	if n.wildcard != nil {
+		n.wildcard.methods(seen)
+	}
+}
+
+func allowedMethods(matches []match) string {
+	seen := map[string]bool{}
+	for _, m := range matches {
+		for method := range m.n.handlers {
+			seen[method] = true
+		}
+	}
+	return joinMethods(seen)
+}
+
+// joinMethods lists seen together with the methods the router answers
+// itself, OPTIONS and HEAD wherever there is GET
+func joinMethods(seen map[string]bool) string {
+	seen["OPTIONS"] = true
+	if seen["GET"] {
+		seen["HEAD"] = true
+	}
+	methods := make([]string, 0, len(seen))
+	for method := range seen {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+func writeEmpty(w *response.Writer, sc response.StatusCode, allow string) {
+	body := []byte{}
+	if sc != response.StatusNoContent {
+		body = []byte(fmt.Sprintf("%d %s\n", sc, response.StatusText(sc)))
+	}
+	err := w.WriteStatusLine(sc)
+	if err != nil {
+		log.Printf("Error writing status line: %v", err)
+		return
+	}
+	h := response.GetDefaultHeaders(len(body))
+	if sc == response.StatusNoContent {
+		h.Remove("Content-Length")
+		h.Remove("Content-Type")
+	}
+	if allow != "" {
+		h.Set("Allow", allow)
+	}
+	err = w.WriteHeaders(h)
+	if err != nil {
+		log.Printf("Error writing headers: %v", err)
+		return
+	}
+	_, err = w.WriteBody(body)
+	if err != nil {
+		log.Printf("Error writing body: %v", err)
+	}
+}
+
+type Group struct {
+	router      *Router
+	prefix      string
+	middlewares []server.Middleware
+}
+
+func (r *Router) Group(prefix string, mws ...server.Middleware) *Group {
+	return &Group{router: r, prefix: strings.TrimSuffix(prefix, "/"), middlewares: mws}
+}
+
+// Group creates a sub group, inheriting the prefix and middleware of g
+func (g *Group) Group(prefix string, mws ...server.Middleware) *Group {
+	return &Group{
+		router:      g.router,
+		prefix:      g.prefix + strings.TrimSuffix(prefix, "/"),
+		middlewares: append(append([]server.Middleware{}, g.middlewares...), mws...),
+	}
+}
+
+// Use adds middleware to routes registered on g after the call
+func (g *Group) Use(mws ...server.Middleware) {
+	g.middlewares = append(g.middlewares, mws...)
+}
+
+func (g *Group) Handle(method, pattern string, h server.Handler, mws ...server.Middleware) {
+	all := append(append([]server.Middleware{}, g.middlewares...), mws...)
+	g.router.Handle(method, g.prefix+pattern, h, all...)
+}
+
+func (g *Group) Get(pattern string, h server.Handler, mws ...server.Middleware) {
+	g.Handle("GET", pattern, h, mws...)
+}
+
+func (g *Group) Post(pattern string, h server.Handler, mws ...server.Middleware) {
+	g.Handle("POST", pattern, h, mws...)
+}
+
+func (g *Group) Put(pattern string, h server.Handler, mws ...server.Middleware) {
+	g.Handle("PUT", pattern, h, mws...)
+}
+
+func (g *Group) Delete(pattern string, h server.Handler, mws ...server.Middleware) {
+	g.Handle("DELETE", pattern, h, mws...)
+}
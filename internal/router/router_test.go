@@ -0,0 +1,188 @@
+package router
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRequest(method, target string) *request.Request {
+	return &request.Request{
+		RequestLine: request.RequestLine{HttpVersion: "1.1", RequestTarget: target, Method: method},
+		Headers:     headers.NewHeaders(),
+	}
+}
+
+func serve(r *Router, method, target string) string {
+	buf := &bytes.Buffer{}
+	r.ServeRequest(&response.Writer{W: buf}, newRequest(method, target))
+	return buf.String()
+}
+
+func named(name string) func(w *response.Writer, req *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		w.W.Write([]byte(name))
+	}
+}
+
+func TestRouterMatch(t *testing.T) {
+	r := New()
+	r.Get("/", named("root"))
+	r.Get("/users/new", named("new"))
+	r.Get("/users/{id}", func(w *response.Writer, req *request.Request) {
+		w.W.Write([]byte("user " + req.PathValue("id")))
+	})
+	r.Delete("/users/{id}", named("delete"))
+	r.Get("/files/{path...}", func(w *response.Writer, req *request.Request) {
+		w.W.Write([]byte("file " + req.PathValue("path")))
+	})
+	r.Get("/static/*", func(w *response.Writer, req *request.Request) {
+		w.W.Write([]byte("static " + req.PathValue("*")))
+	})
+
+	// Test: Root
+	assert.Equal(t, "root", serve(r, "GET", "/"))
+
+	// Test: Static wins over parameter
+	assert.Equal(t, "new", serve(r, "GET", "/users/new"))
+
+	// Test: Named parameter, query string ignored
+	assert.Equal(t, "user 42", serve(r, "GET", "/users/42?x=y"))
+
+	// Test: Escaped parameter
+	assert.Equal(t, "user a b", serve(r, "GET", "/users/a%20b"))
+
+	// Test: Falls back to parameter route when static route lacks method
+	assert.Equal(t, "delete", serve(r, "DELETE", "/users/new"))
+
+	// Test: Named wildcard
+	assert.Equal(t, "file a/b/c.txt", serve(r, "GET", "/files/a/b/c.txt"))
+
+	// Test: Anonymous wildcard
+	assert.Equal(t, "static css/site.css", serve(r, "GET", "/static/css/site.css"))
+
+	// Test: Empty parameter does not match
+	assert.Contains(t, serve(r, "GET", "/users/"), "HTTP/1.1 404 Not Found\r\n")
+}
+
+func TestRouterErrors(t *testing.T) {
+	r := New()
+	r.Get("/users/{id}", named("get"))
+	r.Put("/users/{id}", named("put"))
+
+	// Test: 404
+	assert.Contains(t, serve(r, "GET", "/nope"), "HTTP/1.1 404 Not Found\r\n")
+
+	// Test: 405 with Allow
+	resp := serve(r, "POST", "/users/1")
+	assert.Contains(t, resp, "HTTP/1.1 405 Method Not Allowed\r\n")
+	assert.Contains(t, resp, "allow: GET, HEAD, OPTIONS, PUT\r\n")
+
+	// Test: Automatic OPTIONS
+	resp = serve(r, "OPTIONS", "/users/1")
+	assert.Contains(t, resp, "HTTP/1.1 204 No Content\r\n")
+	assert.Contains(t, resp, "allow: GET, HEAD, OPTIONS, PUT\r\n")
+
+	// Test: OPTIONS * lists the methods of every route
+	r.Post("/forms/{id...}", named("post"))
+	resp = serve(r, "OPTIONS", "*")
+	assert.Contains(t, resp, "HTTP/1.1 204 No Content\r\n")
+	assert.Contains(t, resp, "allow: GET, HEAD, OPTIONS, POST, PUT\r\n")
+
+	// Test: Custom NotFound
+	r.NotFound = named("custom")
+	assert.Equal(t, "custom", serve(r, "GET", "/nope"))
+
+	// Test: Custom MethodNotAllowed still gets Allow
+	r.MethodNotAllowed = func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusMethodNotAllowed)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}
+	resp = serve(r, "POST", "/users/1")
+	assert.Contains(t, resp, "HTTP/1.1 405 Method Not Allowed\r\n")
+	assert.Contains(t, resp, "allow: GET, HEAD, OPTIONS, PUT\r\n")
+
+	// Test: HEAD is answered by the GET route, without the body
+	r.Get("/page", func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len("page body")))
+		w.WriteBody([]byte("page body"))
+	})
+	resp = serve(r, "HEAD", "/page")
+	assert.Contains(t, resp, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, resp, "content-length: 9\r\n")
+	assert.NotContains(t, resp, "page body")
+	r.Handle("HEAD", "/page", named("explicit head"))
+	assert.Equal(t, "explicit head", serve(r, "HEAD", "/page"))
+
+	// Test: Conflicting parameter names
+	assert.Panics(t, func() { r.Get("/users/{name}/posts", named("x")) })
+
+	// Test: Wildcard not last
+	assert.Panics(t, func() { r.Get("/a/{rest...}/b", named("x")) })
+
+	// Test: Duplicate route
+	assert.Panics(t, func() { r.Get("/users/{id}", named("x")) })
+}
+
+func TestRouterGroup(t *testing.T) {
+	r := New()
+	api := r.Group("/api/")
+	v1 := api.Group("/v1")
+	v1.Get("/ping", named("pong"))
+	api.Post("/items/{id}", named("item"))
+
+	// Test: Nested group
+	assert.Equal(t, "pong", serve(r, "GET", "/api/v1/ping"))
+
+	// Test: Group route
+	assert.Equal(t, "item", serve(r, "POST", "/api/items/3"))
+}
+
+func TestRouterMiddleware(t *testing.T) {
+	trace := []string{}
+	tag := func(name string) server.Middleware {
+		return func(next server.Handler) server.Handler {
+			return func(w *response.Writer, req *request.Request) {
+				trace = append(trace, name)
+				next(w, req)
+			}
+		}
+	}
+	var status response.StatusCode
+	var written int
+	observe := func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			next(w, req)
+			status = w.Status()
+			written = w.BytesWritten()
+		}
+	}
+
+	r := New()
+	r.Use(observe, tag("global"))
+	admin := r.Group("/admin", tag("group"))
+	admin.Get("/stats", func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(5))
+		w.WriteBody([]byte("stats"))
+	}, tag("route"))
+
+	// Test: Global, group and route middleware run outermost first
+	serve(r, "GET", "/admin/stats")
+	assert.Equal(t, []string{"global", "group", "route"}, trace)
+	assert.Equal(t, response.StatusOK, status)
+	assert.Equal(t, 5, written)
+
+	// Test: Global middleware observes automatic 404
+	trace = []string{}
+	serve(r, "GET", "/missing")
+	assert.Equal(t, []string{"global"}, trace)
+	assert.Equal(t, response.StatusNotFound, status)
+	assert.Equal(t, len("404 Not Found\n"), written)
+}
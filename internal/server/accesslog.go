@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+)
+
+// AccessEntry describes one request/response exchange. Request fields are
+// empty when the request could not be parsed.
+type AccessEntry struct {
+	Time       time.Time
+	RemoteAddr string
+	Method     string
+	Target     string
+	Version    string
+	Status     response.StatusCode
+	Bytes      int
+	Duration   time.Duration
+	Referer    string
+	UserAgent  string
+}
+
+type AccessLogger interface {
+	Log(e AccessEntry)
+}
+
+func newAccessEntry(start time.Time, remoteAddr string, req *request.Request, w *response.Writer) AccessEntry {
+	e := AccessEntry{
+		Time:       start,
+		RemoteAddr: remoteIPFromAddr(remoteAddr),
+		Status:     w.Status(),
+		Bytes:      w.BytesWritten(),
+		Duration:   time.Since(start),
+	}
+	if req != nil {
+		e.Method = req.RequestLine.Method
+		e.Target = req.RequestLine.RequestTarget
+		e.Version = req.RequestLine.HttpVersion
+		e.Referer = req.Headers.Get("Referer")
+		e.UserAgent = req.Headers.Get("User-Agent")
+	}
+	return e
+}
+
+type combinedLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewCombinedLogger writes entries in the Apache Combined Log Format
+func NewCombinedLogger(w io.Writer) AccessLogger {
+	return &combinedLogger{w: w}
+}
+
+func (l *combinedLogger) Log(e AccessEntry) {
+	requestLine := "-"
+	if e.Method != "" {
+		requestLine = fmt.Sprintf("%s %s HTTP/%s", e.Method, e.Target, e.Version)
+	}
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = fmt.Sprintf("%d", e.Bytes)
+	}
+	line := fmt.Sprintf("%s - - [%s] \"%s\" %d %s \"%s\" \"%s\"\n",
+		orDash(e.RemoteAddr),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		escapeQuotes(requestLine),
+		e.Status,
+		bytes,
+		escapeQuotes(orDash(e.Referer)),
+		escapeQuotes(orDash(e.UserAgent)),
+	)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write([]byte(line))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func escapeQuotes(s string) string {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			out = append(out, '\\', c)
+		case c < 0x20 || c == 0x7f:
+			out = fmt.Appendf(out, "\\x%02x", c)
+		default:
+			out = append(out, c)
+		}
+	}
+	return string(out)
+}
+
+type jsonLogger struct {
+	logger *slog.Logger
+}
+
+// NewJSONLogger writes one JSON object per entry using log/slog
+func NewJSONLogger(w io.Writer) AccessLogger {
+	return &jsonLogger{logger: slog.New(slog.NewJSONHandler(w, nil))}
+}
+
+func (l *jsonLogger) Log(e AccessEntry) {
+	l.logger.LogAttrs(context.Background(), slog.LevelInfo, "access",
+		slog.Time("start", e.Time),
+		slog.String("remote_addr", e.RemoteAddr),
+		slog.String("method", e.Method),
+		slog.String("target", e.Target),
+		slog.String("version", e.Version),
+		slog.Int("status", int(e.Status)),
+		slog.Int("bytes", e.Bytes),
+		slog.Duration("duration", e.Duration),
+		slog.String("referer", e.Referer),
+		slog.String("user_agent", e.UserAgent),
+	)
+}
+
+// LogFile is an append-only file that can be reopened, so it keeps working
+// after logrotate moves it away
+type LogFile struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+func OpenLogFile(path string) (*LogFile, error) {
+	l := &LogFile{path: path}
+	err := l.Reopen()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(p)
+}
+
+func (l *LogFile) Reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("error: could not open log file '%s': %w", l.path, err)
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// ReopenOnSIGHUP reopens the file every time the process receives SIGHUP.
+// Call the returned func to stop.
+func (l *LogFile) ReopenOnSIGHUP() (stop func()) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-sigChan:
+				err := l.Reopen()
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(sigChan)
+			close(done)
+		})
+	}
+}
+
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	e := AccessEntry{
+		Time:       time.Date(2025, 10, 9, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		RemoteAddr: "127.0.0.1",
+		Method:     "GET",
+		Target:     "/apache_pb.gif",
+		Version:    "1.1",
+		Status:     200,
+		Bytes:      2326,
+		Duration:   1500 * time.Microsecond,
+		Referer:    "http://www.example.com/start.html",
+		UserAgent:  "Mozilla/4.08 \"quoted\"",
+	}
+
+	// Test: Combined Log Format
+	buf := &bytes.Buffer{}
+	NewCombinedLogger(buf).Log(e)
+	assert.Equal(t, `127.0.0.1 - - [09/Oct/2025:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 \"quoted\""`+"\n", buf.String())
+
+	// Test: Combined Log Format for an unparsed request
+	buf = &bytes.Buffer{}
+	NewCombinedLogger(buf).Log(AccessEntry{Time: e.Time, RemoteAddr: "10.0.0.1", Status: 400})
+	assert.Equal(t, `10.0.0.1 - - [09/Oct/2025:13:55:36 -0700] "-" 400 - "-" "-"`+"\n", buf.String())
+
+	// Test: JSON
+	buf = &bytes.Buffer{}
+	NewJSONLogger(buf).Log(e)
+	fields := map[string]any{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &fields))
+	assert.Equal(t, "access", fields["msg"])
+	assert.Equal(t, "GET", fields["method"])
+	assert.Equal(t, float64(200), fields["status"])
+	assert.Equal(t, float64(2326), fields["bytes"])
+	assert.Equal(t, float64(1500000), fields["duration"])
+	assert.Equal(t, "Mozilla/4.08 \"quoted\"", fields["user_agent"])
+}
+
+type entryRecorder struct {
+	entries chan AccessEntry
+}
+
+func (r *entryRecorder) Log(e AccessEntry) {
+	r.entries <- e
+}
+
+func TestAccessLogServer(t *testing.T) {
+	rec := &entryRecorder{entries: make(chan AccessEntry, 1)}
+	s, err := Serve(0, okHandler, WithAccessLog(rec))
+	require.NoError(t, err)
+	defer s.Close()
+
+	c := dial(t, s)
+	_, err = c.Write([]byte("GET /logged HTTP/1.1\r\nHost: localhost\r\nUser-Agent: test\r\nReferer: /from\r\n\r\n"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(c)
+	require.NoError(t, err)
+	c.Close()
+
+	// Test: Entry recorded for a served request
+	e := <-rec.entries
+	assert.Equal(t, "127.0.0.1", e.RemoteAddr)
+	assert.Equal(t, "GET", e.Method)
+	assert.Equal(t, "/logged", e.Target)
+	assert.Equal(t, "1.1", e.Version)
+	assert.EqualValues(t, 200, e.Status)
+	assert.Equal(t, 2, e.Bytes)
+	assert.Equal(t, "test", e.UserAgent)
+	assert.Equal(t, "/from", e.Referer)
+
+	// Test: Entry recorded for a malformed request
+	c = dial(t, s)
+	_, err = c.Write([]byte("nonsense\r\n\r\n"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(c)
+	require.NoError(t, err)
+	c.Close()
+	e = <-rec.entries
+	assert.EqualValues(t, 400, e.Status)
+	assert.Empty(t, e.Method)
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	f, err := OpenLogFile(path)
+	require.NoError(t, err)
+	defer f.Close()
+	stop := f.ReopenOnSIGHUP()
+	defer stop()
+
+	f.Write([]byte("first\n"))
+	require.NoError(t, os.Rename(path, path+".1"))
+	f.Write([]byte("second\n"))
+
+	// Test: SIGHUP reopens the file at its original path
+	f.mu.Lock()
+	old := f.f
+	f.mu.Unlock()
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	assert.Eventually(t, func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.f != old
+	}, time.Second, 10*time.Millisecond)
+	f.Write([]byte("third\n"))
+
+	rotated, err := os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, "first\nsecond\n", string(rotated))
+	current, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "third\n", string(current))
+}
@@ -0,0 +1,423 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/metrics"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"gopkg.in/yaml.v3"
+)
+
+// Config describes a server so it can be deployed from a file and the
+// environment instead of code. Start from DefaultConfig.
+type Config struct {
+	// tcp, tcp4, tcp6, unix, or systemd for the first socket passed in by
+	// socket activation
+	Network string `yaml:"network" json:"network"`
+	Address string `yaml:"address" json:"address"`
+	// permissions of a Unix socket file, 0 leaves the umask default
+	SocketMode  FileMode      `yaml:"socket_mode" json:"socket_mode"`
+	Timeouts    TimeoutConfig `yaml:"timeouts" json:"timeouts"`
+	Limits      LimitConfig   `yaml:"limits" json:"limits"`
+	TLS         CertConfig    `yaml:"tls" json:"tls"`
+	Log         LogConfig     `yaml:"log" json:"log"`
+	ErrorFormat string        `yaml:"error_format" json:"error_format"`
+	// empty disables metrics
+	MetricsPath string `yaml:"metrics_path" json:"metrics_path"`
+
+	Handler Handler `yaml:"-" json:"-"`
+}
+
+// TimeoutConfig holds the server timeouts, 0 means no limit
+type TimeoutConfig struct {
+	ReadHeader Duration `yaml:"read_header" json:"read_header"`
+	Read       Duration `yaml:"read" json:"read"`
+	Write      Duration `yaml:"write" json:"write"`
+	Idle       Duration `yaml:"idle" json:"idle"`
+	Request    Duration `yaml:"request" json:"request"`
+	// not used by the server itself, for whoever calls Shutdown
+	Shutdown Duration `yaml:"shutdown" json:"shutdown"`
+}
+
+// LimitConfig holds the connection and request limits, 0 means unlimited
+type LimitConfig struct {
+	MaxConns      int    `yaml:"max_conns" json:"max_conns"`
+	Mode          string `yaml:"mode" json:"mode"`
+	MaxConnsPerIP int    `yaml:"max_conns_per_ip" json:"max_conns_per_ip"`
+	// initial read buffer of the request parser, 0 for the parser's default
+	ReadBufferSize int `yaml:"read_buffer_size" json:"read_buffer_size"`
+	MaxHeaderBytes int `yaml:"max_header_bytes" json:"max_header_bytes"`
+	MaxBodyBytes   int `yaml:"max_body_bytes" json:"max_body_bytes"`
+}
+
+// CertConfig enables TLS when CertFile is set. Extra pairs are chosen
+// between by SNI.
+type CertConfig struct {
+	CertFile       string     `yaml:"cert_file" json:"cert_file"`
+	KeyFile        string     `yaml:"key_file" json:"key_file"`
+	Extra          []CertFile `yaml:"extra" json:"extra"`
+	ReloadInterval Duration   `yaml:"reload_interval" json:"reload_interval"`
+}
+
+type LogConfig struct {
+	// combined, json or off
+	Access string `yaml:"access" json:"access"`
+	// empty logs to stdout, a file is reopened on SIGHUP
+	Path string `yaml:"path" json:"path"`
+}
+
+// Duration is a time.Duration written as "30s" in config files
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("error: invalid duration '%s'", text)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// FileMode is an os.FileMode written in octal, e.g. "0660"
+type FileMode os.FileMode
+
+func (m FileMode) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%04o", uint32(m))), nil
+}
+
+func (m *FileMode) UnmarshalText(text []byte) error {
+	v, err := strconv.ParseUint(string(text), 8, 32)
+	if err != nil || v > 0o777 {
+		return fmt.Errorf("error: invalid file mode '%s'", text)
+	}
+	*m = FileMode(v)
+	return nil
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Network: "tcp",
+		Address: ":42069",
+		Timeouts: TimeoutConfig{
+			ReadHeader: Duration(5 * time.Second),
+			Read:       Duration(30 * time.Second),
+			Write:      Duration(2 * time.Minute),
+			Idle:       Duration(30 * time.Second),
+			Shutdown:   Duration(10 * time.Second),
+		},
+		Limits: LimitConfig{
+			MaxConns:       1024,
+			Mode:           "reject",
+			MaxConnsPerIP:  64,
+			ReadBufferSize: 4096,
+			MaxHeaderBytes: 1 << 20,
+			MaxBodyBytes:   10 << 20,
+		},
+		Log:         LogConfig{Access: "combined"},
+		ErrorFormat: "html",
+		MetricsPath: "/metrics",
+	}
+}
+
+// LoadConfig reads a YAML or JSON file, chosen by its extension, over
+// DefaultConfig. Unknown keys are an error so typos don't go unnoticed.
+func LoadConfig(path string) (Config, error) {
+	c := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, fmt.Errorf("error: could not read config: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&c)
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&c)
+	default:
+		return c, fmt.Errorf("error: unknown config format '%s'", filepath.Ext(path))
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return c, fmt.Errorf("error: could not parse config '%s': %w", path, err)
+	}
+	return c, nil
+}
+
+// ApplyEnv overrides fields from environment variables named after their
+// config keys, e.g. PREFIX_ADDRESS or PREFIX_TIMEOUTS_READ_HEADER. Lists
+// can only be set in a file.
+func (c *Config) ApplyEnv(prefix string) error {
+	return applyEnv(reflect.ValueOf(c).Elem(), prefix)
+}
+
+var textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := range t.NumField() {
+		key, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(key)
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			err := applyEnv(field, name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		err := setField(field, value)
+		if err != nil {
+			return fmt.Errorf("error: %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Addr().Type().Implements(textUnmarshalerType) {
+		return field.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(value))
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer '%s'", value)
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean '%s'", value)
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("cannot be set from the environment")
+	}
+	return nil
+}
+
+var errorRenderers = map[string]ErrorRenderer{
+	"text": RenderText,
+	"html": RenderHTML,
+	"json": RenderJSON,
+}
+
+var limitModes = map[string]LimitMode{
+	"block":  LimitBlock,
+	"reject": LimitReject,
+}
+
+// Validate reports every invalid field at once
+func (c Config) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("error: "+format, args...))
+	}
+
+	switch c.Network {
+	case "tcp", "tcp4", "tcp6", "unix":
+		if c.Address == "" {
+			invalid("address is required for network '%s'", c.Network)
+		}
+	case "systemd":
+	default:
+		invalid("network must be tcp, tcp4, tcp6, unix or systemd, got '%s'", c.Network)
+	}
+	if c.SocketMode != 0 && c.Network != "unix" {
+		invalid("socket_mode only applies to unix sockets")
+	}
+
+	timeouts := map[string]Duration{
+		"read_header": c.Timeouts.ReadHeader,
+		"read":        c.Timeouts.Read,
+		"write":       c.Timeouts.Write,
+		"idle":        c.Timeouts.Idle,
+		"request":     c.Timeouts.Request,
+		"shutdown":    c.Timeouts.Shutdown,
+	}
+	for _, name := range []string{"read_header", "read", "write", "idle", "request", "shutdown"} {
+		if timeouts[name] < 0 {
+			invalid("timeouts.%s must not be negative", name)
+		}
+	}
+
+	if c.Limits.MaxConns < 0 {
+		invalid("limits.max_conns must not be negative")
+	}
+	if c.Limits.MaxConnsPerIP < 0 {
+		invalid("limits.max_conns_per_ip must not be negative")
+	}
+	limits := map[string]int{
+		"read_buffer_size": c.Limits.ReadBufferSize,
+		"max_header_bytes": c.Limits.MaxHeaderBytes,
+		"max_body_bytes":   c.Limits.MaxBodyBytes,
+	}
+	for _, name := range []string{"read_buffer_size", "max_header_bytes", "max_body_bytes"} {
+		if limits[name] < 0 {
+			invalid("limits.%s must not be negative", name)
+		}
+	}
+	if _, ok := limitModes[c.Limits.Mode]; !ok {
+		invalid("limits.mode must be block or reject, got '%s'", c.Limits.Mode)
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		invalid("tls.cert_file and tls.key_file must be set together")
+	}
+	if c.TLS.CertFile == "" && len(c.TLS.Extra) > 0 {
+		invalid("tls.extra requires tls.cert_file")
+	}
+	for i, f := range c.TLS.Extra {
+		if f.CertFile == "" || f.KeyFile == "" {
+			invalid("tls.extra[%d] needs cert_file and key_file", i)
+		}
+	}
+	if c.TLS.ReloadInterval < 0 {
+		invalid("tls.reload_interval must not be negative")
+	}
+
+	switch c.Log.Access {
+	case "combined", "json":
+	case "off":
+		if c.Log.Path != "" {
+			invalid("log.path is set but log.access is off")
+		}
+	default:
+		invalid("log.access must be combined, json or off, got '%s'", c.Log.Access)
+	}
+
+	if _, ok := errorRenderers[c.ErrorFormat]; !ok {
+		invalid("error_format must be text, html or json, got '%s'", c.ErrorFormat)
+	}
+	if c.MetricsPath != "" && !strings.HasPrefix(c.MetricsPath, "/") {
+		invalid("metrics_path must start with '/'")
+	}
+	return errors.Join(errs...)
+}
+
+// ServeConfig validates c and starts serving c.Handler. opts are applied
+// after the ones derived from c.
+func ServeConfig(c Config, opts ...Option) (*Server, error) {
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if c.Handler == nil {
+		return nil, errors.New("error: config has no handler")
+	}
+
+	var cleanups []func()
+	cleanup := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+
+	l, err := c.listen()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.TLS.CertFile != "" {
+		files := append([]CertFile{{CertFile: c.TLS.CertFile, KeyFile: c.TLS.KeyFile}}, c.TLS.Extra...)
+		reloader, err := NewCertReloader(files...)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		if c.TLS.ReloadInterval > 0 {
+			cleanups = append(cleanups, reloader.Watch(time.Duration(c.TLS.ReloadInterval)))
+		}
+		l = tls.NewListener(l, reloader.TLSConfig())
+	}
+
+	serverOpts := []Option{
+		WithReadHeaderTimeout(time.Duration(c.Timeouts.ReadHeader)),
+		WithReadTimeout(time.Duration(c.Timeouts.Read)),
+		WithWriteTimeout(time.Duration(c.Timeouts.Write)),
+		WithIdleTimeout(time.Duration(c.Timeouts.Idle)),
+		WithRequestTimeout(time.Duration(c.Timeouts.Request)),
+		WithMaxConns(c.Limits.MaxConns, limitModes[c.Limits.Mode]),
+		WithMaxConnsPerIP(c.Limits.MaxConnsPerIP),
+		WithRequestLimits(request.Limits{
+			BufferSize:     c.Limits.ReadBufferSize,
+			MaxHeaderBytes: c.Limits.MaxHeaderBytes,
+			MaxBodyBytes:   c.Limits.MaxBodyBytes,
+		}),
+		WithErrorRenderer(errorRenderers[c.ErrorFormat]),
+	}
+
+	if c.Log.Access != "off" {
+		var out io.Writer = os.Stdout
+		if c.Log.Path != "" {
+			f, err := OpenLogFile(c.Log.Path)
+			if err != nil {
+				cleanup()
+				l.Close()
+				return nil, err
+			}
+			cleanups = append(cleanups, func() { f.Close() }, f.ReopenOnSIGHUP())
+			out = f
+		}
+		logger := NewCombinedLogger(out)
+		if c.Log.Access == "json" {
+			logger = NewJSONLogger(out)
+		}
+		serverOpts = append(serverOpts, WithAccessLog(logger))
+	}
+
+	if c.MetricsPath != "" {
+		serverOpts = append(serverOpts, WithMetrics(metrics.NewRegistry(), c.MetricsPath))
+	}
+
+	serverOpts = append(serverOpts, withCleanup(cleanup))
+	return newServer(l, c.Handler, append(serverOpts, opts...)...), nil
+}
+
+func (c Config) listen() (net.Listener, error) {
+	switch c.Network {
+	case "systemd":
+		listeners, err := InheritedListeners()
+		if err != nil {
+			return nil, err
+		}
+		if len(listeners) == 0 {
+			return nil, errors.New("error: no sockets were passed in by systemd")
+		}
+		for _, l := range listeners[1:] {
+			l.Close()
+		}
+		return listeners[0], nil
+	case "unix":
+		return ListenUnix(c.Address, os.FileMode(c.SocketMode))
+	}
+	return Listen(c.Network, c.Address)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, name, data string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o644))
+	return path
+}
+
+func TestConfig(t *testing.T) {
+	// Test: Defaults are valid
+	require.NoError(t, DefaultConfig().Validate())
+
+	// Test: YAML overrides defaults and keeps the rest
+	c, err := LoadConfig(writeConfig(t, "server.yaml", `
+network: unix
+address: /run/http.sock
+socket_mode: 0660
+timeouts:
+  read_header: 2s
+  request: 1m
+limits:
+  mode: block
+tls:
+  extra:
+    - cert_file: b.pem
+      key_file: b-key.pem
+`))
+	require.NoError(t, err)
+	assert.Equal(t, "unix", c.Network)
+	assert.Equal(t, FileMode(0o660), c.SocketMode)
+	assert.Equal(t, Duration(2*time.Second), c.Timeouts.ReadHeader)
+	assert.Equal(t, Duration(time.Minute), c.Timeouts.Request)
+	assert.Equal(t, Duration(30*time.Second), c.Timeouts.Read)
+	assert.Equal(t, "block", c.Limits.Mode)
+	assert.Equal(t, 1024, c.Limits.MaxConns)
+	assert.Equal(t, []CertFile{{CertFile: "b.pem", KeyFile: "b-key.pem"}}, c.TLS.Extra)
+
+	// Test: JSON
+	c, err = LoadConfig(writeConfig(t, "server.json", `{"address": ":8080", "timeouts": {"idle": "1m30s"}, "error_format": "json"}`))
+	require.NoError(t, err)
+	assert.Equal(t, ":8080", c.Address)
+	assert.Equal(t, Duration(90*time.Second), c.Timeouts.Idle)
+	assert.Equal(t, "json", c.ErrorFormat)
+
+	// Test: Empty file gives the defaults
+	c, err = LoadConfig(writeConfig(t, "empty.yml", ""))
+	require.NoError(t, err)
+	assert.Equal(t, DefaultConfig().Address, c.Address)
+
+	// Test: Unknown keys and bad values are errors
+	_, err = LoadConfig(writeConfig(t, "typo.yaml", "adress: :80\n"))
+	require.Error(t, err)
+	_, err = LoadConfig(writeConfig(t, "typo.json", `{"adress": ":80"}`))
+	require.Error(t, err)
+	_, err = LoadConfig(writeConfig(t, "bad.yaml", "timeouts:\n  read: soon\n"))
+	require.ErrorContains(t, err, "invalid duration 'soon'")
+	_, err = LoadConfig(writeConfig(t, "server.toml", ""))
+	require.ErrorContains(t, err, "unknown config format")
+
+	// Test: Environment overrides the file
+	t.Setenv("TEST_ADDRESS", ":9090")
+	t.Setenv("TEST_TIMEOUTS_WRITE", "10s")
+	t.Setenv("TEST_LIMITS_MAX_CONNS_PER_IP", "8")
+	c = DefaultConfig()
+	require.NoError(t, c.ApplyEnv("TEST"))
+	assert.Equal(t, ":9090", c.Address)
+	assert.Equal(t, Duration(10*time.Second), c.Timeouts.Write)
+	assert.Equal(t, 8, c.Limits.MaxConnsPerIP)
+
+	t.Setenv("TEST_LIMITS_MAX_CONNS", "lots")
+	require.ErrorContains(t, c.ApplyEnv("TEST"), "TEST_LIMITS_MAX_CONNS")
+
+	// Test: Validate reports every problem
+	c = DefaultConfig()
+	c.Network = "udp"
+	c.Timeouts.Read = Duration(-time.Second)
+	c.Limits.Mode = "drop"
+	c.TLS.CertFile = "a.pem"
+	c.Log.Access = "verbose"
+	c.ErrorFormat = "xml"
+	c.MetricsPath = "metrics"
+	c.Limits.MaxBodyBytes = -1
+	err = c.Validate()
+	for _, msg := range []string{"network", "timeouts.read", "limits.mode", "limits.max_body_bytes", "tls.cert_file", "log.access", "error_format", "metrics_path"} {
+		assert.ErrorContains(t, err, msg)
+	}
+}
+
+func TestServeConfig(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	c := DefaultConfig()
+	c.Address = "127.0.0.1:0"
+	c.Log.Path = logPath
+	c.Log.Access = "json"
+
+	// Test: Handler is required
+	_, err := ServeConfig(c)
+	require.ErrorContains(t, err, "no handler")
+
+	// Test: Server is configured from the config
+	c.Handler = okHandler
+	s, err := ServeConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Second, s.readHeaderTimeout)
+	assert.Equal(t, 1024, s.maxConns)
+	assert.Equal(t, request.Limits{BufferSize: 4096, MaxHeaderBytes: 1 << 20, MaxBodyBytes: 10 << 20}, s.requestLimits)
+	assert.Contains(t, get(t, "tcp", s.Addr().String()), "HTTP/1.1 200 OK\r\n")
+	assert.Equal(t, "/metrics", s.metrics.path)
+	require.NoError(t, s.Close())
+
+	// Test: Access log went to the file
+	data, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"status":200`)
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+)
+
+type connState int32
+
+const (
+	// waiting for the first byte of a request
+	stateIdle connState = iota
+	// reading a request or running its handler
+	stateActive
+)
+
+// TimeoutError is returned from reads and writes on a connection whose deadline passed
+type TimeoutError struct {
+	// one of "idle", "read header", "read" or "write"
+	Op       string
+	Duration time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("error: %s timeout after %v", e.Op, e.Duration)
+}
+
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return os.ErrDeadlineExceeded
+}
+
+type conn struct {
+	net.Conn
+	state             atomic.Int32
+	headersRead       atomic.Bool
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	requestStart      time.Time
+	metrics           *serverMetrics
+	server            *Server
+	// bytes the request parser read past the end of the request
+	buffered  []byte
+	hijacked  atomic.Bool
+	bgDone    chan struct{}
+	bgAborted atomic.Bool
+	bgMu      sync.Mutex
+	pending   []byte
+}
+
+// how much data a background read buffers before it stops reading
+const maxPendingBytes = 4096
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+func newConn(c net.Conn, s *Server) *conn {
+	return &conn{
+		Conn:              c,
+		readHeaderTimeout: s.readHeaderTimeout,
+		readTimeout:       s.readTimeout,
+		writeTimeout:      s.writeTimeout,
+		idleTimeout:       s.idleTimeout,
+		metrics:           s.metrics,
+		server:            s,
+	}
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.metrics.read(n)
+	if n > 0 && c.state.CompareAndSwap(int32(stateIdle), int32(stateActive)) {
+		c.requestStarted()
+	}
+	if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, c.readTimeoutError()
+	}
+	return n, err
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.metrics.written(n)
+	if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, &TimeoutError{Op: "write", Duration: c.writeTimeout}
+	}
+	return n, err
+}
+
+func (c *conn) readTimeoutError() error {
+	switch {
+	case c.getState() == stateIdle:
+		return &TimeoutError{Op: "idle", Duration: c.idleTimeout}
+	case !c.headersRead.Load() && c.readHeaderTimeout > 0:
+		return &TimeoutError{Op: "read header", Duration: c.readHeaderTimeout}
+	default:
+		return &TimeoutError{Op: "read", Duration: c.readTimeout}
+	}
+}
+
+func (c *conn) waitForRequest() {
+	if c.idleTimeout > 0 {
+		c.SetReadDeadline(time.Now().Add(c.idleTimeout))
+	}
+}
+
+func (c *conn) requestStarted() {
+	c.requestStart = time.Now()
+	timeout := c.readHeaderTimeout
+	if timeout == 0 || (c.readTimeout > 0 && c.readTimeout < timeout) {
+		timeout = c.readTimeout
+	}
+	c.setReadTimeout(timeout)
+}
+
+// HeadersRead is called by request.RequestFromReader
+func (c *conn) HeadersRead() {
+	c.headersRead.Store(true)
+	c.setReadTimeout(c.readTimeout)
+}
+
+func (c *conn) setReadTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		c.SetReadDeadline(c.requestStart.Add(timeout))
+	} else {
+		c.SetReadDeadline(time.Time{})
+	}
+}
+
+func (c *conn) requestRead() {
+	if c.writeTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+}
+
+// startBackgroundRead watches the connection while the handler runs, calling
+// onClose if the client disconnects. Bytes the client sends meanwhile are kept
+// in c.pending, up to maxPendingBytes after which the watch stops.
+func (c *conn) startBackgroundRead(onClose func()) {
+	c.Conn.SetReadDeadline(time.Time{})
+	c.bgAborted.Store(false)
+	c.bgDone = make(chan struct{})
+	go func() {
+		defer close(c.bgDone)
+		buf := make([]byte, 512)
+		for {
+			c.bgMu.Lock()
+			room := maxPendingBytes - len(c.pending)
+			c.bgMu.Unlock()
+			if room <= 0 {
+				return
+			}
+			n, err := c.Conn.Read(buf[:min(room, len(buf))])
+			c.metrics.read(n)
+			if n > 0 {
+				c.bgMu.Lock()
+				c.pending = append(c.pending, buf[:n]...)
+				c.bgMu.Unlock()
+			}
+			if err != nil {
+				if !c.bgAborted.Load() {
+					onClose()
+				}
+				return
+			}
+		}
+	}()
+}
+
+// abortBackgroundRead stops a background read and waits for it to return
+func (c *conn) abortBackgroundRead() {
+	if c.bgDone == nil {
+		return
+	}
+	c.bgAborted.Store(true)
+	c.Conn.SetReadDeadline(aLongTimeAgo)
+	<-c.bgDone
+	c.Conn.SetReadDeadline(time.Time{})
+	c.bgDone = nil
+}
+
+// Hijack stops the server from managing the connection: it is no longer
+// tracked, timed out or closed when the handler returns
+func (c *conn) Hijack() (net.Conn, []byte, error) {
+	if c.hijacked.Swap(true) {
+		return nil, nil, response.ErrHijacked
+	}
+	c.abortBackgroundRead()
+	c.server.untrackConn(c)
+	c.Conn.SetDeadline(time.Time{})
+	c.bgMu.Lock()
+	buffered := append(append([]byte{}, c.buffered...), c.pending...)
+	c.pending = nil
+	c.bgMu.Unlock()
+	return c.Conn, buffered, nil
+}
+
+func (c *conn) getState() connState {
+	return connState(c.state.Load())
+}
+
+func (c *conn) setState(state connState) {
+	c.state.Store(int32(state))
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+)
+
+func (e *HandlerError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = response.StatusText(e.StatusCode)
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%d %s: %v", e.StatusCode, msg, e.Err)
+	}
+	return fmt.Sprintf("%d %s", e.StatusCode, msg)
+}
+
+func (e *HandlerError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorHandler is a Handler that can fail. The returned error is rendered
+// by HandleErrors, so it should return before writing anything when it can.
+type ErrorHandler func(w *response.Writer, req *request.Request) *HandlerError
+
+// ErrorRenderer writes a complete error response for herr
+type ErrorRenderer func(w *response.Writer, req *request.Request, herr *HandlerError) error
+
+// HandleErrors adapts h to a Handler, rendering any error it returns with
+// render (RenderText if nil)
+func HandleErrors(h ErrorHandler, render ErrorRenderer) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		herr := h(w, req)
+		if herr != nil {
+			WriteError(w, req, herr, render)
+		}
+	}
+}
+
+// WriteError renders herr if nothing has been written yet. Otherwise the
+// partial response is abandoned and the connection will be closed without
+// completing it.
+func WriteError(w *response.Writer, req *request.Request, herr *HandlerError, render ErrorRenderer) {
+	target := ""
+	if req != nil {
+		target = req.RequestLine.RequestTarget
+	}
+	if w.Started() {
+		log.Printf("error: %s failed after response started, aborting: %v", target, herr)
+		return
+	}
+	if render == nil {
+		render = RenderText
+	}
+	if herr.StatusCode >= 500 {
+		log.Printf("error: %s: %v", target, herr)
+	}
+	err := render(w, req, herr)
+	if err != nil {
+		log.Printf("error: could not render error response: %v", err)
+	}
+}
+
+func writeErrorPage(w *response.Writer, sc response.StatusCode, contentType string, body []byte) error {
+	err := w.WriteStatusLine(sc)
+	if err != nil {
+		return err
+	}
+	h := response.GetDefaultHeaders(len(body))
+	h.Override("Content-Type", contentType)
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return err
+	}
+	_, err = w.WriteBody(body)
+	return err
+}
+
+func RenderText(w *response.Writer, req *request.Request, herr *HandlerError) error {
+	body := fmt.Sprintf("%d %s\n", herr.StatusCode, response.StatusText(herr.StatusCode))
+	if herr.Message != "" {
+		body += herr.Message + "\n"
+	}
+	return writeErrorPage(w, herr.StatusCode, "text/plain", []byte(body))
+}
+
+func RenderHTML(w *response.Writer, req *request.Request, herr *HandlerError) error {
+	title := fmt.Sprintf("%d %s", herr.StatusCode, response.StatusText(herr.StatusCode))
+	body := []byte("<html>" +
+		"  <head>" +
+		fmt.Sprintf("	<title>%s</title>", html.EscapeString(title)) +
+		"  </head>" +
+		"  <body>" +
+		fmt.Sprintf("	<h1>%s</h1>", html.EscapeString(response.StatusText(herr.StatusCode))) +
+		fmt.Sprintf("	<p>%s</p>", html.EscapeString(herr.Message)) +
+		"  </body>" +
+		"</html>")
+	return writeErrorPage(w, herr.StatusCode, "text/html", body)
+}
+
+func RenderJSON(w *response.Writer, req *request.Request, herr *HandlerError) error {
+	body := &bytes.Buffer{}
+	enc := json.NewEncoder(body)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(struct {
+		Status  int    `json:"status"`
+		Error   string `json:"error"`
+		Message string `json:"message,omitempty"`
+	}{
+		Status:  int(herr.StatusCode),
+		Error:   response.StatusText(herr.StatusCode),
+		Message: herr.Message,
+	})
+	if err != nil {
+		return err
+	}
+	return writeErrorPage(w, herr.StatusCode, "application/json", body.Bytes())
+}
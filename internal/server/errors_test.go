@@ -0,0 +1,53 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleErrors(t *testing.T) {
+	req := &request.Request{RequestLine: request.RequestLine{RequestTarget: "/x"}}
+	notFound := func(w *response.Writer, req *request.Request) *HandlerError {
+		return &HandlerError{StatusCode: response.StatusNotFound, Message: "no <such> thing"}
+	}
+
+	// Test: Plain text is the default renderer
+	buf := &bytes.Buffer{}
+	HandleErrors(notFound, nil)(&response.Writer{W: buf}, req)
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 404 Not Found\r\n"))
+	assert.Contains(t, buf.String(), "content-type: text/plain\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "404 Not Found\nno <such> thing\n"))
+
+	// Test: HTML renderer escapes the message
+	buf = &bytes.Buffer{}
+	HandleErrors(notFound, RenderHTML)(&response.Writer{W: buf}, req)
+	assert.Contains(t, buf.String(), "content-type: text/html\r\n")
+	assert.Contains(t, buf.String(), "<p>no &lt;such&gt; thing</p>")
+
+	// Test: JSON renderer
+	buf = &bytes.Buffer{}
+	HandleErrors(notFound, RenderJSON)(&response.Writer{W: buf}, req)
+	assert.Contains(t, buf.String(), "content-type: application/json\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), `{"status":404,"error":"Not Found","message":"no <such> thing"}`+"\n"))
+
+	// Test: Nothing is rendered once the response has started
+	buf = &bytes.Buffer{}
+	HandleErrors(func(w *response.Writer, req *request.Request) *HandlerError {
+		w.WriteStatusLine(response.StatusOK)
+		return &HandlerError{StatusCode: response.StatusInternalServerError, Err: errors.New("boom")}
+	}, RenderJSON)(&response.Writer{W: buf}, req)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+
+	// Test: No error
+	buf = &bytes.Buffer{}
+	HandleErrors(func(w *response.Writer, req *request.Request) *HandlerError {
+		return nil
+	}, RenderJSON)(&response.Writer{W: buf}, req)
+	assert.Empty(t, buf.String())
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+)
+
+type LimitMode int
+
+const (
+	// stop accepting until a connection slot frees up
+	LimitBlock LimitMode = iota
+	// accept and answer 503 Service Unavailable
+	LimitReject
+)
+
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+	rejectTimeout    = time.Second
+)
+
+type ConnStats struct {
+	Current  int
+	Peak     int
+	Rejected int
+}
+
+func (s *Server) ConnStats() ConnStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ConnStats{
+		Current:  len(s.conns),
+		Peak:     s.peakConns,
+		Rejected: s.rejectedConns,
+	}
+}
+
+// acquireSlot blocks while the server is at its connection limit in
+// LimitBlock mode. It returns false once the server is closed.
+func (s *Server) acquireSlot() bool {
+	if s.slots == nil {
+		return !s.closed.Load()
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func (s *Server) releaseSlot() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// trackConn registers c, returning a non-empty reason if it exceeds a limit
+// and must be rejected instead of served
+func (s *Server) trackConn(c *conn) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxConns > 0 && s.limitMode == LimitReject && len(s.conns) >= s.maxConns {
+		s.rejectedConns++
+		return fmt.Sprintf("connection limit of %d reached", s.maxConns)
+	}
+	ip := remoteIP(c)
+	// Unix socket peers have no address to tell them apart
+	if s.maxConnsPerIP > 0 && ip != "" && s.connsPerIP[ip] >= s.maxConnsPerIP {
+		s.rejectedConns++
+		return fmt.Sprintf("connection limit of %d per client reached", s.maxConnsPerIP)
+	}
+	s.conns[c] = struct{}{}
+	s.metrics.connOpened()
+	s.connsPerIP[ip]++
+	s.peakConns = max(s.peakConns, len(s.conns))
+	return ""
+}
+
+func (s *Server) untrackConn(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[c]; !ok {
+		return
+	}
+	delete(s.conns, c)
+	s.metrics.connClosed()
+	ip := remoteIP(c)
+	s.connsPerIP[ip]--
+	if s.connsPerIP[ip] <= 0 {
+		delete(s.connsPerIP, ip)
+	}
+	s.releaseSlot()
+}
+
+func (s *Server) reject(c *conn, reason string) {
+	defer c.Close()
+	if s.slots != nil {
+		defer s.releaseSlot()
+	}
+	c.SetWriteDeadline(time.Now().Add(rejectTimeout))
+	w := response.Writer{W: c}
+	WriteError(&w, nil, &HandlerError{
+		StatusCode: response.StatusServiceUnavailable,
+		Message:    fmt.Sprintf("Service unavailable: %s", reason),
+	}, s.errorRenderer)
+}
+
+func remoteIP(c net.Conn) string {
+	return remoteIPFromAddr(c.RemoteAddr().String())
+}
+
+func remoteIPFromAddr(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func isTemporary(err error) bool {
+	te, ok := err.(interface{ Temporary() bool })
+	return ok && te.Temporary()
+}
+
+func nextBackoff(d time.Duration) time.Duration {
+	if d == 0 {
+		return minAcceptBackoff
+	}
+	return min(d*2, maxAcceptBackoff)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// first file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+// ServeListener serves connections accepted from l, which the server owns
+// and closes on Close or Shutdown
+func ServeListener(l net.Listener, h Handler, opts ...Option) *Server {
+	return newServer(l, h, opts...)
+}
+
+// ServeAddr listens on address using Listen and serves it, e.g.
+// ServeAddr("tcp", "[::1]:8080", h) or ServeAddr("unix", "/run/app.sock", h)
+func ServeAddr(network, address string, h Handler, opts ...Option) (*Server, error) {
+	l, err := Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return newServer(l, h, opts...), nil
+}
+
+// Listen is like net.Listen, but Unix sockets go through ListenUnix so a
+// stale socket file left by a previous run doesn't stop us from binding
+func Listen(network, address string) (net.Listener, error) {
+	switch network {
+	case "unix":
+		return ListenUnix(address, 0)
+	case "tcp", "tcp4", "tcp6":
+		return net.Listen(network, address)
+	}
+	return nil, fmt.Errorf("error: unsupported network '%s'", network)
+}
+
+// ListenUnix listens on a Unix domain socket. A path starting with '@' is an
+// abstract socket (Linux only) and has no file. Otherwise a stale socket file
+// is removed first, and the file is chmod'ed to mode unless mode is 0.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	abstract := strings.HasPrefix(path, "@")
+	if !abstract {
+		err := removeStaleSocket(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if !abstract && mode != 0 {
+		err = os.Chmod(path, mode)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("error: could not set permissions on '%s': %w", path, err)
+		}
+	}
+	return l, nil
+}
+
+// removeStaleSocket deletes a socket file nothing is listening on. Regular
+// files and live sockets are left alone so net.Listen reports the conflict.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != os.ModeSocket {
+		return nil
+	}
+	c, err := net.Dial("unix", path)
+	if err == nil {
+		c.Close()
+		return fmt.Errorf("error: socket '%s' is already in use", path)
+	}
+	return os.Remove(path)
+}
+
+// InheritedListeners returns the sockets passed in by systemd socket
+// activation (LISTEN_FDS/LISTEN_PID), in order, or nil if there are none.
+// The environment variables are unset so child processes don't see them.
+func InheritedListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]net.Listener, 0, n)
+	for i := range n {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := fmt.Sprintf("LISTEN_FD_%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("error: inherited fd %d (%s) is not a listening socket: %w", fd, name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
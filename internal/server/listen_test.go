@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, network, address string) string {
+	c, err := net.Dial(network, address)
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(simpleRequest))
+	require.NoError(t, err)
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	return string(resp)
+}
+
+func TestServeAddr(t *testing.T) {
+	// Test: Unix socket file with permissions
+	path := filepath.Join(t.TempDir(), "http.sock")
+	l, err := ListenUnix(path, 0o600)
+	require.NoError(t, err)
+	s := ServeListener(l, okHandler)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	assert.Contains(t, get(t, "unix", path), "HTTP/1.1 200 OK\r\n")
+
+	// Test: Socket in use is not replaced
+	_, err = ServeAddr("unix", path, okHandler)
+	require.Error(t, err)
+	s.Close()
+
+	// Test: Stale socket file is removed
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	s, err = ServeAddr("unix", path, okHandler)
+	require.NoError(t, err)
+	assert.Contains(t, get(t, "unix", path), "HTTP/1.1 200 OK\r\n")
+	s.Close()
+
+	// Test: Regular file is not removed
+	file := filepath.Join(t.TempDir(), "not-a-socket")
+	require.NoError(t, os.WriteFile(file, []byte("data"), 0o644))
+	_, err = ServeAddr("unix", file, okHandler)
+	require.Error(t, err)
+	assert.FileExists(t, file)
+
+	// Test: Abstract socket
+	abstract := fmt.Sprintf("@learn-http-test-%d", os.Getpid())
+	s, err = ServeAddr("unix", abstract, okHandler)
+	require.NoError(t, err)
+	assert.Contains(t, get(t, "unix", abstract), "HTTP/1.1 200 OK\r\n")
+	s.Close()
+
+	// Test: IPv6 loopback
+	s, err = ServeAddr("tcp6", "[::1]:0", okHandler)
+	if err != nil {
+		t.Log("skipping IPv6:", err)
+	} else {
+		assert.Contains(t, get(t, "tcp6", s.Addr().String()), "HTTP/1.1 200 OK\r\n")
+		s.Close()
+	}
+
+	// Test: Unknown network
+	_, err = ServeAddr("udp", ":0", okHandler)
+	require.Error(t, err)
+}
+
+func TestInheritedListeners(t *testing.T) {
+	if os.Getenv("TEST_INHERITED_HELPER") == "1" {
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		listeners, err := InheritedListeners()
+		if err != nil || len(listeners) != 1 {
+			fmt.Println("bad listeners:", len(listeners), err)
+			os.Exit(1)
+		}
+		c, err := listeners[0].Accept()
+		if err != nil {
+			os.Exit(1)
+		}
+		fmt.Fprintf(c, "LISTEN_FDS=%q", os.Getenv("LISTEN_FDS"))
+		c.Close()
+		os.Exit(0)
+	}
+
+	// Test: No listeners without a matching LISTEN_PID
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err := InheritedListeners()
+	require.NoError(t, err)
+	assert.Nil(t, listeners)
+	assert.Empty(t, os.Getenv("LISTEN_FDS"))
+
+	// Test: Listener passed as fd 3 is picked up and the env is cleared
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(t, err)
+	defer f.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInheritedListeners$")
+	cmd.Env = append(os.Environ(), "TEST_INHERITED_HELPER=1", "LISTEN_FDS=1", "LISTEN_FDNAMES=http")
+	cmd.ExtraFiles = []*os.File{f}
+	out := make(chan string, 1)
+	go func() {
+		c, err := net.Dial("tcp4", l.Addr().String())
+		if err != nil {
+			out <- err.Error()
+			return
+		}
+		defer c.Close()
+		b, _ := io.ReadAll(c)
+		out <- string(b)
+	}()
+	combined, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(combined))
+	assert.Equal(t, `LISTEN_FDS=""`, <-out)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/metrics"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+)
+
+type serverMetrics struct {
+	path        string
+	handler     Handler
+	requests    *metrics.CounterVec
+	duration    *metrics.HistogramVec
+	inFlight    *metrics.GaugeVec
+	openConns   *metrics.GaugeVec
+	bytesIn     *metrics.CounterVec
+	bytesOut    *metrics.CounterVec
+	parseErrors *metrics.CounterVec
+}
+
+func newServerMetrics(reg *metrics.Registry, path string) *serverMetrics {
+	return &serverMetrics{
+		path:        path,
+		handler:     reg.Handler(),
+		requests:    reg.NewCounter("http_requests_total", "Requests served.", "method", "route", "status"),
+		duration:    reg.NewHistogram("http_request_duration_seconds", "Time from the first byte of the request until the handler returned.", nil, "method", "route"),
+		inFlight:    reg.NewGauge("http_requests_in_flight", "Requests currently being handled."),
+		openConns:   reg.NewGauge("http_open_connections", "Connections currently open."),
+		bytesIn:     reg.NewCounter("http_received_bytes_total", "Bytes read from connections."),
+		bytesOut:    reg.NewCounter("http_sent_bytes_total", "Bytes written to connections."),
+		parseErrors: reg.NewCounter("http_request_parse_errors_total", "Requests that could not be parsed.", "type"),
+	}
+}
+
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true, "CONNECT": true, "TRACE": true,
+}
+
+// methodLabel keeps the label cardinality bounded
+func methodLabel(method string) string {
+	if knownMethods[method] {
+		return method
+	}
+	return "OTHER"
+}
+
+func routeLabel(req *request.Request) string {
+	pattern := req.MatchedPattern()
+	if pattern == "" {
+		return "unmatched"
+	}
+	return pattern
+}
+
+func (m *serverMetrics) observeRequest(req *request.Request, w *response.Writer, start time.Time) {
+	if m == nil {
+		return
+	}
+	method := methodLabel(req.RequestLine.Method)
+	route := routeLabel(req)
+	m.requests.Inc(method, route, strconv.Itoa(int(w.Status())))
+	m.duration.Observe(time.Since(start).Seconds(), method, route)
+}
+
+func (m *serverMetrics) observeParseError(err error) {
+	if m == nil {
+		return
+	}
+	kind := "other"
+	var timeoutErr *TimeoutError
+	var parseErr *request.ParseError
+	switch {
+	case errors.As(err, &timeoutErr):
+		kind = "timeout"
+	case errors.As(err, &parseErr):
+		kind = parseErr.Kind
+	}
+	m.parseErrors.Inc(kind)
+}
+
+func (m *serverMetrics) connOpened() {
+	if m != nil {
+		m.openConns.Inc()
+	}
+}
+
+func (m *serverMetrics) connClosed() {
+	if m != nil {
+		m.openConns.Dec()
+	}
+}
+
+func (m *serverMetrics) read(n int) {
+	if m != nil && n > 0 {
+		m.bytesIn.Add(float64(n))
+	}
+}
+
+func (m *serverMetrics) written(n int) {
+	if m != nil && n > 0 {
+		m.bytesOut.Add(float64(n))
+	}
+}
@@ -0,0 +1,13 @@
+package server
+
+// Middleware wraps a Handler to run code before and after it. After the
+// wrapped handler returns, w.Status() and w.BytesWritten() report what it wrote.
+type Middleware func(Handler) Handler
+
+// Chain wraps h in mws, the first middleware being the outermost
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
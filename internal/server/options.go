@@ -0,0 +1,112 @@
+package server
+
+import (
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/metrics"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+)
+
+type Option func(*Server)
+
+// WithReadHeaderTimeout limits the time from the first byte of a request
+// until its headers have been read
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.readHeaderTimeout = d
+	}
+}
+
+// WithReadTimeout limits the time from the first byte of a request until
+// its body has been read
+func WithReadTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.readTimeout = d
+	}
+}
+
+// WithWriteTimeout limits the time the handler has to write the response,
+// measured from the end of the request
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+// WithIdleTimeout limits how long a connection may wait for the first byte
+// of a request before being closed
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+// WithMaxConns limits the number of concurrent connections. Beyond the limit
+// the server either stops accepting or answers 503, depending on mode.
+func WithMaxConns(n int, mode LimitMode) Option {
+	return func(s *Server) {
+		s.maxConns = n
+		s.limitMode = mode
+	}
+}
+
+// WithMaxConnsPerIP limits concurrent connections from one client IP,
+// connections beyond the limit are answered with 503
+func WithMaxConnsPerIP(n int) Option {
+	return func(s *Server) {
+		s.maxConnsPerIP = n
+	}
+}
+
+// WithErrorRenderer sets how errors produced by the server itself, such as
+// malformed requests and timeouts, are rendered
+func WithErrorRenderer(r ErrorRenderer) Option {
+	return func(s *Server) {
+		s.errorRenderer = r
+	}
+}
+
+// WithPanicHook installs a hook called after a handler panic is recovered,
+// for example to report it to an error tracker
+func WithPanicHook(hook PanicHook) Option {
+	return func(s *Server) {
+		s.panicHook = hook
+	}
+}
+
+// WithAccessLog records every request, see NewCombinedLogger and NewJSONLogger
+func WithAccessLog(l AccessLogger) Option {
+	return func(s *Server) {
+		s.accessLog = l
+	}
+}
+
+// WithMetrics instruments the server into reg and, unless path is empty,
+// serves reg in the Prometheus text format on path ahead of the handler
+func WithMetrics(reg *metrics.Registry, path string) Option {
+	return func(s *Server) {
+		s.metrics = newServerMetrics(reg, path)
+	}
+}
+
+// WithRequestTimeout sets a deadline on every request context, measured from
+// the end of the request
+func WithRequestTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.requestTimeout = d
+	}
+}
+
+// WithRequestLimits sets the request parser's buffer size and limits.
+// Requests beyond them are answered with 431 or 413.
+func WithRequestLimits(l request.Limits) Option {
+	return func(s *Server) {
+		s.requestLimits = l
+	}
+}
+
+func withCleanup(f func()) Option {
+	return func(s *Server) {
+		s.cleanups = append(s.cleanups, f)
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+)
+
+// Protocol takes over connections that start with Preface, or whose first
+// HTTP/1.1 request asks to Upgrade to it and passes Accept. Either may be
+// empty.
+type Protocol struct {
+	Preface string
+	Upgrade string
+	// optional, lets the protocol ignore upgrade requests it can't handle
+	Accept func(req *request.Request) bool
+	// runs the protocol until the connection should be closed
+	Serve func(pc *ProtocolConn)
+}
+
+// WithProtocol serves another protocol on the same listener
+func WithProtocol(p Protocol) Option {
+	return func(s *Server) {
+		s.protocols = append(s.protocols, p)
+	}
+}
+
+// ProtocolConn is a connection handed to a Protocol. It stays tracked by the
+// server, so Shutdown waits for Serve to return and Close closes it.
+type ProtocolConn struct {
+	net.Conn
+	// bytes read after the preface or the upgrade request
+	Buffered []byte
+	// the request that asked to upgrade, already answered with 101. Nil
+	// when the connection started with the preface.
+	Request     *request.Request
+	IdleTimeout time.Duration
+	server      *Server
+}
+
+// Context is cancelled when the server is closed
+func (pc *ProtocolConn) Context() context.Context {
+	return pc.server.baseCtx
+}
+
+// ShuttingDown is closed once the server stops accepting connections, the
+// protocol should finish its requests and return
+func (pc *ProtocolConn) ShuttingDown() <-chan struct{} {
+	return pc.server.done
+}
+
+// ServeRequest runs the server's handler for one request of the protocol,
+// with the same metrics, timeouts, panic recovery and access logging as an
+// HTTP/1.1 request
+func (pc *ProtocolConn) ServeRequest(w *response.Writer, req *request.Request) {
+	s := pc.server
+	start := time.Now()
+	req.RemoteAddr = pc.RemoteAddr().String()
+	if s.requestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), s.requestTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	s.serveRequest(w, req, start)
+	if s.accessLog != nil && w.Started() {
+		s.accessLog.Log(newAccessEntry(start, req.RemoteAddr, req, w))
+	}
+}
+
+func (s *Server) hasPreface() bool {
+	for _, p := range s.protocols {
+		if p.Preface != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// readPreface reads while the bytes so far could still start a protocol
+// preface, returning the protocol whose preface matched, if any, and
+// everything read. Read errors are left for the request parser to find.
+func (s *Server) readPreface(c *conn) (*Protocol, []byte) {
+	size := 512
+	for _, p := range s.protocols {
+		size = max(size, len(p.Preface))
+	}
+	buf := make([]byte, 0, size)
+	for {
+		candidate := false
+		for i := range s.protocols {
+			p := &s.protocols[i]
+			if p.Preface == "" {
+				continue
+			}
+			if strings.HasPrefix(string(buf), p.Preface) {
+				return p, buf
+			}
+			if strings.HasPrefix(p.Preface, string(buf)) {
+				candidate = true
+			}
+		}
+		if !candidate || len(buf) == cap(buf) {
+			return nil, buf
+		}
+		n, err := c.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err != nil {
+			return nil, buf
+		}
+	}
+}
+
+func (s *Server) upgradeProtocol(req *request.Request) *Protocol {
+	for i := range s.protocols {
+		p := &s.protocols[i]
+		if p.Upgrade != "" && IsUpgrade(req, p.Upgrade) && (p.Accept == nil || p.Accept(req)) {
+			return p
+		}
+	}
+	return nil
+}
+
+// switchProtocols answers the upgrade request with 101 and hands over
+func (s *Server) switchProtocols(c *conn, w *response.Writer, req *request.Request, p *Protocol) {
+	err := w.WriteStatusLine(response.StatusSwitchingProtocols)
+	if err != nil {
+		return
+	}
+	h := headers.NewHeaders()
+	h.Override("Connection", "Upgrade")
+	h.Override("Upgrade", p.Upgrade)
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return
+	}
+	s.serveProtocol(c, p, req, req.Buffered())
+}
+
+func (s *Server) serveProtocol(c *conn, p *Protocol, req *request.Request, buffered []byte) {
+	c.Conn.SetDeadline(time.Time{})
+	c.setState(stateActive)
+	p.Serve(&ProtocolConn{
+		Conn:        c,
+		Buffered:    buffered,
+		Request:     req,
+		IdleTimeout: s.idleTimeout,
+		server:      s,
+	})
+}
+
+// prefixReader replays bytes read while looking for a preface before
+// reading the rest of the request from the connection
+type prefixReader struct {
+	*conn
+	prefix []byte
+}
+
+func (r *prefixReader) Read(p []byte) (int, error) {
+	if len(r.prefix) > 0 {
+		n := copy(p, r.prefix)
+		r.prefix = r.prefix[n:]
+		return n, nil
+	}
+	return r.conn.Read(p)
+}
@@ -1,75 +1,333 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"runtime/debug"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
 	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
 )
 
 type Server struct {
-	handler  Handler
-	listener net.Listener
-	closed   atomic.Bool
+	handler           Handler
+	listener          net.Listener
+	closed            atomic.Bool
+	mu                sync.Mutex
+	conns             map[*conn]struct{}
+	connsPerIP        map[string]int
+	peakConns         int
+	rejectedConns     int
+	done              chan struct{}
+	doneOnce          sync.Once
+	slots             chan struct{}
+	maxConns          int
+	limitMode         LimitMode
+	maxConnsPerIP     int
+	errorRenderer     ErrorRenderer
+	panicHook         PanicHook
+	accessLog         AccessLogger
+	metrics           *serverMetrics
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	requestTimeout    time.Duration
+	requestLimits     request.Limits
+	baseCtx           context.Context
+	cancelBase        context.CancelCauseFunc
+	cleanups          []func()
+	cleanupOnce       sync.Once
+	protocols         []Protocol
 }
 
+// ErrClientDisconnected is the cause of a request context cancelled because
+// the client closed its connection
+var ErrClientDisconnected = errors.New("client disconnected")
+
+// ErrServerClosed is the cause of a request context cancelled because the
+// server was closed or its shutdown deadline passed
+var ErrServerClosed = errors.New("server closed")
+
 type HandlerError struct {
 	StatusCode response.StatusCode
 	Message    string
+	// optional cause, logged but not shown to the client
+	Err error
 }
 
 type Handler func(w *response.Writer, req *request.Request)
 
-func Serve(port int, h Handler) (*Server, error) {
-	l, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
-	if err != nil {
-		return nil, err
-	}
+// PanicHook is called with the recovered value and stack trace when a handler panics
+type PanicHook func(req *request.Request, recovered any, stack []byte)
+
+func Serve(port int, h Handler, opts ...Option) (*Server, error) {
+	return ServeAddr("tcp4", fmt.Sprintf(":%d", port), h, opts...)
+}
+
+func newServer(l net.Listener, h Handler, opts ...Option) *Server {
 	s := &Server{
-		handler:  h,
-		listener: l,
+		handler:    h,
+		listener:   l,
+		conns:      map[*conn]struct{}{},
+		connsPerIP: map[string]int{},
+		done:       make(chan struct{}),
+	}
+	s.baseCtx, s.cancelBase = context.WithCancelCause(context.Background())
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.maxConns > 0 && s.limitMode == LimitBlock {
+		s.slots = make(chan struct{}, s.maxConns)
 	}
 	go s.listen()
-	return s, nil
+	return s
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
 }
 
 func (s *Server) Close() error {
-	s.closed.Store(true)
+	s.markClosed()
+	s.cancelBase(ErrServerClosed)
+	defer s.cleanup()
 	return s.listener.Close()
 
 }
 
+func (s *Server) markClosed() {
+	s.closed.Store(true)
+	s.doneOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown stops accepting connections, closes idle ones and waits for active
+// handlers to finish. If ctx expires first the remaining connections are
+// closed, and the number cut off is returned along with ctx.Err().
+func (s *Server) Shutdown(ctx context.Context) (int, error) {
+	s.markClosed()
+	err := s.listener.Close()
+	if err != nil {
+		log.Printf("error: could not close listener: %v", err)
+	}
+
+	defer s.cleanup()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return 0, nil
+		}
+		select {
+		case <-ctx.Done():
+			s.cancelBase(ErrServerClosed)
+			return s.closeAllConns(), ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// cleanup releases what the server's options set up, like log files and
+// certificate watchers. It runs once, on Close or Shutdown.
+func (s *Server) cleanup() {
+	s.cleanupOnce.Do(func() {
+		for _, f := range s.cleanups {
+			f()
+		}
+	})
+}
+
+// closeIdleConns reports whether all connections are closed
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		if c.getState() == stateIdle {
+			c.Close()
+		}
+	}
+	return len(s.conns) == 0
+}
+
+func (s *Server) closeAllConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+	return len(s.conns)
+}
+
 func (s *Server) listen() {
+	var backoff time.Duration
 	for {
+		if !s.acquireSlot() {
+			return
+		}
 		conn, err := s.listener.Accept()
 		if err != nil {
+			s.releaseSlot()
 			if s.closed.Load() {
 				return
 			}
-			log.Printf("error: could not accept connection: %v", err)
-			continue
+			if isTemporary(err) {
+				backoff = nextBackoff(backoff)
+				log.Printf("error: could not accept connection: %v; retrying in %v", err, backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			// e.g. the listener was closed underneath the server
+			log.Printf("error: could not accept connection: %v; no longer accepting", err)
+			return
 		}
+		backoff = 0
 
-		go s.handle(conn)
+		c := newConn(conn, s)
+		if reason := s.trackConn(c); reason != "" {
+			go s.reject(c, reason)
+			continue
+		}
+		go s.handle(c)
 	}
 }
 
-func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+func (s *Server) handle(conn *conn) {
+	defer s.untrackConn(conn)
+	defer func() {
+		if !conn.hijacked.Load() {
+			conn.Close()
+		}
+	}()
 	w := response.Writer{W: conn}
-	req, err := request.RequestFromReader(conn)
+	conn.waitForRequest()
+	var req *request.Request
+	defer func() {
+		s.logAccess(conn, req, &w)
+	}()
+	var reader io.Reader = conn
+	if s.hasPreface() {
+		p, peeked := s.readPreface(conn)
+		if p != nil {
+			s.serveProtocol(conn, p, nil, peeked[len(p.Preface):])
+			return
+		}
+		reader = &prefixReader{conn: conn, prefix: peeked}
+	}
+	req, err := request.RequestFromReaderLimits(reader, s.requestLimits)
 	if err != nil {
-		w.WriteStatusLine(response.StatusBadRequest)
-		body := []byte(fmt.Sprintf("Error parsing request: %v", err))
-		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
-		w.WriteBody(body)
+		var timeoutErr *TimeoutError
+		if errors.As(err, &timeoutErr) {
+			if timeoutErr.Op == "idle" {
+				return
+			}
+			s.metrics.observeParseError(err)
+			conn.requestRead()
+			WriteError(&w, nil, &HandlerError{
+				StatusCode: response.StatusRequestTimeout,
+				Message:    fmt.Sprintf("Error reading request: %v", timeoutErr),
+			}, s.errorRenderer)
+			return
+		}
+		s.metrics.observeParseError(err)
+		status := response.StatusBadRequest
+		switch {
+		case errors.Is(err, request.ErrHeaderTooLarge):
+			status = response.StatusRequestHeaderFieldsTooLarge
+		case errors.Is(err, request.ErrBodyTooLarge):
+			status = response.StatusContentTooLarge
+		}
+		WriteError(&w, nil, &HandlerError{
+			StatusCode: status,
+			Message:    fmt.Sprintf("Error parsing request: %v", err),
+		}, s.errorRenderer)
+		return
+	}
+	req.RemoteAddr = conn.RemoteAddr().String()
+	if pr, ok := reader.(*prefixReader); ok {
+		req.AppendBuffered(pr.prefix)
+	}
+	conn.buffered = req.Buffered()
+	if tlsConn, ok := conn.Conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+	conn.requestRead()
+	if p := s.upgradeProtocol(req); p != nil {
+		s.switchProtocols(conn, &w, req, p)
 		return
 	}
 
-	s.handler(&w, req)
+	ctx, cancel := context.WithCancelCause(s.baseCtx)
+	defer cancel(nil)
+	if s.requestTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, s.requestTimeout)
+		defer cancelTimeout()
+	}
+	req = req.WithContext(ctx)
+	conn.startBackgroundRead(func() {
+		cancel(ErrClientDisconnected)
+	})
+	defer conn.abortBackgroundRead()
+
+	s.serveRequest(&w, req, conn.requestStart)
 
 	return
 }
+
+func (s *Server) logAccess(conn *conn, req *request.Request, w *response.Writer) {
+	// nothing was requested on idle connections
+	if s.accessLog == nil || !w.Started() {
+		return
+	}
+	start := conn.requestStart
+	if start.IsZero() {
+		start = time.Now()
+	}
+	s.accessLog.Log(newAccessEntry(start, conn.RemoteAddr().String(), req, w))
+}
+
+func (s *Server) serveRequest(w *response.Writer, req *request.Request, start time.Time) {
+	handler := s.handler
+	if s.metrics != nil {
+		if s.metrics.path != "" && req.Path() == s.metrics.path {
+			handler = s.metrics.handler
+			req.SetPattern(s.metrics.path)
+		}
+		s.metrics.inFlight.Inc()
+		defer s.metrics.inFlight.Dec()
+		defer s.metrics.observeRequest(req, w, start)
+	}
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		stack := debug.Stack()
+		log.Printf("error: panic serving %s %s %s for %s: %v\n%s",
+			req.RequestLine.Method, req.RequestLine.RequestTarget, req.RequestLine.HttpVersion, req.RemoteAddr, recovered, stack)
+		if s.panicHook != nil {
+			s.panicHook(req, recovered, stack)
+		}
+		// once the response has started the connection is closed by handle
+		if !w.Started() && !w.Hijacked() {
+			WriteError(w, req, &HandlerError{
+				StatusCode: response.StatusInternalServerError,
+				Err:        fmt.Errorf("panic: %v", recovered),
+			}, s.errorRenderer)
+		}
+	}()
+	handler(w, req)
+}
@@ -0,0 +1,529 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/metrics"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const simpleRequest = "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+func okHandler(w *response.Writer, req *request.Request) {
+	body := []byte("ok")
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func dial(t *testing.T, s *Server) net.Conn {
+	c, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	return c
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-release
+		okHandler(w, req)
+	})
+	require.NoError(t, err)
+
+	// Test: Idle connection is closed, active handler finishes
+	idle := dial(t, s)
+	defer idle.Close()
+	active := dial(t, s)
+	defer active.Close()
+	_, err = active.Write([]byte(simpleRequest))
+	require.NoError(t, err)
+	<-started
+
+	done := make(chan struct{})
+	var cut int
+	go func() {
+		cut, err = s.Shutdown(context.Background())
+		close(done)
+	}()
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	_, readErr := idle.Read(make([]byte, 1))
+	assert.ErrorIs(t, readErr, io.EOF)
+
+	close(release)
+	resp, readErr := io.ReadAll(active)
+	require.NoError(t, readErr)
+	assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+	<-done
+	require.NoError(t, err)
+	assert.Equal(t, 0, cut)
+
+	// Test: New connections are refused
+	_, err = net.Dial("tcp", s.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	started := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-block
+	})
+	require.NoError(t, err)
+
+	c := dial(t, s)
+	defer c.Close()
+	_, err = c.Write([]byte(simpleRequest))
+	require.NoError(t, err)
+	<-started
+
+	// Test: Active connection is cut when the context expires
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	cut, err := s.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, cut)
+}
+
+func TestTimeouts(t *testing.T) {
+	writeErr := make(chan error, 1)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			time.Sleep(150 * time.Millisecond)
+			writeErr <- w.WriteStatusLine(response.StatusOK)
+			return
+		}
+		okHandler(w, req)
+	},
+		WithIdleTimeout(100*time.Millisecond),
+		WithReadHeaderTimeout(100*time.Millisecond),
+		WithReadTimeout(time.Second),
+		WithWriteTimeout(100*time.Millisecond),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Idle connection is closed without a response
+	c := dial(t, s)
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Empty(t, resp)
+	c.Close()
+
+	// Test: Stalled headers get a 408
+	c = dial(t, s)
+	_, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: loc"))
+	require.NoError(t, err)
+	resp, err = io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 408 Request Timeout\r\n")
+	assert.Contains(t, string(resp), "read header timeout")
+	c.Close()
+
+	// Test: Complete request is served
+	c = dial(t, s)
+	_, err = c.Write([]byte(simpleRequest))
+	require.NoError(t, err)
+	resp, err = io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+	c.Close()
+
+	// Test: Write after the write timeout returns a TimeoutError
+	c = dial(t, s)
+	_, err = c.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, <-writeErr, &timeoutErr)
+	assert.Equal(t, "write", timeoutErr.Op)
+	c.Close()
+}
+
+func TestConnLimits(t *testing.T) {
+	for _, opt := range []Option{WithMaxConns(1, LimitReject), WithMaxConnsPerIP(1)} {
+		release := make(chan struct{})
+		started := make(chan struct{}, 1)
+		s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+			started <- struct{}{}
+			<-release
+			okHandler(w, req)
+		}, opt)
+		require.NoError(t, err)
+
+		first := dial(t, s)
+		_, err = first.Write([]byte(simpleRequest))
+		require.NoError(t, err)
+		<-started
+
+		// Test: Connection beyond the limit is rejected with 503
+		second := dial(t, s)
+		resp, err := io.ReadAll(second)
+		require.NoError(t, err)
+		assert.Contains(t, string(resp), "HTTP/1.1 503 Service Unavailable\r\n")
+		second.Close()
+
+		close(release)
+		resp, err = io.ReadAll(first)
+		require.NoError(t, err)
+		assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+		first.Close()
+
+		stats := s.ConnStats()
+		assert.Equal(t, 1, stats.Peak)
+		assert.Equal(t, 1, stats.Rejected)
+		s.Close()
+	}
+}
+
+func TestConnLimitBlock(t *testing.T) {
+	release := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/block" {
+			<-release
+		}
+		okHandler(w, req)
+	}, WithMaxConns(1, LimitBlock))
+	require.NoError(t, err)
+	defer s.Close()
+
+	first := dial(t, s)
+	defer first.Close()
+	_, err = first.Write([]byte("GET /block HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	// Test: Connection beyond the limit waits for a free slot
+	second := dial(t, s)
+	defer second.Close()
+	_, err = second.Write([]byte(simpleRequest))
+	require.NoError(t, err)
+	second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = second.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	close(release)
+	second.SetReadDeadline(time.Time{})
+	resp, err := io.ReadAll(second)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+	assert.Equal(t, 0, s.ConnStats().Rejected)
+}
+
+func TestRequestLimits(t *testing.T) {
+	s, err := Serve(0, okHandler, WithRequestLimits(request.Limits{BufferSize: 1024, MaxHeaderBytes: 64, MaxBodyBytes: 4}))
+	require.NoError(t, err)
+	defer s.Close()
+	send := func(raw string) string {
+		c := dial(t, s)
+		defer c.Close()
+		_, err := c.Write([]byte(raw))
+		require.NoError(t, err)
+		resp, err := io.ReadAll(c)
+		require.NoError(t, err)
+		return string(resp)
+	}
+
+	// Test: Requests within the limits are served
+	assert.Contains(t, send("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nbody"), "HTTP/1.1 200 OK\r\n")
+
+	// Test: Oversized headers get a 431 and oversized bodies a 413
+	assert.Contains(t, send("GET / HTTP/1.1\r\nHost: localhost\r\nX-Big: "+strings.Repeat("x", 64)+"\r\n\r\n"),
+		"HTTP/1.1 431 Request Header Fields Too Large\r\n")
+	assert.Contains(t, send("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nbody!"),
+		"HTTP/1.1 413 Content Too Large\r\n")
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	// Test: Backoff doubles up to the maximum
+	assert.Equal(t, minAcceptBackoff, nextBackoff(0))
+	assert.Equal(t, 2*minAcceptBackoff, nextBackoff(minAcceptBackoff))
+	assert.Equal(t, maxAcceptBackoff, nextBackoff(maxAcceptBackoff))
+
+	// Test: Accepting stops on errors that aren't temporary
+	l := &failingListener{}
+	s := &Server{listener: l}
+	stopped := make(chan struct{})
+	go func() {
+		s.listen()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("listen kept accepting after a permanent error")
+	}
+	assert.Equal(t, int32(1), l.accepts.Load())
+}
+
+// failingListener fails every Accept as if closed underneath the server
+type failingListener struct {
+	accepts atomic.Int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.accepts.Add(1)
+	return nil, net.ErrClosed
+}
+
+func (l *failingListener) Close() error   { return nil }
+func (l *failingListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestPanicRecovery(t *testing.T) {
+	hooked := make(chan any, 2)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.RequestTarget {
+		case "/early":
+			panic("early")
+		case "/late":
+			w.WriteStatusLine(response.StatusOK)
+			panic("late")
+		}
+		okHandler(w, req)
+	}, WithPanicHook(func(req *request.Request, recovered any, stack []byte) {
+		assert.Contains(t, string(stack), "TestPanicRecovery")
+		hooked <- recovered
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	get := func(target string) string {
+		c := dial(t, s)
+		defer c.Close()
+		_, err := c.Write([]byte("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		resp, err := io.ReadAll(c)
+		require.NoError(t, err)
+		return string(resp)
+	}
+
+	// Test: Panic before the response starts gets a 500
+	assert.Contains(t, get("/early"), "HTTP/1.1 500 Internal Server Error\r\n")
+	assert.Equal(t, "early", <-hooked)
+
+	// Test: Panic after the response starts closes the connection
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", get("/late"))
+	assert.Equal(t, "late", <-hooked)
+
+	// Test: Server keeps serving
+	assert.Contains(t, get("/"), "HTTP/1.1 200 OK\r\n")
+}
+
+func TestMetrics(t *testing.T) {
+	reg := metrics.NewRegistry()
+	type ctxKey struct{}
+	// like a global middleware attaching a value in front of the router
+	attach := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			next(w, req.WithContext(context.WithValue(req.Context(), ctxKey{}, "attached")))
+		}
+	}
+	s, err := Serve(0, Chain(func(w *response.Writer, req *request.Request) {
+		req.SetPattern("/items/{id}")
+		okHandler(w, req)
+	}, attach), WithMetrics(reg, "/metrics"))
+	require.NoError(t, err)
+	defer s.Close()
+
+	send := func(raw string) string {
+		c := dial(t, s)
+		defer c.Close()
+		_, err := c.Write([]byte(raw))
+		require.NoError(t, err)
+		resp, err := io.ReadAll(c)
+		require.NoError(t, err)
+		return string(resp)
+	}
+	send("GET /items/1 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	send("GET /items/2 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	send("BAD\r\n\r\n")
+
+	// Test: Metrics endpoint exposes request, connection and parse error
+	// metrics, with routes matched behind a middleware copying the request
+	resp := send("GET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, resp, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, resp, `http_requests_total{method="GET",route="/items/{id}",status="200"} 2`)
+	assert.Contains(t, resp, `http_request_duration_seconds_count{method="GET",route="/items/{id}"} 2`)
+	assert.Contains(t, resp, `http_request_parse_errors_total{type="request_line"} 1`)
+	assert.Contains(t, resp, "http_requests_in_flight 1\n")
+	assert.Regexp(t, `http_open_connections [1-9]\n`, resp)
+	assert.Contains(t, resp, "http_received_bytes_total ")
+}
+
+func TestRequestContext(t *testing.T) {
+	type ctxKey struct{}
+	causes := make(chan error, 1)
+	h := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/value" {
+			assert.Equal(t, "attached", req.Context().Value(ctxKey{}))
+			okHandler(w, req)
+			return
+		}
+		<-req.Context().Done()
+		causes <- context.Cause(req.Context())
+	}
+	attach := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			next(w, req.WithContext(context.WithValue(req.Context(), ctxKey{}, "attached")))
+		}
+	}
+	s, err := Serve(0, Chain(h, attach), WithRequestTimeout(200*time.Millisecond))
+	require.NoError(t, err)
+	defer s.Close()
+
+	send := func(target string) net.Conn {
+		c := dial(t, s)
+		_, err := c.Write([]byte("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		return c
+	}
+
+	// Test: Client disconnect cancels the context
+	c := send("/wait")
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	assert.ErrorIs(t, <-causes, ErrClientDisconnected)
+
+	// Test: Request timeout expires the context
+	c = send("/wait")
+	defer c.Close()
+	assert.ErrorIs(t, <-causes, context.DeadlineExceeded)
+
+	// Test: Middleware can attach values
+	c = send("/value")
+	defer c.Close()
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+
+	// Test: Closing the server cancels in-flight requests
+	c = send("/wait")
+	defer c.Close()
+	time.Sleep(50 * time.Millisecond)
+	s.Close()
+	assert.ErrorIs(t, <-causes, ErrServerClosed)
+}
+
+func TestHijack(t *testing.T) {
+	writeErrs := make(chan error, 2)
+	echo := func(w *response.Writer, req *request.Request) {
+		conn, buffered, err := Upgrade(w, req, "echo", headers.Headers{"x-echo": "1"})
+		if errors.Is(err, ErrUpgradeNotRequested) {
+			WriteError(w, req, &HandlerError{StatusCode: response.StatusUpgradeRequired}, nil)
+			return
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		writeErrs <- w.WriteStatusLine(response.StatusOK)
+		go func() {
+			defer conn.Close()
+			conn.Write(buffered)
+			io.Copy(conn, conn)
+		}()
+	}
+	s, err := Serve(0, echo)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Upgrade answers 101 and hands over bytes sent with the request
+	c := dial(t, s)
+	defer c.Close()
+	_, err = c.Write([]byte("GET /echo HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nearly "))
+	require.NoError(t, err)
+	r := bufio.NewReader(c)
+	status, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+	head := ""
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+		head += strings.ToLower(line)
+	}
+	assert.Contains(t, head, "connection: upgrade\r\n")
+	assert.Contains(t, head, "upgrade: echo\r\n")
+	assert.Contains(t, head, "x-echo: 1\r\n")
+	assert.NotContains(t, head, "content-length")
+	assert.ErrorIs(t, <-writeErrs, response.ErrHijacked)
+
+	_, err = c.Write([]byte("late"))
+	require.NoError(t, err)
+	echoed := make([]byte, len("early late"))
+	_, err = io.ReadFull(r, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "early late", string(echoed))
+
+	// Test: Hijacked connection is no longer managed by the server
+	require.Eventually(t, func() bool { return s.ConnStats().Current == 0 }, time.Second, 10*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	cut, err := s.Shutdown(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, cut)
+	_, err = c.Write([]byte("still here"))
+	require.NoError(t, err)
+	echoed = make([]byte, len("still here"))
+	_, err = io.ReadFull(r, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "still here", string(echoed))
+
+	// Test: Bytes read ahead while looking for a protocol preface are
+	// handed over too
+	s, err = Serve(0, echo, WithProtocol(Protocol{Preface: "PRI * HTTP/2.0\r\n", Serve: func(pc *ProtocolConn) {}}))
+	require.NoError(t, err)
+	defer s.Close()
+	c = dial(t, s)
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = c.Write([]byte("GET /echo HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nearly-bytes-here\n"))
+	require.NoError(t, err)
+	r = bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+	}
+	echoed = make([]byte, len("early-bytes-here\n"))
+	_, err = io.ReadFull(r, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "early-bytes-here\n", string(echoed))
+}
+
+func TestUpgradeRequired(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		_, _, err := Upgrade(w, req, "echo", nil)
+		assert.ErrorIs(t, err, ErrUpgradeNotRequested)
+		WriteError(w, req, &HandlerError{StatusCode: response.StatusUpgradeRequired}, nil)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Request without Upgrade is left for the handler to answer
+	c := dial(t, s)
+	defer c.Close()
+	_, err = c.Write([]byte("GET /echo HTTP/1.1\r\nHost: localhost\r\nUpgrade: echo\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 426 Upgrade Required\r\n")
+}
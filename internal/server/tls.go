@@ -0,0 +1,167 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ServeTLS is like Serve but terminates TLS on every accepted connection
+func ServeTLS(port int, h Handler, config *tls.Config, opts ...Option) (*Server, error) {
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil) {
+		return nil, errors.New("error: TLS config has no certificates")
+	}
+	l, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	return newServer(tls.NewListener(l, config), h, opts...), nil
+}
+
+type CertFile struct {
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+}
+
+type loadedCert struct {
+	cert *tls.Certificate
+	// of the certificate and key files when loaded
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// CertReloader serves one or more certificate/key pairs, choosing between
+// them by SNI, and reloads them from disk on Reload or when watched.
+type CertReloader struct {
+	files []CertFile
+	mu    sync.RWMutex
+	certs []loadedCert
+}
+
+func NewCertReloader(files ...CertFile) (*CertReloader, error) {
+	if len(files) == 0 {
+		return nil, errors.New("error: no certificate files given")
+	}
+	r := &CertReloader{files: files}
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads every certificate pair from disk. On error the previously
+// loaded certificates are kept.
+func (r *CertReloader) Reload() error {
+	certs := make([]loadedCert, 0, len(r.files))
+	for _, f := range r.files {
+		// stat first, so a file changing during the load is reloaded later
+		certModTime, keyModTime, err := f.modTimes()
+		if err != nil {
+			return err
+		}
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return fmt.Errorf("error: could not load certificate '%s': %w", f.CertFile, err)
+		}
+		if cert.Leaf == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return fmt.Errorf("error: could not parse certificate '%s': %w", f.CertFile, err)
+			}
+		}
+		certs = append(certs, loadedCert{cert: &cert, certModTime: certModTime, keyModTime: keyModTime})
+	}
+	r.mu.Lock()
+	r.certs = certs
+	r.mu.Unlock()
+	return nil
+}
+
+// Watch polls the certificate files every interval and reloads them when
+// one changes. Call the returned func to stop watching.
+func (r *CertReloader) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if !r.changed() {
+					continue
+				}
+				err := r.Reload()
+				if err != nil {
+					log.Printf("error: could not reload certificates: %v", err)
+					continue
+				}
+				log.Printf("Reloaded %d certificates", len(r.files))
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+func (r *CertReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for i, f := range r.files {
+		certModTime, keyModTime, err := f.modTimes()
+		if err != nil {
+			continue
+		}
+		if !certModTime.Equal(r.certs[i].certModTime) || !keyModTime.Equal(r.certs[i].keyModTime) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f CertFile) modTimes() (cert, key time.Time, err error) {
+	certInfo, err := os.Stat(f.CertFile)
+	if err != nil {
+		return cert, key, fmt.Errorf("error: could not stat certificate '%s': %w", f.CertFile, err)
+	}
+	keyInfo, err := os.Stat(f.KeyFile)
+	if err != nil {
+		return cert, key, fmt.Errorf("error: could not stat key '%s': %w", f.KeyFile, err)
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// GetCertificate picks the first certificate valid for the client's SNI
+// name, falling back to the first certificate
+func (r *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.certs) == 0 {
+		return nil, errors.New("error: no certificates loaded")
+	}
+	if hello.ServerName != "" {
+		for _, c := range r.certs {
+			if c.cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return c.cert, nil
+			}
+		}
+	}
+	return r.certs[0].cert, nil
+}
+
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+}
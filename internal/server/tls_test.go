@@ -0,0 +1,162 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue signs a leaf certificate and returns it as a tls.Certificate and PEM files
+func (ca *testCA) issue(t *testing.T, dir, name string, serial int64, usage x509.ExtKeyUsage) (tls.Certificate, CertFile) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	files := CertFile{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	require.NoError(t, os.WriteFile(files.CertFile, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(files.KeyFile, keyPEM, 0o600))
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	return cert, files
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	_, aFiles := ca.issue(t, dir, "a.test", 2, x509.ExtKeyUsageServerAuth)
+	_, bFiles := ca.issue(t, dir, "b.test", 3, x509.ExtKeyUsageServerAuth)
+	clientCert, _ := ca.issue(t, dir, "client.test", 4, x509.ExtKeyUsageClientAuth)
+
+	reloader, err := NewCertReloader(aFiles, bFiles)
+	require.NoError(t, err)
+	config := reloader.TLSConfig()
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	config.ClientCAs = ca.pool
+
+	s, err := ServeTLS(0, func(w *response.Writer, req *request.Request) {
+		body := []byte("no tls")
+		if req.TLS != nil {
+			client := ""
+			if len(req.TLS.PeerCertificates) > 0 {
+				client = req.TLS.PeerCertificates[0].Subject.CommonName
+			}
+			body = []byte(fmt.Sprintf("%s %s %s", tls.VersionName(req.TLS.Version), req.TLS.ServerName, client))
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}, config)
+	require.NoError(t, err)
+	defer s.Close()
+
+	get := func(serverName string, certs []tls.Certificate) (*x509.Certificate, string) {
+		c, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{
+			RootCAs:      ca.pool,
+			ServerName:   serverName,
+			Certificates: certs,
+		})
+		require.NoError(t, err)
+		defer c.Close()
+		_, err = c.Write([]byte(simpleRequest))
+		require.NoError(t, err)
+		resp, err := io.ReadAll(c)
+		require.NoError(t, err)
+		return c.ConnectionState().PeerCertificates[0], string(resp)
+	}
+
+	// Test: SNI selects the first certificate
+	cert, resp := get("a.test", nil)
+	assert.Equal(t, "a.test", cert.Subject.CommonName)
+	assert.Contains(t, resp, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, resp, "TLS 1.3 a.test ")
+
+	// Test: SNI selects the second certificate, client certificate is exposed
+	cert, resp = get("b.test", []tls.Certificate{clientCert})
+	assert.Equal(t, "b.test", cert.Subject.CommonName)
+	assert.Contains(t, resp, "TLS 1.3 b.test client.test")
+
+	// Test: Reload picks up a new certificate from disk
+	stop := reloader.Watch(10 * time.Millisecond)
+	defer stop()
+	future := time.Now().Add(time.Minute)
+	ca.issue(t, dir, "a.test", 5, x509.ExtKeyUsageServerAuth)
+	require.NoError(t, os.Chtimes(aFiles.CertFile, future, future))
+	assert.Eventually(t, func() bool {
+		cert, _ := get("a.test", nil)
+		return cert.SerialNumber.Int64() == 5
+	}, time.Second, 20*time.Millisecond)
+
+	// Test: A new key alone is noticed, the certificate's mtime kept as is
+	ca.issue(t, dir, "a.test", 6, x509.ExtKeyUsageServerAuth)
+	require.NoError(t, os.Chtimes(aFiles.CertFile, future, future))
+	later := future.Add(time.Minute)
+	require.NoError(t, os.Chtimes(aFiles.KeyFile, later, later))
+	assert.Eventually(t, func() bool {
+		cert, _ := get("a.test", nil)
+		return cert.SerialNumber.Int64() == 6
+	}, time.Second, 20*time.Millisecond)
+
+	// Test: Missing config
+	_, err = ServeTLS(0, okHandler, &tls.Config{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"errors"
+	"net"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+)
+
+var ErrUpgradeNotRequested = errors.New("error: request does not ask to upgrade to the protocol")
+
+// IsUpgrade reports whether req asks to switch to protocol
+func IsUpgrade(req *request.Request, protocol string) bool {
+	return req.RequestLine.HttpVersion == "1.1" &&
+		req.Headers.HasToken("Connection", "upgrade") &&
+		req.Headers.HasToken("Upgrade", protocol)
+}
+
+// Upgrade answers 101 Switching Protocols to protocol, with any extra headers
+// h, and hijacks the connection. The returned bytes were sent by the client
+// after the request and belong to the new protocol. Nothing is written if
+// the request didn't ask for protocol.
+func Upgrade(w *response.Writer, req *request.Request, protocol string, h headers.Headers) (net.Conn, []byte, error) {
+	if !IsUpgrade(req, protocol) {
+		return nil, nil, ErrUpgradeNotRequested
+	}
+	if w.Started() {
+		return nil, nil, errors.New("error: cannot upgrade after the response has started")
+	}
+	if _, ok := w.W.(response.Hijacker); !ok {
+		return nil, nil, response.ErrNotHijackable
+	}
+	err := w.WriteStatusLine(response.StatusSwitchingProtocols)
+	if err != nil {
+		return nil, nil, err
+	}
+	upgradeHeaders := headers.NewHeaders()
+	for k, v := range h {
+		upgradeHeaders.Override(k, v)
+	}
+	upgradeHeaders.Override("Connection", "Upgrade")
+	upgradeHeaders.Override("Upgrade", protocol)
+	err = w.WriteHeaders(upgradeHeaders)
+	if err != nil {
+		return nil, nil, err
+	}
+	return w.Hijack()
+}
@@ -0,0 +1,163 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+)
+
+const ContentType = "text/event-stream"
+
+var ErrClosed = errors.New("error: event stream closed")
+
+// Event is one message of the stream. Empty fields are left out.
+type Event struct {
+	ID    string
+	Event string
+	// may span several lines
+	Data string
+	// how long the client should wait before reconnecting
+	Retry time.Duration
+}
+
+// Writer streams events as a chunked text/event-stream response. It is safe
+// for concurrent use.
+type Writer struct {
+	w    *response.Writer
+	ctx  context.Context
+	mu   sync.Mutex
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+// LastEventID is the id of the last event a reconnecting client received
+func LastEventID(req *request.Request) string {
+	return req.Headers.Get("Last-Event-ID")
+}
+
+// NewWriter starts the response and sends a keep-alive comment every
+// keepAlive, 0 disables them. The stream ends when the request context is
+// done, which includes the client disconnecting. The server's write timeout
+// covers the whole stream, so long-lived streams need a server without one.
+func NewWriter(w *response.Writer, req *request.Request, keepAlive time.Duration) (*Writer, error) {
+	err := w.WriteStatusLine(response.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	h := response.GetDefaultHeaders(0)
+	h.Remove("Content-Length")
+	h.Override("Content-Type", ContentType)
+	h.Override("Cache-Control", "no-cache")
+	h.Override("Transfer-Encoding", "chunked")
+	// stop nginx from buffering the stream
+	h.Override("X-Accel-Buffering", "no")
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Writer{w: w, ctx: req.Context(), done: make(chan struct{})}
+	if keepAlive > 0 {
+		go s.keepAlive(keepAlive)
+	}
+	return s, nil
+}
+
+func (s *Writer) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if s.Comment("keep-alive") != nil {
+				return
+			}
+		}
+	}
+}
+
+// Done is closed when the client went away or the request was cancelled
+func (s *Writer) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+func (s *Writer) Send(e Event) error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") {
+		return errors.New("error: event id must be a single line without NUL")
+	}
+	if strings.ContainsAny(e.Event, "\r\n") {
+		return errors.New("error: event name must be a single line")
+	}
+	b := &strings.Builder{}
+	if e.Event != "" {
+		fmt.Fprintf(b, "event: %s\n", e.Event)
+	}
+	if e.ID != "" {
+		fmt.Fprintf(b, "id: %s\n", e.ID)
+	}
+	if e.Retry > 0 {
+		fmt.Fprintf(b, "retry: %d\n", e.Retry.Milliseconds())
+	}
+	data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Comment sends a line the client ignores, which keeps idle proxies from
+// closing the connection
+func (s *Writer) Comment(text string) error {
+	b := &strings.Builder{}
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		fmt.Fprintf(b, ": %s\n", line)
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+func (s *Writer) write(p string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.ctx.Err() != nil {
+		s.err = context.Cause(s.ctx)
+		return s.err
+	}
+	_, err := s.w.WriteChunkedBody([]byte(p))
+	if err != nil {
+		s.err = err
+	}
+	return err
+}
+
+// Close stops the keep-alives and ends the response
+func (s *Writer) Close() error {
+	s.once.Do(func() { close(s.done) })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil
+	}
+	s.err = ErrClosed
+	if s.ctx.Err() != nil {
+		return nil
+	}
+	_, err := s.w.WriteChunkedBodyDone()
+	return err
+}
@@ -0,0 +1,84 @@
+package sse
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readEvent(t *testing.T, r *bufio.Reader) string {
+	event := ""
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		event += line
+		if line == "\n" {
+			return event
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	stopped := make(chan error, 1)
+	s, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		sw, err := NewWriter(w, req, 50*time.Millisecond)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer sw.Close()
+		assert.ErrorContains(t, sw.Send(Event{ID: "bad\nid"}), "single line")
+		sw.Send(Event{Data: "resumed after " + LastEventID(req), Retry: 3 * time.Second})
+		sw.Send(Event{ID: "7", Event: "update", Data: "line one\nline two\r\nline three"})
+		if req.Path() == "/short" {
+			return
+		}
+		<-sw.Done()
+		stopped <- sw.Send(Event{Data: "too late"})
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Events are framed and chunked
+	c, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	_, err = c.Write([]byte("GET /events HTTP/1.1\r\nHost: localhost\r\nLast-Event-ID: 6\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	require.NoError(t, err)
+	assert.Equal(t, ContentType, resp.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	body := bufio.NewReader(resp.Body)
+	assert.Equal(t, "retry: 3000\ndata: resumed after 6\n\n", readEvent(t, body))
+	assert.Equal(t, "event: update\nid: 7\ndata: line one\ndata: line two\ndata: line three\n\n", readEvent(t, body))
+
+	// Test: Keep-alive comments are sent while idle
+	assert.Equal(t, ": keep-alive\n\n", readEvent(t, body))
+
+	// Test: Client disconnect stops the stream
+	c.Close()
+	select {
+	case err := <-stopped:
+		assert.ErrorIs(t, err, server.ErrClientDisconnected)
+	case <-time.After(time.Second):
+		t.Fatal("stream did not stop after the client disconnected")
+	}
+
+	// Test: Close ends the chunked body
+	resp, err = http.Get("http://" + s.Addr().String() + "/short")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	all := &strings.Builder{}
+	_, err = bufio.NewReader(resp.Body).WriteTo(all)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(all.String(), "data: line three\n\n"))
+}
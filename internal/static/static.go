@@ -0,0 +1,313 @@
+package static
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/server"
+)
+
+const (
+	indexFile = "index.html"
+	// http.DetectContentType looks at no more than this
+	sniffLen  = 512
+	chunkSize = 32 << 10
+)
+
+// FileServer serves the files of an fs.FS, e.g. os.DirFS or an embed.FS,
+// under a URL prefix. Paths with ".." segments are refused, and names
+// starting with "." are hidden unless Dotfiles is set. Symlinks in an
+// os.DirFS are followed.
+type FileServer struct {
+	fsys   fs.FS
+	prefix string
+	// render a listing for directories without an index.html
+	Listing  bool
+	Dotfiles bool
+	// RenderText if nil
+	ErrorRenderer server.ErrorRenderer
+}
+
+// New serves fsys at prefix, so with prefix "/assets/" a request for
+// /assets/css/site.css opens css/site.css
+func New(prefix string, fsys fs.FS) *FileServer {
+	return &FileServer{fsys: fsys, prefix: "/" + strings.Trim(prefix, "/")}
+}
+
+func (f *FileServer) ServeRequest(w *response.Writer, req *request.Request) {
+	if !allowedMethod(w, req) {
+		return
+	}
+	server.HandleErrors(f.serve, f.ErrorRenderer)(w, req)
+}
+
+// ServeFile answers req with the named file of the file system, whatever
+// the request's path
+func (f *FileServer) ServeFile(w *response.Writer, req *request.Request, name string) {
+	if !allowedMethod(w, req) {
+		return
+	}
+	server.HandleErrors(func(w *response.Writer, req *request.Request) *server.HandlerError {
+		return f.serveName(w, req, name)
+	}, f.ErrorRenderer)(w, req)
+}
+
+func (f *FileServer) serve(w *response.Writer, req *request.Request) *server.HandlerError {
+	rawPath := req.Path()
+	rest, ok := strings.CutPrefix(rawPath, f.prefix)
+	if f.prefix == "/" {
+		rest, ok = rawPath, true
+	}
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return &server.HandlerError{StatusCode: response.StatusNotFound}
+	}
+	decoded, err := url.PathUnescape(rest)
+	if err != nil {
+		return &server.HandlerError{StatusCode: response.StatusBadRequest, Message: "Invalid path escape"}
+	}
+	if herr := f.checkPath(decoded); herr != nil {
+		return herr
+	}
+	name := strings.TrimPrefix(path.Clean("/"+decoded), "/")
+	if name == "" {
+		name = "."
+	}
+
+	info, err := fs.Stat(f.fsys, name)
+	if err != nil {
+		return openError(err)
+	}
+	if !info.IsDir() {
+		return f.serveName(w, req, name)
+	}
+	// relative links in a directory's page need the trailing slash
+	if !strings.HasSuffix(rawPath, "/") {
+		return redirect(w, req, rawPath+"/")
+	}
+	index := path.Join(name, indexFile)
+	if _, err := fs.Stat(f.fsys, index); err == nil {
+		return f.serveName(w, req, index)
+	}
+	if !f.Listing {
+		return &server.HandlerError{StatusCode: response.StatusNotFound}
+	}
+	return f.serveListing(w, req, name)
+}
+
+// allowedMethod answers anything but GET and HEAD with 405
+func allowedMethod(w *response.Writer, req *request.Request) bool {
+	switch req.RequestLine.Method {
+	case "GET", "HEAD":
+		return true
+	}
+	body := []byte("405 Method Not Allowed\n")
+	err := w.WriteStatusLine(response.StatusMethodNotAllowed)
+	if err != nil {
+		log.Printf("Error writing status line: %v", err)
+		return false
+	}
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Allow", "GET, HEAD")
+	err = w.WriteHeaders(h)
+	if err != nil {
+		log.Printf("Error writing headers: %v", err)
+		return false
+	}
+	_, err = w.WriteBody(body)
+	if err != nil {
+		log.Printf("Error writing body: %v", err)
+	}
+	return false
+}
+
+// checkPath refuses traversal outright, and hides dotfiles unless enabled
+func (f *FileServer) checkPath(decoded string) *server.HandlerError {
+	if strings.ContainsAny(decoded, "\\\x00") {
+		return &server.HandlerError{StatusCode: response.StatusBadRequest, Message: "Invalid path"}
+	}
+	for _, seg := range strings.Split(decoded, "/") {
+		if seg == ".." {
+			return &server.HandlerError{StatusCode: response.StatusBadRequest, Message: "Invalid path"}
+		}
+		if strings.HasPrefix(seg, ".") && seg != "." && !f.Dotfiles {
+			return &server.HandlerError{StatusCode: response.StatusNotFound}
+		}
+	}
+	return nil
+}
+
+func openError(err error) *server.HandlerError {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrInvalid):
+		return &server.HandlerError{StatusCode: response.StatusNotFound}
+	case errors.Is(err, fs.ErrPermission):
+		return &server.HandlerError{StatusCode: response.StatusForbidden}
+	}
+	return &server.HandlerError{StatusCode: response.StatusInternalServerError, Err: err}
+}
+
+func redirect(w *response.Writer, req *request.Request, location string) *server.HandlerError {
+	// "//host/" would send the client to another host
+	location = "/" + strings.TrimLeft(location, "/")
+	if _, query, ok := strings.Cut(req.RequestLine.RequestTarget, "?"); ok {
+		location += "?" + query
+	}
+	err := w.WriteStatusLine(response.StatusMovedPermanently)
+	if err != nil {
+		return &server.HandlerError{StatusCode: response.StatusInternalServerError, Err: err}
+	}
+	h := response.GetDefaultHeaders(0)
+	h.Remove("Content-Type")
+	h.Override("Location", location)
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return &server.HandlerError{StatusCode: response.StatusInternalServerError, Err: err}
+	}
+	return nil
+}
+
+// serveName streams one regular file with validators for conditional
+// requests
+func (f *FileServer) serveName(w *response.Writer, req *request.Request, name string) *server.HandlerError {
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return openError(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return openError(err)
+	}
+	if !info.Mode().IsRegular() {
+		return &server.HandlerError{StatusCode: response.StatusNotFound}
+	}
+
+	validators := response.Validators{
+		ETag:         response.StrongETag(fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size())),
+		LastModified: info.ModTime(),
+	}
+	written, err := w.WritePreconditions(req.RequestLine.Method, req.Headers, validators)
+	if err != nil {
+		return &server.HandlerError{StatusCode: response.StatusInternalServerError, Err: err}
+	}
+	if written {
+		return nil
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return &server.HandlerError{StatusCode: response.StatusInternalServerError, Err: err}
+	}
+	head = head[:n]
+
+	err = w.WriteStatusLine(response.StatusOK)
+	if err != nil {
+		return &server.HandlerError{StatusCode: response.StatusInternalServerError, Err: err}
+	}
+	h := response.GetDefaultHeaders(int(info.Size()))
+	h.Override("Content-Type", contentType(name, head))
+	h.Override("X-Content-Type-Options", "nosniff")
+	validators.SetHeaders(h)
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return &server.HandlerError{StatusCode: response.StatusInternalServerError, Err: err}
+	}
+	if req.RequestLine.Method == "HEAD" {
+		return nil
+	}
+
+	_, err = w.WriteBody(head)
+	if err != nil {
+		return &server.HandlerError{StatusCode: response.StatusInternalServerError, Err: err}
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			_, werr := w.WriteBody(buf[:n])
+			if werr != nil {
+				return &server.HandlerError{StatusCode: response.StatusInternalServerError, Err: werr}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &server.HandlerError{StatusCode: response.StatusInternalServerError, Err: err}
+		}
+	}
+}
+
+// contentType goes by the extension, sniffing the content for unknown ones
+func contentType(name string, head []byte) string {
+	if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+		return ct
+	}
+	return http.DetectContentType(head)
+}
+
+func (f *FileServer) serveListing(w *response.Writer, req *request.Request, name string) *server.HandlerError {
+	entries, err := fs.ReadDir(f.fsys, name)
+	if err != nil {
+		return openError(err)
+	}
+	dirPath, err := url.PathUnescape(req.Path())
+	if err != nil {
+		dirPath = req.Path()
+	}
+	title := html.EscapeString("Index of " + dirPath)
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "<!DOCTYPE html>\n<html>\n<head><title>%s</title></head>\n<body>\n<h1>%s</h1>\n<ul>\n", title, title)
+	if dirPath != "/" {
+		b.WriteString("<li><a href=\"../\">../</a></li>\n")
+	}
+	for _, e := range entries {
+		entryName := e.Name()
+		if strings.HasPrefix(entryName, ".") && !f.Dotfiles {
+			continue
+		}
+		if e.IsDir() {
+			entryName += "/"
+		}
+		href := (&url.URL{Path: entryName}).EscapedPath()
+		// a name with a colon would otherwise read as a scheme
+		if strings.Contains(strings.SplitN(entryName, "/", 2)[0], ":") {
+			href = "./" + href
+		}
+		fmt.Fprintf(b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(entryName))
+	}
+	b.WriteString("</ul>\n</body>\n</html>\n")
+	body := []byte(b.String())
+
+	err = w.WriteStatusLine(response.StatusOK)
+	if err != nil {
+		log.Printf("Error writing status line: %v", err)
+		return nil
+	}
+	h := response.GetDefaultHeaders(len(body))
+	h.Override("Content-Type", "text/html; charset=utf-8")
+	err = w.WriteHeaders(h)
+	if err != nil {
+		log.Printf("Error writing headers: %v", err)
+		return nil
+	}
+	if req.RequestLine.Method != "HEAD" {
+		_, err = w.WriteBody(body)
+		if err != nil {
+			log.Printf("Error writing body: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package static
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var modTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func testFS() fstest.MapFS {
+	return fstest.MapFS{
+		"index.html":         {Data: []byte("<h1>home</h1>"), ModTime: modTime},
+		"style.css":          {Data: []byte("body {}"), ModTime: modTime},
+		"noext":              {Data: []byte("\x89PNG\r\n\x1a\nrest"), ModTime: modTime},
+		"big.bin":            {Data: bytes.Repeat([]byte("x"), 100<<10), ModTime: modTime},
+		".env":               {Data: []byte("SECRET=1"), ModTime: modTime},
+		"docs/a <b>.txt":     {Data: []byte("a"), ModTime: modTime},
+		"docs/.hidden":       {Data: []byte("h"), ModTime: modTime},
+		"docs/sub/index.htm": {Data: []byte("not an index"), ModTime: modTime},
+	}
+}
+
+type result struct {
+	*http.Response
+	body string
+}
+
+func serve(t *testing.T, f *FileServer, method, target string, h headers.Headers) result {
+	if h == nil {
+		h = headers.NewHeaders()
+	}
+	req := &request.Request{
+		RequestLine: request.RequestLine{HttpVersion: "1.1", RequestTarget: target, Method: method},
+		Headers:     h,
+	}
+	buf := &bytes.Buffer{}
+	f.ServeRequest(&response.Writer{W: buf}, req)
+	resp, err := http.ReadResponse(bufio.NewReader(buf), &http.Request{Method: method})
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return result{resp, string(body)}
+}
+
+func TestFileServer(t *testing.T) {
+	f := New("/static/", testFS())
+
+	// Test: Files are served with a type from their extension
+	res := serve(t, f, "GET", "/static/style.css", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "text/css; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal(t, "nosniff", res.Header.Get("X-Content-Type-Options"))
+	assert.Equal(t, "7", res.Header.Get("Content-Length"))
+	assert.Equal(t, "body {}", res.body)
+
+	// Test: Files without a known extension are sniffed
+	res = serve(t, f, "GET", "/static/noext", nil)
+	assert.Equal(t, "image/png", res.Header.Get("Content-Type"))
+
+	// Test: Large files are streamed whole
+	res = serve(t, f, "GET", "/static/big.bin", nil)
+	assert.Equal(t, 100<<10, len(res.body))
+
+	// Test: HEAD has the headers but no body
+	res = serve(t, f, "HEAD", "/static/style.css", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "7", res.Header.Get("Content-Length"))
+	assert.Empty(t, res.body)
+
+	// Test: Other methods are not allowed
+	res = serve(t, f, "POST", "/static/style.css", nil)
+	assert.Equal(t, 405, res.StatusCode)
+	assert.Equal(t, "GET, HEAD", res.Header.Get("Allow"))
+
+	// Test: Validators answer conditional requests
+	etag := serve(t, f, "GET", "/static/style.css", nil).Header.Get("ETag")
+	require.NotEmpty(t, etag)
+	res = serve(t, f, "GET", "/static/style.css", headers.Headers{"if-none-match": etag})
+	assert.Equal(t, 304, res.StatusCode)
+	res = serve(t, f, "GET", "/static/style.css", headers.Headers{"if-modified-since": response.FormatHTTPDate(modTime)})
+	assert.Equal(t, 304, res.StatusCode)
+
+	// Test: Directories serve index.html
+	res = serve(t, f, "GET", "/static/", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "<h1>home</h1>", res.body)
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+
+	// Test: Directories without a trailing slash redirect, keeping the query
+	res = serve(t, f, "GET", "/static/docs?sort=name", nil)
+	assert.Equal(t, 301, res.StatusCode)
+	assert.Equal(t, "/static/docs/?sort=name", res.Header.Get("Location"))
+	res = serve(t, New("/", testFS()), "GET", "//docs", nil)
+	assert.Equal(t, "/docs/", res.Header.Get("Location"))
+
+	// Test: Directories without an index are not found unless listed
+	res = serve(t, f, "GET", "/static/docs/", nil)
+	assert.Equal(t, 404, res.StatusCode)
+	f.Listing = true
+	res = serve(t, f, "GET", "/static/docs/", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Contains(t, res.body, `<a href="a%20%3Cb%3E.txt">a &lt;b&gt;.txt</a>`)
+	assert.Contains(t, res.body, `<a href="sub/">sub/</a>`)
+	assert.NotContains(t, res.body, ".hidden")
+
+	// Test: Escaped names are decoded
+	res = serve(t, f, "GET", "/static/docs/a%20%3Cb%3E.txt", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "a", res.body)
+
+	// Test: Traversal is refused
+	for _, target := range []string{
+		"/static/../static.go",
+		"/static/docs/../../secret",
+		"/static/%2e%2e/secret",
+		"/static/docs%2f..%2f..%2fsecret",
+		"/static/docs\\..\\secret",
+		"/static/a%00b",
+	} {
+		res = serve(t, f, "GET", target, nil)
+		assert.Equal(t, 400, res.StatusCode, target)
+	}
+
+	// Test: Dotfiles are hidden unless enabled
+	res = serve(t, f, "GET", "/static/.env", nil)
+	assert.Equal(t, 404, res.StatusCode)
+	res = serve(t, f, "GET", "/static/docs/%2ehidden", nil)
+	assert.Equal(t, 404, res.StatusCode)
+	f.Dotfiles = true
+	res = serve(t, f, "GET", "/static/.env", nil)
+	assert.Equal(t, 200, res.StatusCode)
+
+	// Test: Paths outside the prefix and missing files are not found
+	res = serve(t, f, "GET", "/staticfoo", nil)
+	assert.Equal(t, 404, res.StatusCode)
+	res = serve(t, f, "GET", "/static/missing.txt", nil)
+	assert.Equal(t, 404, res.StatusCode)
+	assert.True(t, strings.HasPrefix(res.body, "404 Not Found"))
+}
+
+func TestServeFile(t *testing.T) {
+	f := New("/", testFS())
+
+	// Test: The named file is served whatever the path
+	req := &request.Request{
+		RequestLine: request.RequestLine{HttpVersion: "1.1", RequestTarget: "/video", Method: "GET"},
+		Headers:     headers.NewHeaders(),
+	}
+	buf := &bytes.Buffer{}
+	f.ServeFile(&response.Writer{W: buf}, req, "style.css")
+	assert.Contains(t, buf.String(), "body {}")
+
+	// Test: Missing files are not found
+	buf.Reset()
+	f.ServeFile(&response.Writer{W: buf}, req, "missing.mp4")
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 404"))
+}
@@ -0,0 +1,338 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// opcodes, RFC 6455 section 5.2
+const (
+	continuationFrame = 0
+	TextMessage       = 1
+	BinaryMessage     = 2
+	CloseMessage      = 8
+	PingMessage       = 9
+	PongMessage       = 10
+)
+
+// close codes, RFC 6455 section 7.4.1
+const (
+	CloseNormalClosure       = 1000
+	CloseGoingAway           = 1001
+	CloseProtocolError       = 1002
+	CloseUnsupportedData     = 1003
+	CloseNoStatusReceived    = 1005
+	CloseAbnormalClosure     = 1006
+	CloseInvalidPayload      = 1007
+	ClosePolicyViolation     = 1008
+	CloseMessageTooBig       = 1009
+	CloseInternalServerError = 1011
+)
+
+const (
+	finBit     = 0x80
+	rsvBits    = 0x70
+	opcodeMask = 0x0f
+	maskBit    = 0x80
+	// 7 bit payload lengths above 125 mean an extended length follows
+	maxPayloadLen7  = 125
+	payloadLen16    = 126
+	payloadLen64    = 127
+	maxPayloadLen16 = 0xffff
+
+	maxControlPayload = 125
+	closeCodeLen      = 2
+	maxCloseReason    = maxControlPayload - closeCodeLen
+
+	closeHandshakeTimeout = 5 * time.Second
+)
+
+var ErrClosed = errors.New("error: websocket connection closed")
+
+// CloseError is returned by ReadMessage once the peer has closed the
+// connection, or after a protocol violation made us close it
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	if e.Text == "" {
+		return fmt.Sprintf("websocket closed: %d", e.Code)
+	}
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Text)
+}
+
+// Conn is a server side websocket connection. One goroutine may read while
+// others write.
+type Conn struct {
+	conn           net.Conn
+	r              *bufio.Reader
+	maxMessageSize int64
+	// negotiated with Sec-WebSocket-Protocol, empty if none
+	Subprotocol string
+
+	wmu       sync.Mutex
+	closeSent bool
+	// set once a close frame was received or the connection failed
+	readErr error
+}
+
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+type frame struct {
+	fin     bool
+	opcode  int
+	payload []byte
+}
+
+// ReadMessage returns the next text or binary message, reassembling
+// fragments. Pings are answered and pongs dropped along the way. Once the
+// peer closes, the close is echoed and a *CloseError returned.
+func (c *Conn) ReadMessage() (messageType int, data []byte, err error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	messageType = continuationFrame
+	for {
+		f, err := c.readFrame(c.maxMessageSize - int64(len(data)))
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+		switch f.opcode {
+		case PingMessage:
+			err = c.writeFrame(PongMessage, f.payload)
+			if err != nil && !errors.Is(err, ErrClosed) {
+				return 0, nil, c.fail(err)
+			}
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			return 0, nil, c.receivedClose(f.payload)
+		case continuationFrame:
+			if messageType == continuationFrame {
+				return 0, nil, c.fail(&CloseError{Code: CloseProtocolError, Text: "continuation frame without a message"})
+			}
+		default:
+			if messageType != continuationFrame {
+				return 0, nil, c.fail(&CloseError{Code: CloseProtocolError, Text: "new message before the previous one finished"})
+			}
+			messageType = f.opcode
+		}
+		data = append(data, f.payload...)
+		if f.fin {
+			break
+		}
+	}
+	if messageType == TextMessage && !utf8.Valid(data) {
+		return 0, nil, c.fail(&CloseError{Code: CloseInvalidPayload, Text: "text message is not valid UTF-8"})
+	}
+	return messageType, data, nil
+}
+
+// readFrame reads one frame, checking the framing rules that don't depend
+// on the frames around it. Data frames may carry at most limit bytes.
+func (c *Conn) readFrame(limit int64) (frame, error) {
+	var head [2]byte
+	_, err := io.ReadFull(c.r, head[:])
+	if err != nil {
+		return frame{}, err
+	}
+	f := frame{fin: head[0]&finBit != 0, opcode: int(head[0] & opcodeMask)}
+	if head[0]&rsvBits != 0 {
+		return f, &CloseError{Code: CloseProtocolError, Text: "reserved bits set"}
+	}
+	switch f.opcode {
+	case continuationFrame, TextMessage, BinaryMessage:
+	case CloseMessage, PingMessage, PongMessage:
+		if !f.fin {
+			return f, &CloseError{Code: CloseProtocolError, Text: "fragmented control frame"}
+		}
+	default:
+		return f, &CloseError{Code: CloseProtocolError, Text: fmt.Sprintf("unknown opcode %d", f.opcode)}
+	}
+	// clients must mask every frame, section 5.1
+	if head[1]&maskBit == 0 {
+		return f, &CloseError{Code: CloseProtocolError, Text: "unmasked client frame"}
+	}
+
+	length := uint64(head[1] &^ maskBit)
+	switch length {
+	case payloadLen16:
+		var ext [2]byte
+		_, err = io.ReadFull(c.r, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case payloadLen64:
+		var ext [8]byte
+		_, err = io.ReadFull(c.r, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return f, &CloseError{Code: CloseProtocolError, Text: "payload length has the most significant bit set"}
+		}
+	}
+	if err != nil {
+		return f, err
+	}
+	if f.opcode >= CloseMessage && length > maxControlPayload {
+		return f, &CloseError{Code: CloseProtocolError, Text: "control frame payload too long"}
+	}
+	if f.opcode < CloseMessage && length > uint64(max(limit, 0)) {
+		return f, &CloseError{Code: CloseMessageTooBig, Text: fmt.Sprintf("message exceeds %d bytes", c.maxMessageSize)}
+	}
+
+	var key [4]byte
+	_, err = io.ReadFull(c.r, key[:])
+	if err != nil {
+		return f, err
+	}
+	f.payload = make([]byte, length)
+	_, err = io.ReadFull(c.r, f.payload)
+	if err != nil {
+		return f, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= key[i%4]
+	}
+	return f, nil
+}
+
+// receivedClose validates a close frame, echoes it and ends the connection
+func (c *Conn) receivedClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+	switch {
+	case len(payload) == 1:
+		return c.fail(&CloseError{Code: CloseProtocolError, Text: "close frame payload of 1 byte"})
+	case len(payload) >= closeCodeLen:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Text = string(payload[closeCodeLen:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(&CloseError{Code: CloseProtocolError, Text: fmt.Sprintf("invalid close code %d", closeErr.Code)})
+		}
+		if !utf8.ValidString(closeErr.Text) {
+			return c.fail(&CloseError{Code: CloseInvalidPayload, Text: "close reason is not valid UTF-8"})
+		}
+	}
+	echo := closeErr.Code
+	if echo == CloseNoStatusReceived {
+		echo = CloseNormalClosure
+	}
+	c.writeClose(echo, "")
+	c.conn.Close()
+	c.readErr = closeErr
+	return closeErr
+}
+
+// fail ends the connection after a read error, telling the peer why when
+// the error is a protocol violation
+func (c *Conn) fail(err error) error {
+	var closeErr *CloseError
+	if errors.As(err, &closeErr) {
+		c.writeClose(closeErr.Code, closeErr.Text)
+	} else {
+		err = errors.Join(&CloseError{Code: CloseAbnormalClosure}, err)
+	}
+	c.conn.Close()
+	c.readErr = err
+	return err
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// WriteMessage sends data as a single text or binary frame
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	switch messageType {
+	case TextMessage:
+		if !utf8.Valid(data) {
+			return errors.New("error: text message is not valid UTF-8")
+		}
+	case BinaryMessage:
+	default:
+		return fmt.Errorf("error: invalid message type %d", messageType)
+	}
+	return c.writeFrame(messageType, data)
+}
+
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return errors.New("error: ping payload too long")
+	}
+	return c.writeFrame(PingMessage, data)
+}
+
+// Close sends a close frame with code and reason, waits briefly for the
+// peer to answer and closes the connection. It must not be called while
+// another goroutine is in ReadMessage.
+func (c *Conn) Close(code int, reason string) error {
+	if len(reason) > maxCloseReason {
+		// cut on a rune boundary, the peer fails a close with invalid UTF-8
+		n := maxCloseReason
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+	err := c.writeClose(code, reason)
+	if err == nil && c.readErr == nil {
+		c.conn.SetReadDeadline(time.Now().Add(closeHandshakeTimeout))
+		for c.readErr == nil {
+			c.ReadMessage()
+		}
+	}
+	c.conn.Close()
+	if errors.Is(err, ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (c *Conn) writeClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	return c.writeFrame(CloseMessage, payload)
+}
+
+// writeFrame sends an unmasked frame, servers never mask. Nothing can be
+// sent after a close frame.
+func (c *Conn) writeFrame(opcode int, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if opcode == CloseMessage {
+		c.closeSent = true
+	}
+	buf := make([]byte, 0, len(payload)+10)
+	buf = append(buf, finBit|byte(opcode))
+	switch n := len(payload); {
+	case n <= maxPayloadLen7:
+		buf = append(buf, byte(n))
+	case n <= maxPayloadLen16:
+		buf = append(buf, payloadLen16)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, payloadLen64)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	buf = append(buf, payload...)
+	_, err := c.conn.Write(buf)
+	return err
+}
@@ -0,0 +1,147 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/headers"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/server"
+)
+
+// magic value from RFC 6455 section 1.3
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const DefaultMaxMessageSize = 1 << 20
+
+var ErrBadHandshake = errors.New("error: bad websocket handshake")
+
+// Upgrader turns a request into a websocket connection
+type Upgrader struct {
+	// largest message ReadMessage accepts, DefaultMaxMessageSize if 0
+	MaxMessageSize int64
+	// offered to the client in order of preference
+	Subprotocols []string
+	// CheckOrigin returns whether a browser page from another origin may
+	// connect. If nil only same-origin requests, or ones without an Origin
+	// header, are allowed.
+	CheckOrigin func(req *request.Request) bool
+}
+
+// AcceptKey computes Sec-WebSocket-Accept for a Sec-WebSocket-Key
+func AcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Upgrade validates the handshake and switches the connection to the
+// websocket protocol. On failure an error response has been written and
+// the handler should just return.
+func (u *Upgrader) Upgrade(w *response.Writer, req *request.Request) (*Conn, error) {
+	if req.RequestLine.Method != "GET" {
+		return nil, handshakeError(w, response.StatusMethodNotAllowed, "websocket requests must use GET", headers.Headers{"allow": "GET"})
+	}
+	if !server.IsUpgrade(req, "websocket") {
+		return nil, handshakeError(w, response.StatusUpgradeRequired, "expected a websocket upgrade request", headers.Headers{"upgrade": "websocket", "connection": "Upgrade"})
+	}
+	if req.Headers.Get("Sec-WebSocket-Version") != "13" {
+		return nil, handshakeError(w, response.StatusUpgradeRequired, "unsupported websocket version", headers.Headers{"sec-websocket-version": "13"})
+	}
+	key := strings.TrimSpace(req.Headers.Get("Sec-WebSocket-Key"))
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 16 {
+		return nil, handshakeError(w, response.StatusBadRequest, "invalid Sec-WebSocket-Key", nil)
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		return nil, handshakeError(w, response.StatusForbidden, "origin not allowed", nil)
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Sec-WebSocket-Accept", AcceptKey(key))
+	subprotocol := u.selectSubprotocol(req)
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	netConn, buffered, err := server.Upgrade(w, req, "websocket", h)
+	if err != nil {
+		return nil, err
+	}
+
+	maxSize := u.MaxMessageSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	return &Conn{
+		conn:           netConn,
+		r:              bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), netConn)),
+		maxMessageSize: maxSize,
+		Subprotocol:    subprotocol,
+	}, nil
+}
+
+func (u *Upgrader) selectSubprotocol(req *request.Request) string {
+	offered := []string{}
+	for _, p := range strings.Split(req.Headers.Get("Sec-WebSocket-Protocol"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			offered = append(offered, p)
+		}
+	}
+	for _, p := range u.Subprotocols {
+		if slices.Contains(offered, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+func sameOrigin(req *request.Request) bool {
+	origin := req.Headers.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	defaultPort := "80"
+	if u.Scheme == "https" {
+		defaultPort = "443"
+	}
+	return request.NormalizeHost(u.Host, defaultPort) == req.Host()
+}
+
+func handshakeError(w *response.Writer, sc response.StatusCode, msg string, extra headers.Headers) error {
+	herr := fmt.Errorf("%w: %s", ErrBadHandshake, msg)
+	body := []byte(fmt.Sprintf("%d %s\n%s\n", sc, response.StatusText(sc), msg))
+	err := w.WriteStatusLine(sc)
+	if err != nil {
+		return errors.Join(herr, err)
+	}
+	h := response.GetDefaultHeaders(len(body))
+	for k, v := range extra {
+		h.Override(k, v)
+	}
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return errors.Join(herr, err)
+	}
+	_, err = w.WriteBody(body)
+	if err != nil {
+		return errors.Join(herr, err)
+	}
+	return herr
+}
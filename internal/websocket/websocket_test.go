@@ -0,0 +1,279 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/request"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/response"
+	"github.com/AkuPython/Learn-the-HTTP-Protocol/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const handshake = "GET /ws HTTP/1.1\r\n" +
+	"Host: localhost\r\n" +
+	"Connection: Upgrade\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Sec-WebSocket-Version: 13\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+
+type client struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func echoServer(t *testing.T, u *Upgrader) *server.Server {
+	s, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		c, err := u.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		for {
+			mt, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if string(data) == "bye" {
+				c.Close(CloseGoingAway, "done")
+				return
+			}
+			if string(data) == "long bye" {
+				c.Close(CloseGoingAway, strings.Repeat("é", 100))
+				return
+			}
+			c.WriteMessage(mt, data)
+		}
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func dial(t *testing.T, s *server.Server, extraHeaders string) (*client, *http.Response) {
+	c, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = c.Write([]byte(handshake + extraHeaders + "\r\n"))
+	require.NoError(t, err)
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	return &client{Conn: c, r: r}, resp
+}
+
+func (c *client) writeFrame(t *testing.T, first byte, payload []byte) {
+	buf := []byte{first}
+	switch {
+	case len(payload) <= 125:
+		buf = append(buf, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(payload)))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(len(payload)))
+	}
+	key := []byte{1, 2, 3, 4}
+	buf = append(buf, key...)
+	for i, b := range payload {
+		buf = append(buf, b^key[i%4])
+	}
+	_, err := c.Write(buf)
+	require.NoError(t, err)
+}
+
+func (c *client) readFrame(t *testing.T) (byte, []byte) {
+	var head [2]byte
+	_, err := io.ReadFull(c.r, head[:])
+	require.NoError(t, err)
+	assert.Zero(t, head[1]&maskBit, "server frames must not be masked")
+	length := int(head[1])
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.r, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.r, ext[:])
+		length = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.r, payload)
+	require.NoError(t, err)
+	return head[0], payload
+}
+
+func (c *client) expectClose(t *testing.T, code int) {
+	first, payload := c.readFrame(t)
+	assert.Equal(t, byte(finBit|CloseMessage), first)
+	require.GreaterOrEqual(t, len(payload), 2)
+	assert.Equal(t, code, int(binary.BigEndian.Uint16(payload)), string(payload[2:]))
+}
+
+func TestAcceptKey(t *testing.T) {
+	// Test: Example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestHandshake(t *testing.T) {
+	s := echoServer(t, &Upgrader{Subprotocols: []string{"chat", "superchat"}})
+
+	// Test: Valid handshake switches protocols
+	_, resp := dial(t, s, "Sec-WebSocket-Protocol: superchat, chat\r\n")
+	assert.Equal(t, 101, resp.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	assert.Equal(t, "chat", resp.Header.Get("Sec-WebSocket-Protocol"))
+	assert.Equal(t, "websocket", resp.Header.Get("Upgrade"))
+
+	// Test: Invalid handshakes are refused
+	cases := map[string]struct {
+		request string
+		status  int
+	}{
+		"bad version":     {strings.Replace(handshake, "Version: 13", "Version: 8", 1), 426},
+		"bad key":         {strings.Replace(handshake, "dGhlIHNhbXBsZSBub25jZQ==", "short", 1), 400},
+		"not an upgrade":  {strings.Replace(handshake, "Connection: Upgrade", "Connection: close", 1), 426},
+		"wrong method":    {strings.Replace(handshake, "GET", "POST", 1), 405},
+		"foreign origin":  {handshake + "Origin: https://evil.example\r\n", 403},
+		"matching origin": {handshake + "Origin: http://localhost\r\n", 101},
+		"normalized host": {strings.Replace(handshake, "Host: localhost", "Host: LocalHost.:80", 1) + "Origin: http://localhost\r\n", 101},
+	}
+	for name, tc := range cases {
+		c, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		_, err = c.Write([]byte(tc.request + "\r\n"))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		require.NoError(t, err, name)
+		assert.Equal(t, tc.status, resp.StatusCode, name)
+		if tc.status == 426 && name == "bad version" {
+			assert.Equal(t, "13", resp.Header.Get("Sec-WebSocket-Version"))
+		}
+		c.Close()
+	}
+}
+
+func TestMessages(t *testing.T) {
+	s := echoServer(t, &Upgrader{MaxMessageSize: 70000})
+
+	// Test: Text, binary and 16 bit length messages are echoed
+	c, _ := dial(t, s, "")
+	c.writeFrame(t, finBit|TextMessage, []byte("hello"))
+	first, payload := c.readFrame(t)
+	assert.Equal(t, byte(finBit|TextMessage), first)
+	assert.Equal(t, "hello", string(payload))
+
+	big := []byte(strings.Repeat("x", 300))
+	c.writeFrame(t, finBit|BinaryMessage, big)
+	first, payload = c.readFrame(t)
+	assert.Equal(t, byte(finBit|BinaryMessage), first)
+	assert.Equal(t, big, payload)
+
+	// Test: 64 bit length message
+	huge := []byte(strings.Repeat("y", 66000))
+	c.writeFrame(t, finBit|BinaryMessage, huge)
+	_, payload = c.readFrame(t)
+	assert.Equal(t, huge, payload)
+
+	// Test: Fragments with a ping in between are reassembled
+	c.writeFrame(t, TextMessage, []byte("frag"))
+	c.writeFrame(t, finBit|PingMessage, []byte("are you there"))
+	c.writeFrame(t, continuationFrame, []byte("men"))
+	c.writeFrame(t, finBit|continuationFrame, []byte("ted"))
+	first, payload = c.readFrame(t)
+	assert.Equal(t, byte(finBit|PongMessage), first)
+	assert.Equal(t, "are you there", string(payload))
+	first, payload = c.readFrame(t)
+	assert.Equal(t, byte(finBit|TextMessage), first)
+	assert.Equal(t, "fragmented", string(payload))
+
+	// Test: Client close is echoed
+	c.writeFrame(t, finBit|CloseMessage, binary.BigEndian.AppendUint16(nil, CloseNormalClosure))
+	c.expectClose(t, CloseNormalClosure)
+
+	// Test: Server initiated close
+	c, _ = dial(t, s, "")
+	c.writeFrame(t, finBit|TextMessage, []byte("bye"))
+	first, payload = c.readFrame(t)
+	assert.Equal(t, byte(finBit|CloseMessage), first)
+	assert.Equal(t, CloseGoingAway, int(binary.BigEndian.Uint16(payload)))
+	assert.Equal(t, "done", string(payload[2:]))
+	c.writeFrame(t, finBit|CloseMessage, payload[:2])
+	_, err := c.r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Long close reasons are cut on a rune boundary
+	c, _ = dial(t, s, "")
+	c.writeFrame(t, finBit|TextMessage, []byte("long bye"))
+	_, payload = c.readFrame(t)
+	assert.Equal(t, strings.Repeat("é", maxCloseReason/2), string(payload[2:]))
+	assert.True(t, utf8.Valid(payload[2:]))
+}
+
+func TestProtocolErrors(t *testing.T) {
+	s := echoServer(t, &Upgrader{MaxMessageSize: 10})
+
+	cases := []struct {
+		name   string
+		frames func(t *testing.T, c *client)
+		code   int
+	}{
+		{"unmasked frame", func(t *testing.T, c *client) {
+			c.Write([]byte{finBit | TextMessage, 2, 'h', 'i'})
+		}, CloseProtocolError},
+		{"reserved bits", func(t *testing.T, c *client) {
+			c.writeFrame(t, finBit|0x40|TextMessage, []byte("hi"))
+		}, CloseProtocolError},
+		{"unknown opcode", func(t *testing.T, c *client) {
+			c.writeFrame(t, finBit|3, []byte("hi"))
+		}, CloseProtocolError},
+		{"fragmented ping", func(t *testing.T, c *client) {
+			c.writeFrame(t, PingMessage, []byte("hi"))
+		}, CloseProtocolError},
+		{"long ping", func(t *testing.T, c *client) {
+			c.writeFrame(t, finBit|PingMessage, make([]byte, 126))
+		}, CloseProtocolError},
+		{"continuation without start", func(t *testing.T, c *client) {
+			c.writeFrame(t, finBit|continuationFrame, []byte("hi"))
+		}, CloseProtocolError},
+		{"interleaved message", func(t *testing.T, c *client) {
+			c.writeFrame(t, TextMessage, []byte("a"))
+			c.writeFrame(t, finBit|TextMessage, []byte("b"))
+		}, CloseProtocolError},
+		{"invalid UTF-8", func(t *testing.T, c *client) {
+			c.writeFrame(t, finBit|TextMessage, []byte{0xff, 0xfe})
+		}, CloseInvalidPayload},
+		{"message too big", func(t *testing.T, c *client) {
+			c.writeFrame(t, finBit|BinaryMessage, make([]byte, 11))
+		}, CloseMessageTooBig},
+		{"fragments too big", func(t *testing.T, c *client) {
+			c.writeFrame(t, BinaryMessage, make([]byte, 6))
+			c.writeFrame(t, finBit|continuationFrame, make([]byte, 6))
+		}, CloseMessageTooBig},
+		{"invalid close code", func(t *testing.T, c *client) {
+			c.writeFrame(t, finBit|CloseMessage, binary.BigEndian.AppendUint16(nil, 1005))
+		}, CloseProtocolError},
+		{"one byte close", func(t *testing.T, c *client) {
+			c.writeFrame(t, finBit|CloseMessage, []byte{3})
+		}, CloseProtocolError},
+	}
+
+	// Test: Protocol violations close the connection with a status code
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, _ := dial(t, s, "")
+			tc.frames(t, c)
+			c.expectClose(t, tc.code)
+		})
+	}
+}